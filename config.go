@@ -1,11 +1,17 @@
 package main
 
 import (
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"github.com/cobookman/s3-parallel-downloader/downloaders"
 	flag "github.com/spf13/pflag"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
 type Config struct {
@@ -23,12 +29,118 @@ type Config struct {
 	isBenchmark bool
 	loglevel    string
 	cpuprofile  string
+
+	// http transport flags
+	maxIdleConns          int
+	maxIdleConnsPerHost   int
+	idleConnTimeout       time.Duration
+	keepAlive             time.Duration
+	tlsHandshakeTimeout   time.Duration
+	responseHeaderTimeout time.Duration
+	socketReadBuffer      int
+	socketWriteBuffer     int
+	proxy                 string
+	spreadIPs             bool
+	dnsRefresh            time.Duration
+	maxIPs                int
+
+	// shared by every HTTP client when --spread-ips is set, so that connections are spread & counted across all of them
+	spreader *downloaders.IPSpreader
+
+	// S3 compatible endpoint flags
+	endpointURL    string
+	forcePathStyle bool
+	noVerifySSL    bool
+	caBundle       string
+
+	// credential flags, the source & destination flags override the shared ones
+	profile          string
+	roleARN          string
+	roleSessionName  string
+	externalID       string
+	sourceProfile    string
+	sourceRoleARN    string
+	sourceExternalID string
+	destProfile      string
+	destRoleARN      string
+	destExternalID   string
+
+	// request flags
+	requesterPays        bool
+	expectedBucketOwner  string
+	sseCustomerAlgorithm string
+	sseCustomerKey       string
+
+	// version flags
+	asOf      time.Time
+	versionId string
+
+	// glacier restore flags
+	restore     bool
+	restoreTier string
+	restoreDays int
+	restorePoll time.Duration
+
+	// metadata flags
+	preserveMtime bool
+	xattrs        bool
+	xattrTags     bool
+
+	// path mapping flags
+	onConflict     string
+	conflictSuffix string
+	conflictDir    string
+	mappingReport  string
+	outputTemplate string
+	rename         []string
+
+	// striping flags
+	destRoots      []string
+	stripeBy       string
+	stripeManifest string
+
+	// transfer manifest & run summary flags
+	manifestOut string
+	summaryJSON string
+
+	// every destination, when copying to more than one
+	destinations []string
+
+	// streaming flags
+	streamWindow int64
+
+	// partial & concatenated download flags
+	byteRange string
+	concat    string
+
+	// decompression & extraction flags
+	decompress bool
+	extract    bool
+
+	// zip member extraction flags
+	zipInclude []string
+	zipList    bool
+
+	// shard packing flags
+	pack        bool
+	shardSize   int64
+	groupByStem bool
+
+	// tar index flags
+	indexTar   bool
+	tarIndex   string
+	tarInclude []string
 }
 
 func NewConfig(args []string) (c *Config, err error) {
 	c = &Config{}
-	err = c.parse(args)
-	return c, err
+	if err = c.parse(args); err != nil {
+		return c, err
+	}
+	if c.spreadIPs {
+		c.spreader = downloaders.NewIPSpreader(c.dnsRefresh, c.maxIPs)
+	}
+	return c, nil
 }
 
 func (c *Config) parse(args []string) (err error) {
@@ -51,6 +163,106 @@ func (c *Config) parse(args []string) (err error) {
 	// interfaces, improving performance.
 	f.StringVar(&c.nics, "nics", "", "to send load across multiple NICs, set to a list of network interfaces to LB across E.g. (--nics=en0,en1,en2,en3)")
 
+	// Tuning of the HTTP connections made to S3. With hundreds of concurrent requests the Go defaults
+	// (2 idle connections per host) cause connections to be constantly closed and re-opened.
+	f.IntVar(&c.maxIdleConns, "max-idle-conns", 0, "max number of idle HTTP connections kept open across all hosts, 0 is unlimited (Default 0)")
+	f.IntVar(&c.maxIdleConnsPerHost, "max-idle-conns-per-host", 0, "max number of idle HTTP connections kept open per host, 0 uses workers*threads (Default 0)")
+	f.DurationVar(&c.idleConnTimeout, "idle-conn-timeout", 90*time.Second, "how long an idle HTTP connection is kept open (Default 90s)")
+	f.DurationVar(&c.keepAlive, "keepalive", 30*time.Second, "interval between TCP keepalive probes, negative disables keepalives (Default 30s)")
+	f.DurationVar(&c.tlsHandshakeTimeout, "tls-handshake-timeout", 10*time.Second, "max time to wait for a TLS handshake, 0 is no timeout (Default 10s)")
+	f.DurationVar(&c.responseHeaderTimeout, "response-header-timeout", 0, "max time to wait for a response's headers after sending a request, 0 is no timeout (Default 0)")
+	f.IntVar(&c.socketReadBuffer, "socket-read-buffer", 0, "size in bytes of each TCP socket's receive buffer, 0 uses the OS default (Default 0)")
+	f.IntVar(&c.socketWriteBuffer, "socket-write-buffer", 0, "size in bytes of each TCP socket's send buffer, 0 uses the OS default (Default 0)")
+	f.StringVar(&c.proxy, "proxy", "", "HTTP proxy url to send requests through, when unset uses HTTP_PROXY, HTTPS_PROXY & NO_PROXY env vars")
+
+	// S3's DNS only returns a few of its IPs per lookup, spreading connections across the IPs
+	// seen over multiple lookups avoids pinning most connections to a single S3 front end
+	f.BoolVar(&c.spreadIPs, "spread-ips", false, "spread connections across the distinct IPs S3's endpoint resolves to (Default false)")
+	f.DurationVar(&c.dnsRefresh, "dns-refresh", 30*time.Second, "how often S3's endpoint is re-resolved when --spread-ips is set (Default 30s)")
+	f.IntVar(&c.maxIPs, "max-ips", 16, "max number of distinct IPs to spread connections across when --spread-ips is set (Default 16)")
+
+	// Allows using S3 compatible stores such-as MinIO, Ceph RGW & Cloudflare R2, or S3 VPC interface endpoints
+	f.StringVar(&c.endpointURL, "endpoint-url", "", "send S3 requests to this endpoint instead of AWS's E.g. (--endpoint-url=http://localhost:9000)")
+	f.BoolVar(&c.forcePathStyle, "force-path-style", false, "address buckets as endpoint/bucket rather than bucket.endpoint (Default false)")
+	f.BoolVar(&c.noVerifySSL, "no-verify-ssl", false, "skip verifying the endpoint's TLS certificate (Default false)")
+	f.StringVar(&c.caBundle, "ca-bundle", "", "path to a PEM file of CA certificates to trust when verifying the endpoint's TLS certificate")
+
+	// When copying across accounts each side of the transfer can use its own credentials
+	f.StringVar(&c.profile, "profile", "", "named profile from ~/.aws/config & ~/.aws/credentials to get credentials from")
+	f.StringVar(&c.roleARN, "role-arn", "", "IAM role to assume for S3 requests, credentials are refreshed before they expire")
+	f.StringVar(&c.roleSessionName, "role-session-name", "s3pd", "session name used when assuming --role-arn (Default \"s3pd\")")
+	f.StringVar(&c.externalID, "external-id", "", "external ID used when assuming --role-arn")
+	f.StringVar(&c.sourceProfile, "source-profile", "", "overrides --profile for the source S3 location")
+	f.StringVar(&c.sourceRoleARN, "source-role-arn", "", "overrides --role-arn for the source S3 location")
+	f.StringVar(&c.sourceExternalID, "source-external-id", "", "overrides --external-id for the source S3 location")
+	f.StringVar(&c.destProfile, "dest-profile", "", "overrides --profile for the destination S3 location")
+	f.StringVar(&c.destRoleARN, "dest-role-arn", "", "overrides --role-arn for the destination S3 location")
+	f.StringVar(&c.destExternalID, "dest-external-id", "", "overrides --external-id for the destination S3 location")
+
+	f.BoolVar(&c.requesterPays, "request-payer", false, "acknowledge you'll be charged for requests to a requester-pays bucket (Default false)")
+	f.StringVar(&c.expectedBucketOwner, "expected-bucket-owner", "", "AWS account ID that must own the bucket, requests fail otherwise")
+	f.StringVar(&c.sseCustomerAlgorithm, "sse-c", "AES256", "server-side encryption algorithm used with --sse-c-key (Default \"AES256\")")
+	f.StringVar(&c.sseCustomerKey, "sse-c-key", "", "base64 encoded 256-bit key the objects were encrypted with using SSE-C")
+
+	// Reproduce a dataset as it looked at a point in time, using the bucket's object versions
+	var asOf string
+	f.StringVar(&asOf, "as-of", "", "download the newest version of each object as of this RFC3339 time or date E.g. (--as-of=2024-01-02T15:04:05Z)")
+	f.StringVar(&c.versionId, "version-id", "", "download this version of the single object given as the source")
+
+	// Objects in GLACIER & DEEP_ARCHIVE must be restored before they can be downloaded, which takes minutes to hours
+	f.BoolVar(&c.restore, "restore", false, "restore objects in GLACIER & DEEP_ARCHIVE, downloading each one once available (Default false)")
+	f.StringVar(&c.restoreTier, "restore-tier", "Standard", "retrieval tier used to restore archived objects: Expedited, Standard or Bulk (Default \"Standard\")")
+	f.IntVar(&c.restoreDays, "restore-days", 1, "number of days restored copies of archived objects are kept for (Default 1)")
+	f.DurationVar(&c.restorePoll, "restore-poll", 5*time.Minute, "how often archived objects are checked to see if they've been restored (Default 5m)")
+
+	// Keeps S3 metadata with downloaded files, and restores it when uploading those files back to S3
+	f.BoolVar(&c.preserveMtime, "preserve-mtime", false, "set downloaded files' modification time to the object's LastModified time (Default false)")
+	f.BoolVar(&c.xattrs, "xattrs", false, "store ETag, Content-Type & x-amz-meta-* metadata in user.s3.* xattrs when downloading, and restore them when uploading (Default false)")
+	f.BoolVar(&c.xattrTags, "xattr-tags", false, "also store object tags in user.s3.tag.* xattrs when downloading with --xattrs (Default false)")
+
+	// POSIX filesystems can't hold a file & folder with the same path, e.g. the objects a/test.txt & a/test.txt/other
+	f.StringVar(&c.onConflict, "on-conflict", "fail", "what to do with objects that have the same path as a folder: fail, fail-upfront, rename or sidecar (Default \"fail\")")
+	f.StringVar(&c.conflictSuffix, "conflict-suffix", ".s3pd-file", "suffix appended to conflicting objects' names with --on-conflict=rename (Default \".s3pd-file\")")
+	f.StringVar(&c.conflictDir, "conflict-dir", ".s3pd-conflicts", "folder under the destination conflicting objects are written to with --on-conflict=sidecar (Default \".s3pd-conflicts\")")
+	f.StringVar(&c.outputTemplate, "output-template", "", "path objects are written to under the destination, using {key}, {path}, {rel}, {basename}, {etag} & {prefix_N} E.g. (--output-template={prefix_1}/{basename})")
+	f.StringArrayVar(&c.rename, "rename", nil, "sed style regex substitution applied to each path, can be repeated E.g. (--rename='s|date=(\\d+)-(\\d+)-(\\d+)|$1/$2/$3|')")
+	f.StringVar(&c.mappingReport, "mapping-report", "", "write the path each object is written to, and why, to this file as tab separated values")
+
+	// Destination roots in addition to the destination, e.g. NVMe drives that aren't in a RAID, spread the objects across them all
+	f.StringArrayVar(&c.destRoots, "dest-root", nil, "spread the objects across this root as well as the destination, can be repeated E.g. (--dest-root=/mnt/nvme1 --dest-root=/mnt/nvme2)")
+	f.StringVar(&c.stripeBy, "stripe-by", "round-robin", "how objects are spread across the destination & --dest-root roots: round-robin, free-space or hash (Default \"round-robin\")")
+	f.StringVar(&c.stripeManifest, "stripe-manifest", "", "write the destination root & path each object is written to, to this file as tab separated values")
+
+	// A record of every object transferred, for lineage & auditing
+	f.StringVar(&c.summaryJSON, "summary-json", "", "write the run's totals, timings, per-object latency percentiles, requests by API & settings to this file as JSON")
+	f.StringVar(&c.manifestOut, "manifest-out", "", "write a JSON line per object transferred, with its key, version, ETag, size, destination, timings, retries, NICs & CRC32C, to this file")
+
+	// A destination of - streams objects to stdout, e.g. to pipe into tar
+	f.Int64Var(&c.streamWindow, "stream-window", 0, "bytes of each object fetched ahead of what's been written when streaming to stdout (Default 2*threads*partsize)")
+
+	// Download part of a huge object, or join many objects, e.g. part-* files, into one
+	f.StringVar(&c.byteRange, "range", "", "download only this inclusive byte range of the single object given as the source E.g. (--range=0-1048575 or --range=1048576-)")
+	f.StringVar(&c.concat, "concat", "", "concatenate the objects, in key order, into this file instead of taking a [destination]")
+
+	// Saves decompressing .gz & .zst objects as a second pass over the disk
+	f.BoolVar(&c.decompress, "decompress", false, "decompress gzip & zstd objects, found by their .gz/.zst extension or Content-Encoding, as they're downloaded (Default false)")
+
+	f.BoolVar(&c.extract, "extract", false, "unpack .tar, .tar.gz & .tar.zst objects into the destination as they're downloaded, rather than writing the archive (Default false)")
+
+	// Only the central directory & matching members of a zip object are downloaded
+	f.StringArrayVar(&c.zipInclude, "zip-include", nil, "extract the members of the zip object matching this pattern, or in a folder matching it, can be repeated E.g. (--zip-include='images/*.jpg')")
+	f.BoolVar(&c.zipList, "zip-list", false, "list the members of the zip object, matching --zip-include when set, instead of extracting them (Default false)")
+
+	// Millions of small files are hard on filesystems' metadata servers, so objects can be packed into tar shards instead
+	f.BoolVar(&c.pack, "pack", false, "pack the objects into tar shards, with an index.tsv of each object's shard & offset, rather than writing a file per object (Default false)")
+	f.Int64Var(&c.shardSize, "shard-size", 1024*1024*1024, "bytes each tar shard is filled to before starting the next with --pack (Default 1GiB)")
+	f.BoolVar(&c.groupByStem, "group-by-stem", false, "keep objects with the same key stem, E.g. 0001.jpg & 0001.json, together in a shard as WebDataset expects (Default false)")
+
+	// Tar objects indexed with --index-tar can have their files extracted without downloading the whole archive
+	f.StringArrayVar(&c.tarInclude, "tar-include", nil, "extract the files of the tar object matching this pattern, or in a folder matching it, using its index, can be repeated E.g. (--tar-include='images/*.jpg')")
+	f.BoolVar(&c.indexTar, "index-tar", false, "index the files in the source tar object, storing the index at --tar-index, rather than downloading it (Default false)")
+	f.StringVar(&c.tarIndex, "tar-index", "", "local path or s3:// url of the tar object's index made by --index-tar (Default [tar object].index.tsv)")
+
 	f.StringVar(&c.loglevel, "loglevel", "NOTICE", "Level of logging to expose, INFO, NOTICE, WARNING, ERROR. (Default \"NOTICE\")")
 	f.StringVar(&c.cpuprofile, "cpuprofile", "", "Writes cpu profile to specified filepath")
 
@@ -59,7 +271,8 @@ func (c *Config) parse(args []string) (err error) {
 		fmt.Fprintf(w, "\033[1mDESCRIPTION:\033[0m\n")
 		fmt.Fprintf(w, "3pd is a utility for downloading or uploading multiple S3 objects at a time using multiple threads\n\n")
 		fmt.Fprintf(w, "\033[1mUSAGE:\033[0m\n")
-		fmt.Fprintf(w, "s3pd [flags] [source] [destination]\n\n")
+		fmt.Fprintf(w, "s3pd [flags] [source] [destination] [more destinations...]\n")
+		fmt.Fprintf(w, "s3pd [flags] --index-tar [tar object]\n\n")
 		fmt.Fprintf(w, "\033[1mEXAMPLES:\033[0m\n")
 		fmt.Fprintf(w, "The following is how to download objects in mybucket with the prefix of mydataset/* to /mnt/scratch\n\n")
 		fmt.Fprintf(w, "\ts3pd s3://mybucket/mydataset/* /mnt/scratch\n\n\n")
@@ -69,7 +282,11 @@ func (c *Config) parse(args []string) (err error) {
 		fmt.Fprintf(w, "The following is how to download objects in mybucket with the prefix of mydataset/* to /mnt/scratch")
 		fmt.Fprintf(w, "using the s3 api in us-east-2, and downloading 25 objects at a time. With 5 threads used ")
 		fmt.Fprintf(w, "to download each object. 125 concurrent s3 downloads total)\n\n")
-		fmt.Fprintf(w, "\ts3pd s3://mybucket/mydataset/* /mnt/scratch --region=us-east-2 --workers=25 --threads=5\n\n")
+		fmt.Fprintf(w, "\ts3pd s3://mybucket/mydataset/* /mnt/scratch --region=us-east-2 --workers=25 --threads=5\n\n\n")
+		fmt.Fprintf(w, "The following is how to index the files in a tar object, storing the index next to it, and then ")
+		fmt.Fprintf(w, "extract only the jpgs from it to /mnt/scratch\n\n")
+		fmt.Fprintf(w, "\ts3pd --index-tar s3://mybucket/mydataset.tar\n")
+		fmt.Fprintf(w, "\ts3pd s3://mybucket/mydataset.tar /mnt/scratch --tar-include='*.jpg'\n\n")
 		fmt.Fprintf(w, "\033[1mFLAGS:\033[0m\n")
 		flag.PrintDefaults()
 	}
@@ -85,19 +302,258 @@ func (c *Config) parse(args []string) (err error) {
 		os.Exit(0)
 	}
 
-	hasSourceAndDest := len(args) == 2 || (len(args) == 1 && c.isBenchmark)
+	if c.maxIdleConns < 0 || c.maxIdleConnsPerHost < 0 {
+		return errors.New("--max-idle-conns and --max-idle-conns-per-host cannot be negative")
+	}
+	if c.socketReadBuffer < 0 || c.socketWriteBuffer < 0 {
+		return errors.New("--socket-read-buffer and --socket-write-buffer cannot be negative")
+	}
+
+	if len(c.endpointURL) != 0 {
+		u, err := url.Parse(c.endpointURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return fmt.Errorf("--endpoint-url %q must be an http:// or https:// url", c.endpointURL)
+		}
+	}
+
+	if len(c.sseCustomerKey) != 0 {
+		key, err := base64.StdEncoding.DecodeString(c.sseCustomerKey)
+		if err != nil || len(key) != 32 {
+			return errors.New("--sse-c-key must be a base64 encoded 256-bit key")
+		}
+	}
+
+	if len(asOf) != 0 {
+		if c.asOf, err = parseTime(asOf); err != nil {
+			return err
+		}
+	}
+	if len(c.versionId) != 0 && !c.asOf.IsZero() {
+		return errors.New("--version-id and --as-of cannot be used together")
+	}
+
+	if c.restoreTier != "Expedited" && c.restoreTier != "Standard" && c.restoreTier != "Bulk" {
+		return fmt.Errorf("--restore-tier %q must be one of Expedited, Standard or Bulk", c.restoreTier)
+	}
+	if c.restoreDays < 1 {
+		return errors.New("--restore-days must be at least 1")
+	}
+	if c.restorePoll <= 0 {
+		return errors.New("--restore-poll must be greater than 0")
+	}
+
+	if c.xattrTags && !c.xattrs {
+		return errors.New("--xattr-tags requires --xattrs")
+	}
+
+	switch downloaders.ConflictPolicy(c.onConflict) {
+	case downloaders.ConflictFail, downloaders.ConflictFailUpfront, downloaders.ConflictRename, downloaders.ConflictSidecar:
+	default:
+		return fmt.Errorf("--on-conflict %q must be one of fail, fail-upfront, rename or sidecar", c.onConflict)
+	}
+	if len(c.conflictSuffix) == 0 || strings.ContainsRune(c.conflictSuffix, '/') {
+		return errors.New("--conflict-suffix must be a non-empty file name suffix")
+	}
+	if !filepath.IsLocal(c.conflictDir) {
+		return errors.New("--conflict-dir must be a path within the destination")
+	}
+
+	if err := downloaders.ValidatePathTemplate(c.outputTemplate); err != nil {
+		return err
+	}
+	for _, rule := range c.rename {
+		if _, err := downloaders.ParseRenameRule(rule); err != nil {
+			return err
+		}
+	}
+
+	switch downloaders.StripePolicy(c.stripeBy) {
+	case downloaders.StripeRoundRobin, downloaders.StripeFreeSpace, downloaders.StripeHash:
+	default:
+		return fmt.Errorf("--stripe-by %q must be one of round-robin, free-space or hash", c.stripeBy)
+	}
+
+	if c.maxIPs < 1 {
+		return errors.New("--max-ips must be at least 1")
+	}
+
+	if len(c.concat) != 0 {
+		if len(args) != 1 || c.isBenchmark {
+			return errors.New("--concat takes the place of the [destination], and can't be used with --benchmark")
+		}
+		if len(c.byteRange) != 0 {
+			return errors.New("--concat and --range cannot be used together")
+		}
+		if !strings.HasPrefix(args[0], "s3://") {
+			return errors.New("--concat requires the source to be S3 objects")
+		}
+	}
+
+	hasSourceAndDest := len(args) == 2 || (len(args) > 2 && !c.isBenchmark) || (len(args) == 1 && (c.isBenchmark || len(c.concat) != 0 || c.zipList || c.indexTar))
 	if !hasSourceAndDest {
 		return errors.New("Missing [source] and [destination]")
 	}
 	c.source = args[0]
 
-	if !c.isBenchmark {
+	if len(c.byteRange) != 0 {
+		if _, err := downloaders.ParseByteRange(c.byteRange); err != nil {
+			return err
+		}
+		if !strings.HasPrefix(c.source, "s3://") || strings.HasSuffix(c.source, "/") || len(args) > 2 {
+			return errors.New("--range requires the source to be a single S3 object, downloaded to a single destination")
+		}
+		if !c.asOf.IsZero() {
+			return errors.New("--range and --as-of cannot be used together")
+		}
+	}
+
+	if len(c.versionId) != 0 && (!strings.HasPrefix(c.source, "s3://") || strings.HasSuffix(c.source, "/")) {
+		return errors.New("--version-id requires the source to be a single S3 object")
+	}
+
+	if !c.isBenchmark && len(c.concat) == 0 && len(args) > 1 {
 		c.destination = args[1]
 	}
 
+	if c.decompress {
+		if !strings.HasPrefix(c.source, "s3://") || len(args) > 2 {
+			return errors.New("--decompress requires the source to be S3 objects, downloaded to a single destination")
+		}
+		if len(c.byteRange) != 0 || len(c.concat) != 0 {
+			return errors.New("--decompress cannot be used with --range or --concat")
+		}
+	}
+
+	if c.extract {
+		if !strings.HasPrefix(c.source, "s3://") || len(args) > 2 || c.isBenchmark || c.StreamsToStdout() {
+			return errors.New("--extract requires the source to be S3 objects, downloaded to a single local destination")
+		}
+		if len(c.byteRange) != 0 || len(c.concat) != 0 {
+			return errors.New("--extract cannot be used with --range or --concat")
+		}
+	}
+
+	if c.ExtractsZip() {
+		for _, pattern := range c.zipInclude {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("--zip-include %q isn't a valid pattern", pattern)
+			}
+		}
+		if !strings.HasPrefix(c.source, "s3://") || strings.HasSuffix(c.source, "/") {
+			return errors.New("--zip-include & --zip-list require the source to be a single S3 object")
+		}
+		if !c.zipList && (len(args) != 2 || strings.HasPrefix(c.destination, "s3://") || c.StreamsToStdout() || c.isBenchmark) {
+			return errors.New("zip members can only be extracted to a single local destination")
+		}
+		if len(c.byteRange) != 0 || len(c.concat) != 0 || c.extract || c.decompress {
+			return errors.New("--zip-include & --zip-list cannot be used with --range, --concat, --extract or --decompress")
+		}
+	}
+
+	if c.indexTar {
+		if len(args) != 1 || !strings.HasPrefix(c.source, "s3://") || strings.HasSuffix(c.source, "/") {
+			return errors.New("--index-tar requires the source to be a single S3 tar object, without a [destination]")
+		}
+		if len(c.tarInclude) != 0 || len(c.byteRange) != 0 || len(c.concat) != 0 || c.extract || c.decompress || c.ExtractsZip() || c.pack || c.isBenchmark {
+			return errors.New("--index-tar cannot be used with --tar-include, --range, --concat, --extract, --decompress, --pack, zip extraction or --benchmark")
+		}
+		if len(c.manifestOut) != 0 {
+			return errors.New("--manifest-out cannot be used with --index-tar")
+		}
+	}
+
+	if len(c.tarInclude) != 0 {
+		for _, pattern := range c.tarInclude {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("--tar-include %q isn't a valid pattern", pattern)
+			}
+		}
+		if !strings.HasPrefix(c.source, "s3://") || strings.HasSuffix(c.source, "/") {
+			return errors.New("--tar-include requires the source to be a single S3 tar object")
+		}
+		if len(args) != 2 || strings.HasPrefix(c.destination, "s3://") || c.StreamsToStdout() || c.isBenchmark {
+			return errors.New("tar files can only be extracted to a single local destination")
+		}
+		if len(c.byteRange) != 0 || len(c.concat) != 0 || c.extract || c.decompress || c.ExtractsZip() || c.pack {
+			return errors.New("--tar-include cannot be used with --range, --concat, --extract, --decompress, --pack or zip extraction")
+		}
+	} else if len(c.tarIndex) != 0 && !c.indexTar {
+		return errors.New("--tar-index requires --tar-include or --index-tar")
+	}
+
+	if c.pack {
+		if c.shardSize <= 0 {
+			return errors.New("--shard-size must be greater than 0")
+		}
+		if !strings.HasPrefix(c.source, "s3://") || len(args) != 2 || strings.HasPrefix(c.destination, "s3://") ||
+			c.StreamsToStdout() || len(c.destRoots) != 0 {
+			return errors.New("--pack requires the source to be S3 objects, packed into a single local destination")
+		}
+		if len(c.byteRange) != 0 || len(c.concat) != 0 || c.extract || c.decompress || c.ExtractsZip() {
+			return errors.New("--pack cannot be used with --range, --concat, --extract, --decompress or zip extraction")
+		}
+	} else if c.groupByStem {
+		return errors.New("--group-by-stem requires --pack")
+	}
+
+	if len(c.manifestOut) != 0 {
+		if len(args) > 2 || strings.HasPrefix(c.destination, "s3://") || c.ExtractsZip() || c.ExtractsTar() {
+			return errors.New("--manifest-out is only supported when downloading from S3 or copying local files to a single destination")
+		}
+	}
+
+	if c.streamWindow < 0 {
+		return errors.New("--stream-window cannot be negative")
+	}
+	if c.StreamsToStdout() && !strings.HasPrefix(c.source, "s3://") {
+		return errors.New("only S3 objects can be streamed to stdout")
+	}
+	if c.StreamsFromStdin() && (len(args) > 2 || !strings.HasPrefix(c.destination, "s3://")) {
+		return errors.New("stdin can only be streamed to a single S3 object")
+	}
+
+	// Copying to several destinations at once reads each part from the source once
+	if len(args) > 2 {
+		c.destinations = args[1:]
+		for _, dest := range c.destinations {
+			if dest == "-" {
+				return errors.New("objects can't be streamed to stdout when copying to several destinations")
+			}
+		}
+		// every destination gets the source's paths as they are
+		if c.onConflict != string(downloaders.ConflictFail) || len(c.rename) != 0 || len(c.outputTemplate) != 0 || len(c.mappingReport) != 0 {
+			return errors.New("--on-conflict, --rename, --output-template & --mapping-report can't be used when copying to several destinations")
+		}
+		if len(c.destRoots) != 0 || c.stripeBy != string(downloaders.StripeRoundRobin) || len(c.stripeManifest) != 0 {
+			return errors.New("--dest-root, --stripe-by & --stripe-manifest can't be used when copying to several destinations")
+		}
+	}
+
+	if len(c.destRoots) != 0 {
+		if strings.HasPrefix(c.destination, "s3://") || c.destination == "-" {
+			return errors.New("--dest-root can only spread objects across local destination roots")
+		}
+		for _, root := range c.destRoots {
+			if len(root) == 0 || strings.HasPrefix(root, "s3://") {
+				return fmt.Errorf("--dest-root %q must be a local path", root)
+			}
+		}
+	}
+
 	return nil
 }
 
+// Parses a RFC3339 timestamp, or a date in the format of 2006-01-02 which is treated as midnight UTC
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected RFC3339 E.g. (2006-01-02T15:04:05Z) or a date E.g. (2006-01-02)", s)
+}
+
 // Parses the input "en0,en1,en2,en3" nics
 // and outputs them as an array of ["en0", "en1", "en2", "en3"]
 func (c Config) NicsArr() (out []string) {
@@ -112,3 +568,173 @@ func (c Config) NicsArr() (out []string) {
 
 	return strings.Split(s, ",")
 }
+
+// Whether objects are streamed to stdout rather than written to files
+func (c Config) StreamsToStdout() bool {
+	return c.destination == "-"
+}
+
+// Whether stdin is uploaded rather than files
+func (c Config) StreamsFromStdin() bool {
+	return c.source == "-"
+}
+
+// Returns the part of the object to download, or nil to download all of it
+func (c Config) ByteRange() *downloaders.ByteRange {
+	if len(c.byteRange) == 0 {
+		return nil
+	}
+	// validated when parsing flags
+	r, _ := downloaders.ParseByteRange(c.byteRange)
+	return &r
+}
+
+// Whether members of a zip object are extracted or listed, rather than objects downloaded
+func (c Config) ExtractsZip() bool {
+	return len(c.zipInclude) != 0 || c.zipList
+}
+
+// Whether files are extracted from the source tar object using its index
+func (c Config) ExtractsTar() bool {
+	return len(c.tarInclude) != 0
+}
+
+// Returns where the source tar object's index is kept, next to the tar object by default
+func (c Config) TarIndexPath() string {
+	if len(c.tarIndex) != 0 {
+		return c.tarIndex
+	}
+	return c.source + ".index.tsv"
+}
+
+// Returns how objects are packed into tar shards
+func (c Config) PackOptions() downloaders.PackOptions {
+	return downloaders.PackOptions{
+		Enabled:     c.pack,
+		ShardSize:   c.shardSize,
+		GroupByStem: c.groupByStem,
+	}
+}
+
+// Returns the destination followed by the --dest-root roots
+func (c Config) DestinationRoots() []string {
+	return append([]string{c.destination}, c.destRoots...)
+}
+
+// Returns how objects are spread across the destination's roots
+func (c Config) StripeOptions() downloaders.StripeOptions {
+	o := downloaders.StripeOptions{
+		Policy:   downloaders.StripePolicy(c.stripeBy),
+		Manifest: c.stripeManifest,
+	}
+	if roots := c.DestinationRoots(); len(roots) > 1 {
+		o.Roots = roots
+	}
+	return o
+}
+
+// Returns the IP spreader shared by every HTTP client, nil unless --spread-ips is set
+func (c Config) IPSpreader() *downloaders.IPSpreader {
+	return c.spreader
+}
+
+// Returns the HTTP transport settings requested by the user
+func (c Config) HTTPOptions() downloaders.HTTPOptions {
+	return downloaders.HTTPOptions{
+		MaxIdleConns:          c.maxIdleConns,
+		MaxIdleConnsPerHost:   c.maxIdleConnsPerHost,
+		IdleConnTimeout:       c.idleConnTimeout,
+		KeepAlive:             c.keepAlive,
+		TLSHandshakeTimeout:   c.tlsHandshakeTimeout,
+		ResponseHeaderTimeout: c.responseHeaderTimeout,
+		SocketReadBuffer:      c.socketReadBuffer,
+		SocketWriteBuffer:     c.socketWriteBuffer,
+		Proxy:                 c.proxy,
+		Spreader:              c.spreader,
+		InsecureSkipVerify:    c.noVerifySSL,
+		CABundle:              c.caBundle,
+	}
+}
+
+// Returns the settings used to create the S3 client reading from the source
+func (c Config) SourceS3ClientConfig() downloaders.S3ClientConfig {
+	return c.s3ClientConfig(c.credentials(c.sourceProfile, c.sourceRoleARN, c.sourceExternalID))
+}
+
+// Returns the settings used to create the S3 client writing to the destination
+func (c Config) DestinationS3ClientConfig() downloaders.S3ClientConfig {
+	return c.s3ClientConfig(c.credentials(c.destProfile, c.destRoleARN, c.destExternalID))
+}
+
+func (c Config) s3ClientConfig(creds downloaders.S3Credentials) downloaders.S3ClientConfig {
+	return downloaders.S3ClientConfig{
+		Region:         c.region,
+		EndpointURL:    c.endpointURL,
+		ForcePathStyle: c.forcePathStyle,
+		NICs:           c.NicsArr(),
+		HTTP:           c.HTTPOptions(),
+		Credentials:    creds,
+	}
+}
+
+// Returns the shared credential settings, overridden by any of the given side specific settings
+func (c Config) credentials(profile, roleARN, externalID string) downloaders.S3Credentials {
+	creds := downloaders.S3Credentials{
+		Profile:         c.profile,
+		RoleARN:         c.roleARN,
+		RoleSessionName: c.roleSessionName,
+		ExternalID:      c.externalID,
+	}
+	if len(profile) != 0 {
+		creds.Profile = profile
+	}
+	if len(roleARN) != 0 {
+		creds.RoleARN = roleARN
+		creds.ExternalID = externalID
+	} else if len(externalID) != 0 {
+		creds.ExternalID = externalID
+	}
+	return creds
+}
+
+// Returns the settings applied to every S3 request
+func (c Config) S3RequestOptions() downloaders.S3RequestOptions {
+	return downloaders.S3RequestOptions{
+		RequesterPays:        c.requesterPays,
+		ExpectedBucketOwner:  c.expectedBucketOwner,
+		SSECustomerAlgorithm: c.sseCustomerAlgorithm,
+		SSECustomerKey:       c.sseCustomerKey,
+	}
+}
+
+// Returns how object keys are mapped to the paths they're written to
+func (c Config) PathMapping() downloaders.PathMapping {
+	return downloaders.PathMapping{
+		Conflicts:    downloaders.ConflictPolicy(c.onConflict),
+		RenameSuffix: c.conflictSuffix,
+		SidecarDir:   c.conflictDir,
+		Report:       c.mappingReport,
+		Template:     c.outputTemplate,
+		Rules:        c.renameRules(),
+	}
+}
+
+// Returns the parsed --rename rules, which were validated when parsing flags
+func (c Config) renameRules() []downloaders.RenameRule {
+	var rules []downloaders.RenameRule
+	for _, rule := range c.rename {
+		r, _ := downloaders.ParseRenameRule(rule)
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// Returns how archived objects are to be restored
+func (c Config) S3RestoreOptions() downloaders.S3RestoreOptions {
+	return downloaders.S3RestoreOptions{
+		Enabled:      c.restore,
+		Tier:         c.restoreTier,
+		Days:         int32(c.restoreDays),
+		PollInterval: c.restorePoll,
+	}
+}
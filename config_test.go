@@ -5,6 +5,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"reflect"
 	"testing"
+	"time"
 )
 
 type configTest struct {
@@ -24,6 +25,80 @@ var defaults = Config{
 	isBenchmark: false,
 	loglevel:    "NOTICE",
 	cpuprofile:  "",
+
+	maxIdleConns:          0,
+	maxIdleConnsPerHost:   0,
+	idleConnTimeout:       90 * time.Second,
+	keepAlive:             30 * time.Second,
+	tlsHandshakeTimeout:   10 * time.Second,
+	responseHeaderTimeout: 0,
+	socketReadBuffer:      0,
+	socketWriteBuffer:     0,
+	proxy:                 "",
+	spreadIPs:             false,
+	dnsRefresh:            30 * time.Second,
+	maxIPs:                16,
+
+	endpointURL:    "",
+	forcePathStyle: false,
+	noVerifySSL:    false,
+	caBundle:       "",
+
+	profile:          "",
+	roleARN:          "",
+	roleSessionName:  "s3pd",
+	externalID:       "",
+	sourceProfile:    "",
+	sourceRoleARN:    "",
+	sourceExternalID: "",
+	destProfile:      "",
+	destRoleARN:      "",
+	destExternalID:   "",
+
+	requesterPays:        false,
+	expectedBucketOwner:  "",
+	sseCustomerAlgorithm: "AES256",
+	sseCustomerKey:       "",
+
+	asOf:      time.Time{},
+	versionId: "",
+
+	restore:     false,
+	restoreTier: "Standard",
+	restoreDays: 1,
+	restorePoll: 5 * time.Minute,
+
+	preserveMtime: false,
+	xattrs:        false,
+	xattrTags:     false,
+
+	onConflict:     "fail",
+	conflictSuffix: ".s3pd-file",
+	conflictDir:    ".s3pd-conflicts",
+	mappingReport:  "",
+	outputTemplate: "",
+	rename:         nil,
+
+	destRoots:      nil,
+	stripeBy:       "round-robin",
+	stripeManifest: "",
+
+	destinations: nil,
+
+	streamWindow: 0,
+
+	byteRange: "",
+	concat:    "",
+
+	decompress: false,
+	extract:    false,
+
+	zipInclude: nil,
+	zipList:    false,
+
+	pack:        false,
+	shardSize:   1024 * 1024 * 1024,
+	groupByStem: false,
 }
 
 var configTests []configTest
@@ -82,6 +157,338 @@ func TestMain(m *testing.M) {
 			"--threads=20"},
 		expected: test4,
 	})
+
+	test5 := defaults
+	test5.source = "s3://mybucket/prefix"
+	test5.destination = "/mnt/ram-disk"
+	test5.maxIdleConns = 500
+	test5.maxIdleConnsPerHost = 250
+	test5.idleConnTimeout = 2 * time.Minute
+	test5.keepAlive = 15 * time.Second
+	test5.tlsHandshakeTimeout = 5 * time.Second
+	test5.responseHeaderTimeout = 30 * time.Second
+	test5.socketReadBuffer = 4 * 1024 * 1024
+	test5.socketWriteBuffer = 1024 * 1024
+	test5.proxy = "http://proxy.internal:3128"
+	configTests = append(configTests, configTest{
+		args: []string{"s3pd",
+			"s3://mybucket/prefix", "/mnt/ram-disk",
+			"--max-idle-conns=500",
+			"--max-idle-conns-per-host=250",
+			"--idle-conn-timeout=2m",
+			"--keepalive=15s",
+			"--tls-handshake-timeout=5s",
+			"--response-header-timeout=30s",
+			"--socket-read-buffer=4194304",
+			"--socket-write-buffer=1048576",
+			"--proxy=http://proxy.internal:3128"},
+		expected: test5,
+	})
+
+	test6 := defaults
+	test6.source = "s3://mybucket/prefix"
+	test6.destination = "/mnt/ram-disk"
+	test6.spreadIPs = true
+	test6.dnsRefresh = 10 * time.Second
+	test6.maxIPs = 32
+	configTests = append(configTests, configTest{
+		args: []string{"s3pd",
+			"s3://mybucket/prefix", "/mnt/ram-disk",
+			"--spread-ips",
+			"--dns-refresh=10s",
+			"--max-ips=32"},
+		expected: test6,
+	})
+
+	test7 := defaults
+	test7.source = "s3://mybucket/prefix"
+	test7.destination = "/mnt/ram-disk"
+	test7.endpointURL = "https://minio.internal:9000"
+	test7.forcePathStyle = true
+	test7.noVerifySSL = true
+	test7.caBundle = "/etc/ssl/minio.pem"
+	configTests = append(configTests, configTest{
+		args: []string{"s3pd",
+			"s3://mybucket/prefix", "/mnt/ram-disk",
+			"--endpoint-url=https://minio.internal:9000",
+			"--force-path-style",
+			"--no-verify-ssl",
+			"--ca-bundle=/etc/ssl/minio.pem"},
+		expected: test7,
+	})
+
+	test8 := defaults
+	test8.source = "s3://mybucket/prefix"
+	test8.destination = "/mnt/ram-disk"
+	test8.profile = "shared"
+	test8.roleARN = "arn:aws:iam::111111111111:role/reader"
+	test8.roleSessionName = "training-run"
+	test8.externalID = "abc"
+	test8.sourceProfile = "src"
+	test8.sourceRoleARN = "arn:aws:iam::222222222222:role/reader"
+	test8.sourceExternalID = "def"
+	test8.destProfile = "dst"
+	test8.destRoleARN = "arn:aws:iam::333333333333:role/writer"
+	test8.destExternalID = "ghi"
+	configTests = append(configTests, configTest{
+		args: []string{"s3pd",
+			"s3://mybucket/prefix", "/mnt/ram-disk",
+			"--profile=shared",
+			"--role-arn=arn:aws:iam::111111111111:role/reader",
+			"--role-session-name=training-run",
+			"--external-id=abc",
+			"--source-profile=src",
+			"--source-role-arn=arn:aws:iam::222222222222:role/reader",
+			"--source-external-id=def",
+			"--dest-profile=dst",
+			"--dest-role-arn=arn:aws:iam::333333333333:role/writer",
+			"--dest-external-id=ghi"},
+		expected: test8,
+	})
+
+	test9 := defaults
+	test9.source = "s3://mybucket/prefix"
+	test9.destination = "/mnt/ram-disk"
+	test9.requesterPays = true
+	test9.expectedBucketOwner = "111111111111"
+	test9.sseCustomerKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	configTests = append(configTests, configTest{
+		args: []string{"s3pd",
+			"s3://mybucket/prefix", "/mnt/ram-disk",
+			"--request-payer",
+			"--expected-bucket-owner=111111111111",
+			"--sse-c-key=MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="},
+		expected: test9,
+	})
+
+	test10 := defaults
+	test10.source = "s3://mybucket/prefix/"
+	test10.destination = "/mnt/ram-disk"
+	test10.asOf = time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	configTests = append(configTests, configTest{
+		args: []string{"s3pd",
+			"s3://mybucket/prefix/", "/mnt/ram-disk",
+			"--as-of=2024-01-02T15:04:05Z"},
+		expected: test10,
+	})
+
+	test11 := defaults
+	test11.source = "s3://mybucket/prefix/object.bin"
+	test11.destination = "/mnt/ram-disk"
+	test11.versionId = "3HL4kqtJlcpXroDTDmJ+rmSpXd3dIbrHY"
+	configTests = append(configTests, configTest{
+		args: []string{"s3pd",
+			"s3://mybucket/prefix/object.bin", "/mnt/ram-disk",
+			"--version-id=3HL4kqtJlcpXroDTDmJ+rmSpXd3dIbrHY"},
+		expected: test11,
+	})
+
+	test12 := defaults
+	test12.source = "s3://mybucket/prefix/"
+	test12.destination = "/mnt/ram-disk"
+	test12.restore = true
+	test12.restoreTier = "Bulk"
+	test12.restoreDays = 7
+	test12.restorePoll = time.Hour
+	configTests = append(configTests, configTest{
+		args: []string{"s3pd",
+			"s3://mybucket/prefix/", "/mnt/ram-disk",
+			"--restore",
+			"--restore-tier=Bulk",
+			"--restore-days=7",
+			"--restore-poll=1h"},
+		expected: test12,
+	})
+
+	test13 := defaults
+	test13.source = "s3://mybucket/prefix/"
+	test13.destination = "/mnt/ram-disk"
+	test13.preserveMtime = true
+	test13.xattrs = true
+	test13.xattrTags = true
+	configTests = append(configTests, configTest{
+		args: []string{"s3pd",
+			"s3://mybucket/prefix/", "/mnt/ram-disk",
+			"--preserve-mtime",
+			"--xattrs",
+			"--xattr-tags"},
+		expected: test13,
+	})
+	test14 := defaults
+	test14.source = "s3://mybucket/prefix/"
+	test14.destination = "/mnt/ram-disk"
+	test14.onConflict = "sidecar"
+	test14.conflictDir = "conflicts"
+	test14.mappingReport = "/tmp/mapping.tsv"
+	configTests = append(configTests, configTest{
+		args: []string{"s3pd",
+			"s3://mybucket/prefix/", "/mnt/ram-disk",
+			"--on-conflict=sidecar",
+			"--conflict-dir=conflicts",
+			"--mapping-report=/tmp/mapping.tsv"},
+		expected: test14,
+	})
+	test15 := defaults
+	test15.source = "s3://mybucket/prefix/"
+	test15.destination = "/mnt/ram-disk"
+	test15.outputTemplate = "{prefix_1}/{basename}"
+	test15.rename = []string{`s|date=(\d+)-(\d+)-(\d+)|$1/$2/$3|`, "s/a/b/"}
+	configTests = append(configTests, configTest{
+		args: []string{"s3pd",
+			"s3://mybucket/prefix/", "/mnt/ram-disk",
+			"--output-template={prefix_1}/{basename}",
+			`--rename=s|date=(\d+)-(\d+)-(\d+)|$1/$2/$3|`,
+			"--rename=s/a/b/"},
+		expected: test15,
+	})
+	test16 := defaults
+	test16.source = "s3://mybucket/prefix/"
+	test16.destination = "/mnt/nvme0"
+	test16.destRoots = []string{"/mnt/nvme1"}
+	test16.stripeBy = "free-space"
+	test16.stripeManifest = "/tmp/stripe.tsv"
+	configTests = append(configTests, configTest{
+		args: []string{"s3pd",
+			"s3://mybucket/prefix/", "/mnt/nvme0",
+			"--dest-root=/mnt/nvme1",
+			"--stripe-by=free-space",
+			"--stripe-manifest=/tmp/stripe.tsv"},
+		expected: test16,
+	})
+	test17 := defaults
+	test17.source = "s3://mybucket/prefix/"
+	test17.destination = "/mnt/ram-disk"
+	test17.destinations = []string{"/mnt/ram-disk", "s3://mirror/prefix/"}
+	configTests = append(configTests, configTest{
+		args: []string{"s3pd",
+			"s3://mybucket/prefix/", "/mnt/ram-disk", "s3://mirror/prefix/"},
+		expected: test17,
+	})
+	test18 := defaults
+	test18.source = "s3://mybucket/big.tar"
+	test18.destination = "-"
+	test18.streamWindow = 64 * 1024 * 1024
+	configTests = append(configTests, configTest{
+		args: []string{"s3pd",
+			"s3://mybucket/big.tar", "-",
+			"--stream-window=67108864"},
+		expected: test18,
+	})
+	test19 := defaults
+	test19.source = "-"
+	test19.destination = "s3://mybucket/data.tar"
+	configTests = append(configTests, configTest{
+		args:     []string{"s3pd", "-", "s3://mybucket/data.tar"},
+		expected: test19,
+	})
+	test20 := defaults
+	test20.source = "s3://mybucket/huge.bin"
+	test20.destination = "/mnt/ram-disk"
+	test20.byteRange = "10737418240-12884901887"
+	configTests = append(configTests, configTest{
+		args:     []string{"s3pd", "--range=10737418240-12884901887", "s3://mybucket/huge.bin", "/mnt/ram-disk"},
+		expected: test20,
+	})
+	test21 := defaults
+	test21.source = "s3://mybucket/output/part-"
+	test21.concat = "/mnt/ram-disk/output.csv"
+	configTests = append(configTests, configTest{
+		args:     []string{"s3pd", "--concat=/mnt/ram-disk/output.csv", "s3://mybucket/output/part-"},
+		expected: test21,
+	})
+	test22 := defaults
+	test22.source = "s3://mybucket/logs/"
+	test22.destination = "/mnt/ram-disk"
+	test22.decompress = true
+	configTests = append(configTests, configTest{
+		args:     []string{"s3pd", "--decompress", "s3://mybucket/logs/", "/mnt/ram-disk"},
+		expected: test22,
+	})
+	test23 := defaults
+	test23.source = "s3://mybucket/shards/"
+	test23.destination = "/mnt/ram-disk"
+	test23.extract = true
+	configTests = append(configTests, configTest{
+		args:     []string{"s3pd", "--extract", "s3://mybucket/shards/", "/mnt/ram-disk"},
+		expected: test23,
+	})
+	test24 := defaults
+	test24.source = "s3://mybucket/archive.zip"
+	test24.destination = "/mnt/ram-disk"
+	test24.zipInclude = []string{"images/*.jpg", "docs"}
+	configTests = append(configTests, configTest{
+		args: []string{"s3pd",
+			"--zip-include=images/*.jpg", "--zip-include=docs",
+			"s3://mybucket/archive.zip", "/mnt/ram-disk"},
+		expected: test24,
+	})
+	test25 := defaults
+	test25.source = "s3://mybucket/archive.zip"
+	test25.zipList = true
+	configTests = append(configTests, configTest{
+		args:     []string{"s3pd", "--zip-list", "s3://mybucket/archive.zip"},
+		expected: test25,
+	})
+	test26 := defaults
+	test26.source = "s3://mybucket/train/"
+	test26.destination = "/mnt/ram-disk"
+	test26.pack = true
+	test26.shardSize = 256 * 1024 * 1024
+	test26.groupByStem = true
+	configTests = append(configTests, configTest{
+		args: []string{"s3pd",
+			"--pack", "--shard-size=268435456", "--group-by-stem",
+			"s3://mybucket/train/", "/mnt/ram-disk"},
+		expected: test26,
+	})
+
+	test27 := defaults
+	test27.source = "s3://mybucket/dataset.tar"
+	test27.indexTar = true
+	test27.tarIndex = "s3://mybucket/indexes/dataset.tsv"
+	configTests = append(configTests, configTest{
+		args:     []string{"s3pd", "--index-tar", "--tar-index=s3://mybucket/indexes/dataset.tsv", "s3://mybucket/dataset.tar"},
+		expected: test27,
+	})
+
+	test28 := defaults
+	test28.source = "s3://mybucket/dataset.tar"
+	test28.destination = "/mnt/ram-disk"
+	test28.tarInclude = []string{"images/*.jpg", "labels"}
+	configTests = append(configTests, configTest{
+		args: []string{"s3pd",
+			"--tar-include=images/*.jpg", "--tar-include=labels",
+			"s3://mybucket/dataset.tar", "/mnt/ram-disk"},
+		expected: test28,
+	})
+
+	test29 := defaults
+	test29.source = "s3://mybucket/train/"
+	test29.destination = "/mnt/ram-disk"
+	test29.manifestOut = "/mnt/manifest.jsonl"
+	configTests = append(configTests, configTest{
+		args:     []string{"s3pd", "--manifest-out=/mnt/manifest.jsonl", "s3://mybucket/train/", "/mnt/ram-disk"},
+		expected: test29,
+	})
+
+	test30 := defaults
+	test30.source = "/mnt/path1/"
+	test30.destination = "/mnt/path2/"
+	test30.summaryJSON = "/mnt/summary.json"
+	configTests = append(configTests, configTest{
+		args:     []string{"s3pd", "--summary-json=/mnt/summary.json", "/mnt/path1/", "/mnt/path2/"},
+		expected: test30,
+	})
+
+	test31 := defaults
+	test31.source = "/mnt/path1/"
+	test31.destination = "/mnt/path2/"
+	test31.destinations = []string{"/mnt/path2/", "s3://mybucket/path3/"}
+	test31.summaryJSON = "/mnt/summary.json"
+	configTests = append(configTests, configTest{
+		args:     []string{"s3pd", "--summary-json=/mnt/summary.json", "/mnt/path1/", "/mnt/path2/", "s3://mybucket/path3/"},
+		expected: test31,
+	})
 	m.Run()
 }
 
@@ -94,10 +501,67 @@ func TestNewConfig(t *testing.T) {
 			t.Error(err)
 		}
 
+		// one spreader is shared by every client when spreading connections across IPs
+		assert.Equal(t, ct.expected.spreadIPs, actual.IPSpreader() != nil)
+		assert.True(t, actual.HTTPOptions().Spreader == actual.SourceS3ClientConfig().HTTP.Spreader)
+		actual.spreader = nil
 		assert.True(t, reflect.DeepEqual(*actual, ct.expected))
 	}
 }
 
+func TestInvalidEndpointURL(t *testing.T) {
+	_, err := NewConfig([]string{"s3pd", "s3://mybucket/prefix", "/mnt/ram-disk", "--endpoint-url=localhost:9000"})
+	assert.NotEqual(t, nil, err, "Endpoint without a scheme should be rejected")
+}
+
+func TestInvalidSSECustomerKey(t *testing.T) {
+	_, err := NewConfig([]string{"s3pd", "s3://mybucket/prefix", "/mnt/ram-disk", "--sse-c-key=c2hvcnQ="})
+	assert.NotEqual(t, nil, err, "Keys which aren't 256-bits should be rejected")
+}
+
+func TestParseTime(t *testing.T) {
+	date, err := parseTime("2024-01-02")
+	assert.Equal(t, nil, err, "Dates should be accepted")
+	assert.Equal(t, time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), date, "Dates should be midnight UTC")
+
+	_, err = parseTime("last tuesday")
+	assert.NotEqual(t, nil, err, "Invalid times should be rejected")
+}
+
+func TestInvalidVersionFlags(t *testing.T) {
+	_, err := NewConfig([]string{"s3pd", "s3://mybucket/prefix/", "/mnt/ram-disk", "--version-id=abc"})
+	assert.NotEqual(t, nil, err, "--version-id should require a single object")
+
+	_, err = NewConfig([]string{"s3pd", "s3://mybucket/object", "/mnt/ram-disk", "--version-id=abc", "--as-of=2024-01-02"})
+	assert.NotEqual(t, nil, err, "--version-id and --as-of should be exclusive")
+}
+
+func TestInvalidRestoreTier(t *testing.T) {
+	_, err := NewConfig([]string{"s3pd", "s3://mybucket/prefix/", "/mnt/ram-disk", "--restore", "--restore-tier=Fast"})
+	assert.NotEqual(t, nil, err, "Unknown restore tiers should be rejected")
+}
+
+func TestCredentials(t *testing.T) {
+	c := Config{
+		profile:         "shared",
+		roleARN:         "arn:aws:iam::111111111111:role/reader",
+		roleSessionName: "s3pd",
+		externalID:      "abc",
+		destRoleARN:     "arn:aws:iam::333333333333:role/writer",
+	}
+
+	src := c.SourceS3ClientConfig().Credentials
+	assert.Equal(t, "shared", src.Profile, "Source should use the shared profile")
+	assert.Equal(t, "arn:aws:iam::111111111111:role/reader", src.RoleARN, "Source should use the shared role")
+	assert.Equal(t, "abc", src.ExternalID, "Source should use the shared external id")
+
+	dst := c.DestinationS3ClientConfig().Credentials
+	assert.Equal(t, "shared", dst.Profile, "Destination should use the shared profile")
+	assert.Equal(t, "arn:aws:iam::333333333333:role/writer", dst.RoleARN, "Destination role should override the shared role")
+	assert.Equal(t, "", dst.ExternalID, "Shared external id should not be used with the destination's role")
+	assert.Equal(t, "s3pd", dst.RoleSessionName, "Session name should be shared")
+}
+
 func TestNicsArr(t *testing.T) {
 	var c Config
 	var arr []string
@@ -114,3 +578,181 @@ func TestNicsArr(t *testing.T) {
 	assert.Equal(t, "en1", arr[0], "Should remove trailing comman")
 	assert.Equal(t, 1, len(arr), "Should remove trailing comman")
 }
+
+func TestInvalidConflictFlags(t *testing.T) {
+	_, err := NewConfig([]string{"s3pd", "s3://mybucket/prefix/", "/mnt/ram-disk", "--on-conflict=overwrite"})
+	assert.NotEqual(t, nil, err, "Unknown conflict policies should be rejected")
+
+	_, err = NewConfig([]string{"s3pd", "s3://mybucket/prefix/", "/mnt/ram-disk", "--conflict-dir=/tmp/conflicts"})
+	assert.NotEqual(t, nil, err, "Sidecar folders outside the destination should be rejected")
+}
+
+func TestInvalidRenameFlags(t *testing.T) {
+	_, err := NewConfig([]string{"s3pd", "s3://mybucket/prefix/", "/mnt/ram-disk", "--rename=s/(/x/"})
+	assert.NotEqual(t, nil, err, "Invalid regexes should be rejected")
+
+	_, err = NewConfig([]string{"s3pd", "s3://mybucket/prefix/", "/mnt/ram-disk", "--output-template={size}"})
+	assert.NotEqual(t, nil, err, "Unknown placeholders should be rejected")
+}
+
+func TestStripeOptions(t *testing.T) {
+	c, err := NewConfig([]string{"s3pd", "s3://mybucket/prefix/", "/mnt/nvme0", "--dest-root=/mnt/nvme1", "--stripe-by=hash"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"/mnt/nvme0", "/mnt/nvme1"}, c.StripeOptions().Roots)
+	assert.Equal(t, "/mnt/nvme0", c.DestinationRoots()[0])
+
+	c, err = NewConfig([]string{"s3pd", "s3://mybucket/prefix/", "/mnt/nvme0"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(c.StripeOptions().Roots), "A single root isn't striped")
+
+	// Destinations containing commas are a single root
+	c, err = NewConfig([]string{"s3pd", "s3://mybucket/prefix/", "/mnt/data,v2"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"/mnt/data,v2"}, c.DestinationRoots())
+	assert.Equal(t, 0, len(c.StripeOptions().Roots), "Commas shouldn't stripe across roots")
+
+	_, err = NewConfig([]string{"s3pd", "s3://mybucket/prefix/", "/mnt/nvme0", "--dest-root="})
+	assert.NotEqual(t, nil, err, "Empty roots should be rejected")
+
+	_, err = NewConfig([]string{"s3pd", "s3://mybucket/prefix/", "s3://otherbucket/", "--dest-root=/mnt/nvme1"})
+	assert.NotEqual(t, nil, err, "S3 destinations can't be striped")
+
+	_, err = NewConfig([]string{"s3pd", "s3://mybucket/prefix/", "/mnt/nvme0", "/mnt/nvme1", "--dest-root=/mnt/nvme2"})
+	assert.NotEqual(t, nil, err, "Several destinations can't be striped")
+
+	_, err = NewConfig([]string{"s3pd", "s3://mybucket/prefix/", "/mnt/nvme0", "--stripe-by=random"})
+	assert.NotEqual(t, nil, err, "Unknown policies should be rejected")
+}
+
+func TestInvalidFanOutFlags(t *testing.T) {
+	for _, flag := range []string{
+		"--on-conflict=rename",
+		"--rename=s/a/b/",
+		"--output-template={basename}",
+		"--mapping-report=/tmp/mapping.tsv",
+		"--stripe-by=hash",
+		"--stripe-manifest=/tmp/stripe.tsv",
+	} {
+		_, err := NewConfig([]string{"s3pd", "s3://mybucket/prefix/", "/mnt/nvme0", "s3://mirror/prefix/", flag})
+		assert.NotEqual(t, nil, err, "%s should be rejected when copying to several destinations", flag)
+	}
+
+	_, err := NewConfig([]string{"s3pd", "s3://mybucket/prefix/", "/mnt/nvme0", "s3://mirror/prefix/", "--on-conflict=fail"})
+	assert.Equal(t, nil, err)
+}
+
+func TestInvalidStreamFlags(t *testing.T) {
+	_, err := NewConfig([]string{"s3pd", "/mnt/ram-disk", "-"})
+	assert.NotEqual(t, nil, err, "Only S3 objects should be streamed")
+
+	_, err = NewConfig([]string{"s3pd", "s3://mybucket/prefix/", "/mnt/ram-disk", "-"})
+	assert.NotEqual(t, nil, err, "Stdout shouldn't be one of several destinations")
+
+	_, err = NewConfig([]string{"s3pd", "-", "/mnt/ram-disk"})
+	assert.NotEqual(t, nil, err, "Stdin should only be uploaded to S3")
+
+	_, err = NewConfig([]string{"s3pd", "-", "s3://mybucket/a.tar", "s3://mirror/a.tar"})
+	assert.NotEqual(t, nil, err, "Stdin should only be uploaded to one object")
+}
+
+func TestInvalidRangeAndConcatFlags(t *testing.T) {
+	_, err := NewConfig([]string{"s3pd", "--range=10-5", "s3://mybucket/huge.bin", "/mnt/ram-disk"})
+	assert.NotEqual(t, nil, err, "Ranges should end after they start")
+
+	_, err = NewConfig([]string{"s3pd", "--range=0-9", "s3://mybucket/prefix/", "/mnt/ram-disk"})
+	assert.NotEqual(t, nil, err, "Ranges should only be of a single object")
+
+	_, err = NewConfig([]string{"s3pd", "--concat=/mnt/out.bin", "s3://mybucket/prefix/", "/mnt/ram-disk"})
+	assert.NotEqual(t, nil, err, "--concat should take the place of the destination")
+
+	_, err = NewConfig([]string{"s3pd", "--concat=/mnt/out.bin", "/mnt/path1/"})
+	assert.NotEqual(t, nil, err, "Only S3 objects should be concatenated")
+
+	_, err = NewConfig([]string{"s3pd", "--concat=/mnt/out.bin", "--range=0-9", "s3://mybucket/a.bin"})
+	assert.NotEqual(t, nil, err, "--concat and --range should be exclusive")
+}
+
+func TestInvalidDecompressFlags(t *testing.T) {
+	_, err := NewConfig([]string{"s3pd", "--decompress", "/mnt/path1/", "/mnt/path2/"})
+	assert.NotEqual(t, nil, err, "Only S3 objects should be decompressed")
+
+	_, err = NewConfig([]string{"s3pd", "--decompress", "--range=0-9", "s3://mybucket/a.gz", "/mnt/ram-disk"})
+	assert.NotEqual(t, nil, err, "Ranges of compressed objects can't be decompressed")
+}
+
+func TestInvalidExtractFlags(t *testing.T) {
+	_, err := NewConfig([]string{"s3pd", "--extract", "s3://mybucket/shards/", "-"})
+	assert.NotEqual(t, nil, err, "Archives shouldn't be extracted to stdout")
+
+	_, err = NewConfig([]string{"s3pd", "--extract", "--benchmark", "s3://mybucket/shards/"})
+	assert.NotEqual(t, nil, err, "Archives shouldn't be extracted when benchmarking")
+}
+
+func TestInvalidZipFlags(t *testing.T) {
+	_, err := NewConfig([]string{"s3pd", "--zip-include=[", "s3://mybucket/archive.zip", "/mnt/ram-disk"})
+	assert.NotEqual(t, nil, err, "Include patterns should be valid")
+
+	_, err = NewConfig([]string{"s3pd", "--zip-include=*", "s3://mybucket/archives/", "/mnt/ram-disk"})
+	assert.NotEqual(t, nil, err, "Members should only be extracted from a single object")
+
+	_, err = NewConfig([]string{"s3pd", "--zip-include=*", "s3://mybucket/archive.zip", "s3://mirror/archive/"})
+	assert.NotEqual(t, nil, err, "Members should only be extracted locally")
+
+	_, err = NewConfig([]string{"s3pd", "--zip-include=*", "s3://mybucket/archive.zip"})
+	assert.NotEqual(t, nil, err, "Extracting members should need a destination")
+}
+
+func TestInvalidPackFlags(t *testing.T) {
+	_, err := NewConfig([]string{"s3pd", "--pack", "--shard-size=0", "s3://mybucket/train/", "/mnt/ram-disk"})
+	assert.NotEqual(t, nil, err, "Shards should have a size")
+
+	_, err = NewConfig([]string{"s3pd", "--pack", "s3://mybucket/train/", "-"})
+	assert.NotEqual(t, nil, err, "Shards shouldn't be streamed to stdout")
+
+	_, err = NewConfig([]string{"s3pd", "--pack", "--dest-root=/mnt/nvme1", "s3://mybucket/train/", "/mnt/nvme0"})
+	assert.NotEqual(t, nil, err, "Shards shouldn't be striped")
+
+	_, err = NewConfig([]string{"s3pd", "--group-by-stem", "s3://mybucket/train/", "/mnt/ram-disk"})
+	assert.NotEqual(t, nil, err, "Grouping by stem should require packing")
+}
+
+func TestTarIndexPath(t *testing.T) {
+	c, err := NewConfig([]string{"s3pd", "--index-tar", "s3://mybucket/dataset.tar"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "s3://mybucket/dataset.tar.index.tsv", c.TarIndexPath())
+
+	c, err = NewConfig([]string{"s3pd", "--tar-include=*", "--tar-index=/mnt/dataset.tsv", "s3://mybucket/dataset.tar", "/mnt/ram-disk"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "/mnt/dataset.tsv", c.TarIndexPath())
+}
+
+func TestInvalidTarIndexFlags(t *testing.T) {
+	_, err := NewConfig([]string{"s3pd", "--index-tar", "s3://mybucket/tars/"})
+	assert.NotEqual(t, nil, err, "Only a single tar object should be indexed")
+
+	_, err = NewConfig([]string{"s3pd", "--index-tar", "s3://mybucket/dataset.tar", "/mnt/dataset.tsv"})
+	assert.NotEqual(t, nil, err, "The index should be stored at --tar-index rather than a [destination]")
+
+	_, err = NewConfig([]string{"s3pd", "--index-tar", "--max-ips=0", "s3://mybucket/dataset.tar"})
+	assert.NotEqual(t, nil, err, "Indexing should go through the rest of validation")
+
+	_, err = NewConfig([]string{"s3pd", "--index-tar", "--decompress", "s3://mybucket/dataset.tar"})
+	assert.NotEqual(t, nil, err, "Indexing shouldn't be combined with downloading flags")
+
+	_, err = NewConfig([]string{"s3pd", "--tar-include=*", "s3://mybucket/dataset.tar", "-"})
+	assert.NotEqual(t, nil, err, "Tar files shouldn't be extracted to stdout")
+
+	_, err = NewConfig([]string{"s3pd", "--tar-include=*", "--extract", "s3://mybucket/dataset.tar", "/mnt/ram-disk"})
+	assert.NotEqual(t, nil, err, "Extracting with an index shouldn't be combined with --extract")
+
+	_, err = NewConfig([]string{"s3pd", "--tar-index=/mnt/dataset.tsv", "s3://mybucket/dataset.tar", "/mnt/ram-disk"})
+	assert.NotEqual(t, nil, err, "--tar-index should require --tar-include")
+}
+
+func TestInvalidManifestFlags(t *testing.T) {
+	_, err := NewConfig([]string{"s3pd", "--manifest-out=/mnt/manifest.jsonl", "/mnt/path1/", "s3://mybucket/prefix/"})
+	assert.NotEqual(t, nil, err, "Uploads shouldn't write a manifest")
+
+	_, err = NewConfig([]string{"s3pd", "--manifest-out=/mnt/manifest.jsonl", "s3://mybucket/prefix/", "/mnt/path1/", "/mnt/path2/"})
+	assert.NotEqual(t, nil, err, "Copies to several destinations shouldn't write a manifest")
+}
@@ -0,0 +1,117 @@
+package downloaders
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"golang.org/x/sync/errgroup"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Inclusive range of an object's bytes, like a HTTP Range header. End is -1 to read to the end of the object
+type ByteRange struct {
+	Start int64
+	End   int64
+}
+
+// Parses a range in the format of start-end, or start- to read to the end of the object
+func ParseByteRange(s string) (ByteRange, error) {
+	start, end, ok := strings.Cut(s, "-")
+	if !ok {
+		return ByteRange{}, fmt.Errorf("range %q must look like start-end E.g. (0-1048575)", s)
+	}
+
+	r := ByteRange{End: -1}
+	var err error
+	if r.Start, err = strconv.ParseInt(start, 10, 64); err != nil || r.Start < 0 {
+		return ByteRange{}, fmt.Errorf("range %q must start at a byte offset", s)
+	}
+	if len(end) != 0 {
+		if r.End, err = strconv.ParseInt(end, 10, 64); err != nil || r.End < r.Start {
+			return ByteRange{}, fmt.Errorf("range %q must end at a byte offset after its start", s)
+		}
+	}
+	return r, nil
+}
+
+// Returns the offset & length of the range within an object of size bytes
+func (r ByteRange) within(size int64) (offset, length int64, err error) {
+	if r.Start >= size {
+		return 0, 0, fmt.Errorf("range %d-%d starts after the end of the %d byte object", r.Start, r.End, size)
+	}
+	end := r.End
+	if end < 0 || end >= size {
+		end = size - 1
+	}
+	return r.Start, end - r.Start + 1, nil
+}
+
+// Fetches size bytes in parts of partsize using threads concurrent requests, writing each part to w at offset plus the part's offset
+func fetchPartsAt(ctx context.Context, w io.WriterAt, offset, size, partsize int64, threads int, fetch fetchFunc) error {
+	eg, ctx := errgroup.WithContext(ctx)
+
+	parts := make(chan int64)
+	eg.Go(func() error {
+		defer close(parts)
+		for p := int64(0); p < size; p += partsize {
+			select {
+			case parts <- p:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+
+	for t := 1; t <= threads; t++ {
+		eg.Go(func() error {
+			buf := make([]byte, partsize)
+			for p := range parts {
+				n := partsize
+				if size-p < n {
+					n = size - p
+				}
+				if err := fetch(ctx, p, buf[:n]); err != nil {
+					return err
+				}
+				if _, err := w.WriteAt(buf[:n], offset+p); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	return eg.Wait()
+}
+
+// Returns the number of bytes of the object that are downloaded, which is only part of it with --range,
+// and a fetchFunc reading them with offsets relative to the first byte downloaded
+func (d S3Download) objectRange(client *s3.Client, j S3ObjectJob) (int64, fetchFunc, error) {
+	return d.fetchRange(j, d.rangeFetcher(client, j))
+}
+
+// Returns the number of bytes of the object that are downloaded, and fetch with offsets relative to the first of them
+func (d S3Download) fetchRange(j S3ObjectJob, fetch fetchFunc) (int64, fetchFunc, error) {
+	if d.Range == nil {
+		return j.Size, fetch, nil
+	}
+
+	start, length, err := d.Range.within(j.Size)
+	if err != nil {
+		return 0, nil, err
+	}
+	return length, func(ctx context.Context, offset int64, buf []byte) error {
+		return fetch(ctx, start+offset, buf)
+	}, nil
+}
+
+// Writes the object, or its range, to w at offset, fetching its parts concurrently
+func (d S3Download) downloadAt(ctx context.Context, client *s3.Client, w io.WriterAt, offset int64, j S3ObjectJob) error {
+	size, fetch, err := d.objectRange(client, j)
+	if err != nil {
+		return err
+	}
+	return fetchPartsAt(ctx, statsWriterAt{w: w, stats: d.stats}, offset, size, d.Partsize, int(d.Threads), fetch)
+}
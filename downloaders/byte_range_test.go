@@ -0,0 +1,143 @@
+package downloaders
+
+import (
+	"bytes"
+	"context"
+	"github.com/op/go-logging"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseByteRange(t *testing.T) {
+	valid := map[string]ByteRange{
+		"0-1023":     {Start: 0, End: 1023},
+		"1024-":      {Start: 1024, End: -1},
+		"5-5":        {Start: 5, End: 5},
+		"123456789-": {Start: 123456789, End: -1},
+	}
+	for s, expected := range valid {
+		r, err := ParseByteRange(s)
+		if err != nil || r != expected {
+			t.Errorf("Expected %q to be %v, got %v %v", s, expected, r, err)
+		}
+	}
+
+	for _, s := range []string{"", "10", "-10", "10-5", "a-b", "1-2-3"} {
+		if _, err := ParseByteRange(s); err == nil {
+			t.Errorf("Expected %q to be rejected", s)
+		}
+	}
+}
+
+func TestByteRangeWithin(t *testing.T) {
+	offset, length, err := ByteRange{Start: 10, End: 19}.within(100)
+	if err != nil || offset != 10 || length != 10 {
+		t.Errorf("Expected 10 bytes at 10, got %d at %d %v", length, offset, err)
+	}
+
+	// ranges ending after the object are cut short
+	offset, length, err = ByteRange{Start: 90, End: 200}.within(100)
+	if err != nil || offset != 90 || length != 10 {
+		t.Errorf("Expected 10 bytes at 90, got %d at %d %v", length, offset, err)
+	}
+	offset, length, err = ByteRange{Start: 0, End: -1}.within(100)
+	if err != nil || offset != 0 || length != 100 {
+		t.Errorf("Expected the whole object, got %d at %d %v", length, offset, err)
+	}
+
+	if _, _, err := (ByteRange{Start: 100, End: -1}).within(100); err == nil {
+		t.Error("Expected a range starting after the object to be rejected")
+	}
+}
+
+func TestFetchPartsAt(t *testing.T) {
+	data := make([]byte, 10*1024+3)
+	rand.Read(data)
+	fetch := func(ctx context.Context, offset int64, buf []byte) error {
+		copy(buf, data[offset:])
+		return nil
+	}
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := fetchPartsAt(context.Background(), f, 100, int64(len(data)), 1024, 4, fetch); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out[100:], data) || !bytes.Equal(out[:100], make([]byte, 100)) {
+		t.Error("Expected the parts to be written after the offset")
+	}
+}
+
+func TestS3DownloadRangeAndConcat(t *testing.T) {
+	clientConfig := testS3ClientConfig(t)
+	client, err := NewS3Client(context.Background(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	big := make([]byte, 3*1024*1024+11)
+	rand.Read(big)
+	parts := map[string][]byte{
+		"concat/part-0": bytes.Repeat([]byte("0"), 1024*1024+5),
+		"concat/part-1": []byte{},
+		"concat/part-2": bytes.Repeat([]byte("2"), 2*1024*1024),
+		"concat/part-3": []byte("3"),
+	}
+	objects := map[string][]byte{"range/big.bin": big}
+	for key, body := range parts {
+		objects[key] = body
+	}
+	createTestObjects(t, client, "s3pd-test", objects)
+
+	dir := t.TempDir()
+	d := S3Download{
+		Bucket:    "s3pd-test",
+		Prefix:    "range/big.bin",
+		Writepath: dir,
+		Workers:   2,
+		Threads:   3,
+		Partsize:  1024 * 1024,
+		MaxList:   2,
+		Client:    clientConfig,
+		Range:     &ByteRange{Start: 1000, End: 2*1024*1024 + 999},
+		Bar:       newTestBar(),
+		Log:       logging.MustGetLogger("s3pd-test"),
+	}
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "big.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, big[1000:2*1024*1024+1000]) {
+		t.Error("Downloaded range doesn't match the object's bytes")
+	}
+
+	concat := filepath.Join(dir, "joined", "all.bin")
+	d.Prefix = "concat/part-"
+	d.Range = nil
+	d.Concat = concat
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	data, err = ioutil.ReadFile(concat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := bytes.Join([][]byte{parts["concat/part-0"], parts["concat/part-2"], parts["concat/part-3"]}, nil)
+	if !bytes.Equal(data, expected) {
+		t.Error("Concatenated file doesn't match the objects in key order")
+	}
+}
@@ -0,0 +1,56 @@
+package downloaders
+
+import (
+	"context"
+	"sort"
+)
+
+// Moves objects from the listed channel to the jobs channel, setting the offset each object is written at in the
+// concatenated file from the sizes of the objects listed before it. Closes jobs once every listed object has been moved over.
+func (d S3Download) concatOffsets(ctx context.Context, listed <-chan S3ObjectJob, jobs chan<- S3ObjectJob) error {
+	defer close(jobs)
+	defer func() {
+		// keep draining after a failure, so that listing isn't blocked on a full channel
+		for range listed {
+		}
+	}()
+
+	var offset int64
+	send := func(j S3ObjectJob) error {
+		j.Offset = offset
+		offset += j.Size
+		select {
+		case jobs <- j:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return inKeyOrder(d.Bucket, listed, send)
+}
+
+// Calls f with each listed object in key order. Directory buckets don't list keys in order,
+// so every object is listed & sorted before f is called
+func inKeyOrder(bucket string, listed <-chan S3ObjectJob, f func(S3ObjectJob) error) error {
+	if !IsDirectoryBucket(bucket) {
+		for j := range listed {
+			if err := f(j); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var all []S3ObjectJob
+	for j := range listed {
+		all = append(all, j)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Key < all[j].Key })
+	for _, j := range all {
+		if err := f(j); err != nil {
+			return err
+		}
+	}
+	return nil
+}
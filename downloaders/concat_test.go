@@ -0,0 +1,50 @@
+package downloaders
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestConcatOffsets(t *testing.T) {
+	listed := make(chan S3ObjectJob, 3)
+	jobs := make(chan S3ObjectJob, 3)
+	listed <- S3ObjectJob{Key: "part-0", Size: 10}
+	listed <- S3ObjectJob{Key: "part-1", Size: 0}
+	listed <- S3ObjectJob{Key: "part-2", Size: 5}
+	close(listed)
+
+	if err := (S3Download{Bucket: "bucket"}).concatOffsets(context.Background(), listed, jobs); err != nil {
+		t.Fatal(err)
+	}
+	var offsets []int64
+	for j := range jobs {
+		offsets = append(offsets, j.Offset)
+	}
+	if !reflect.DeepEqual(offsets, []int64{0, 10, 10}) {
+		t.Errorf("Expected offsets [0 10 10], got %v", offsets)
+	}
+}
+
+func TestConcatOffsetsDirectoryBucket(t *testing.T) {
+	// directory buckets list keys out of order
+	listed := make(chan S3ObjectJob, 3)
+	jobs := make(chan S3ObjectJob, 3)
+	listed <- S3ObjectJob{Key: "part-2", Size: 5}
+	listed <- S3ObjectJob{Key: "part-0", Size: 10}
+	listed <- S3ObjectJob{Key: "part-1", Size: 3}
+	close(listed)
+
+	d := S3Download{Bucket: "mybucket--usw2-az1--x-s3"}
+	if err := d.concatOffsets(context.Background(), listed, jobs); err != nil {
+		t.Fatal(err)
+	}
+	offsets := map[string]int64{}
+	for j := range jobs {
+		offsets[j.Key] = j.Offset
+	}
+	expected := map[string]int64{"part-0": 0, "part-1": 10, "part-2": 13}
+	if !reflect.DeepEqual(offsets, expected) {
+		t.Errorf("Expected offsets %v, got %v", expected, offsets)
+	}
+}
@@ -0,0 +1,140 @@
+package downloaders
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Compression format of an object that's decompressed as it's downloaded
+type compression string
+
+const (
+	compressionNone compression = ""
+	compressionGzip compression = "gzip"
+	compressionZstd compression = "zstd"
+
+	// Decided by the Content-Encoding of the object's first ranged GET
+	compressionEncoding compression = "content-encoding"
+)
+
+// Extensions of compressed objects, which are dropped from the decompressed file's name
+var compressionExtensions = map[string]compression{
+	".gz":   compressionGzip,
+	".gzip": compressionGzip,
+	".zst":  compressionZstd,
+	".zstd": compressionZstd,
+}
+
+// Returns the compression of the object going by its key's extension
+func compressionByExtension(key string) compression {
+	return compressionExtensions[strings.ToLower(path.Ext(key))]
+}
+
+// Returns the compression given by the object's Content-Encoding
+func compressionByEncoding(encoding string) compression {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		return compressionGzip
+	case "zstd":
+		return compressionZstd
+	}
+	return compressionNone
+}
+
+// Drops the compression extension from the name, as the file holds the decompressed bytes
+func trimCompressionExtension(name string) string {
+	ext := path.Ext(name)
+	if _, ok := compressionExtensions[strings.ToLower(ext)]; !ok || len(path.Base(name)) == len(ext) {
+		return name
+	}
+	return strings.TrimSuffix(name, ext)
+}
+
+// Returns a reader of the decompressed bytes of r
+func newDecompressor(c compression, r io.Reader) (io.ReadCloser, error) {
+	if c == compressionZstd {
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	}
+	return gzip.NewReader(r)
+}
+
+// Returns how the object is to be decompressed, which is compressionNone unless --decompress is set.
+// Objects without a compressed extension are decompressed if their Content-Encoding is gzip or zstd,
+// which is read from the first ranged GET rather than with a HEAD request
+func (d S3Download) objectCompression(j S3ObjectJob) compression {
+	if !d.Decompress || isDirectoryMarker(j.Key) {
+		return compressionNone
+	}
+	if c := compressionByExtension(j.Key); c != compressionNone {
+		return c
+	}
+	return compressionEncoding
+}
+
+// The Content-Encoding of the first response to a ranged GET of an object
+type firstEncoding struct {
+	once     sync.Once
+	encoding string
+}
+
+func (e *firstEncoding) seen(out *s3.GetObjectOutput) {
+	e.once.Do(func() { e.encoding = aws.ToString(out.ContentEncoding) })
+}
+
+// Writes the object's decompressed bytes to w
+func (d S3Download) decompressObject(ctx context.Context, client *s3.Client, j S3ObjectJob, c compression, w io.Writer) error {
+	return d.consumeObject(ctx, client, j, c, func(r io.Reader) error {
+		_, err := io.Copy(statsWriter{w: w, stats: d.stats}, r)
+		return err
+	})
+}
+
+// Reads the object's bytes, decompressed unless c is compressionNone, with consume. The bytes are fetched with
+// concurrent ranged GETs, and go through the reorder buffer so that they're read in order
+func (d S3Download) consumeObject(ctx context.Context, client *s3.Client, j S3ObjectJob, c compression, consume func(io.Reader) error) error {
+	// an empty object isn't a valid gzip stream, but is treated as being empty rather than failing
+	if j.Size == 0 {
+		return consume(bytes.NewReader(nil))
+	}
+
+	var encoding firstEncoding
+	fetch := d.rangeFetcher(client, j)
+	if c == compressionEncoding {
+		fetch = newObjectFetcher(client, d.Bucket, d.Request, d.Bar, j, encoding.seen)
+	}
+	size, fetch, err := d.fetchRange(j, fetch)
+	if err != nil {
+		return err
+	}
+	return consumeParts(ctx, size, d.Partsize, int(d.Threads), d.streamWindow(), fetch, func(r io.Reader) error {
+		if c == compressionEncoding {
+			// the first part has been fetched once any of its bytes can be read. A failed fetch
+			// leaves the encoding unset, and its error is returned by the next read
+			br := bufio.NewReader(r)
+			br.Peek(1)
+			r, c = br, compressionByEncoding(encoding.encoding)
+		}
+		if c != compressionNone {
+			dec, err := newDecompressor(c, r)
+			if err != nil {
+				return err
+			}
+			defer dec.Close()
+			r = dec
+		}
+		return consume(r)
+	})
+}
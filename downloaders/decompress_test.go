@@ -0,0 +1,200 @@
+package downloaders
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/klauspost/compress/zstd"
+	"github.com/op/go-logging"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zstdBytes(t *testing.T, data []byte) []byte {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enc.Close()
+	return enc.EncodeAll(data, nil)
+}
+
+func TestCompressionDetection(t *testing.T) {
+	extensions := map[string]compression{
+		"logs/a.json.gz": compressionGzip,
+		"logs/a.GZ":      compressionGzip,
+		"logs/a.zst":     compressionZstd,
+		"logs/a.zstd":    compressionZstd,
+		"logs/a.json":    compressionNone,
+		"logs/gz":        compressionNone,
+	}
+	for key, expected := range extensions {
+		if c := compressionByExtension(key); c != expected {
+			t.Errorf("Expected %s to be %q, got %q", key, expected, c)
+		}
+	}
+
+	encodings := map[string]compression{"gzip": compressionGzip, "x-gzip": compressionGzip, "zstd": compressionZstd, "": compressionNone, "br": compressionNone}
+	for encoding, expected := range encodings {
+		if c := compressionByEncoding(encoding); c != expected {
+			t.Errorf("Expected Content-Encoding %q to be %q, got %q", encoding, expected, c)
+		}
+	}
+
+	names := map[string]string{"a/b.json.gz": "a/b.json", "a/b.zst": "a/b", "a/b.json": "a/b.json", "a/.gz": "a/.gz"}
+	for name, expected := range names {
+		if trimmed := trimCompressionExtension(name); trimmed != expected {
+			t.Errorf("Expected %s to be trimmed to %s, got %s", name, expected, trimmed)
+		}
+	}
+}
+
+func TestNewDecompressor(t *testing.T) {
+	data := bytes.Repeat([]byte("decompressed "), 1000)
+	for c, compressed := range map[compression][]byte{compressionGzip: gzipBytes(t, data), compressionZstd: zstdBytes(t, data)} {
+		r, err := newDecompressor(c, bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || !bytes.Equal(out, data) {
+			t.Errorf("Expected %s to decompress to the original data, got %v", c, err)
+		}
+	}
+}
+
+func TestS3DownloadDecompress(t *testing.T) {
+	clientConfig := testS3ClientConfig(t)
+	client, err := NewS3Client(context.Background(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// incompressible, so that the compressed objects are several parts
+	data := make([]byte, 3*1024*1024)
+	rand.Read(data)
+	createTestObjects(t, client, "s3pd-test", map[string][]byte{
+		"decompress/a.bin.gz":  gzipBytes(t, data),
+		"decompress/b.bin.zst": zstdBytes(t, data),
+		"decompress/c.bin":     data,
+	})
+	_, err = client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket:          aws.String("s3pd-test"),
+		Key:             aws.String("decompress/d.bin"),
+		Body:            bytes.NewReader(gzipBytes(t, data)),
+		ContentEncoding: aws.String("gzip"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	d := S3Download{
+		Bucket:     "s3pd-test",
+		Prefix:     "decompress/",
+		Writepath:  dir,
+		Workers:    2,
+		Threads:    3,
+		Partsize:   1024 * 1024,
+		MaxList:    10,
+		Client:     clientConfig,
+		Decompress: true,
+		Summary:    NewRunSummary(),
+		Bar:        newTestBar(),
+		Log:        logging.MustGetLogger("s3pd-test"),
+	}
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"a.bin", "b.bin", "c.bin", "d.bin"} {
+		out, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("Expected %s to be decompressed", name)
+		}
+	}
+
+	// the Content-Encoding comes from the GETs, rather than a HEAD of each object
+	if n := d.Summary.Totals().Requests["HeadObject"]; n != 0 {
+		t.Errorf("Expected no HeadObject requests, got %d", n)
+	}
+}
+
+func TestS3DownloadDecompressXattrs(t *testing.T) {
+	clientConfig := testS3ClientConfig(t)
+	client, err := NewS3Client(context.Background(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("decompressed with its metadata")
+	createTestObjects(t, client, "s3pd-test", nil)
+	_, err = client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket:          aws.String("s3pd-test"),
+		Key:             aws.String("decompress-xattrs/a.json"),
+		Body:            bytes.NewReader(gzipBytes(t, data)),
+		ContentEncoding: aws.String("gzip"),
+		ContentType:     aws.String("application/json"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	if err := setXattr(dir, "user.s3pd.test", []byte("1")); err != nil {
+		t.Skipf("extended attributes not supported: %v", err)
+	}
+	d := S3Download{
+		Bucket:     "s3pd-test",
+		Prefix:     "decompress-xattrs/",
+		Writepath:  dir,
+		Workers:    1,
+		Threads:    1,
+		Partsize:   1024 * 1024,
+		MaxList:    10,
+		Client:     clientConfig,
+		Decompress: true,
+		Xattrs:     true,
+		Bar:        newTestBar(),
+		Log:        logging.MustGetLogger("s3pd-test"),
+	}
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "a.json")
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Errorf("Expected a.json to be decompressed")
+	}
+	m, err := readMetadataXattrs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ContentEncoding != "" || m.ContentType != "application/json" {
+		t.Errorf("Expected the decompressed file's metadata without its Content-Encoding, got %+v", m)
+	}
+}
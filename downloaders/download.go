@@ -5,6 +5,8 @@ import (
 )
 
 type Downloader interface {
-	Throughput() float64
 	Start(ctx context.Context) error
+
+	// Bytes written & received, and requests in flight, since Start was called
+	Stats() *Stats
 }
@@ -0,0 +1,228 @@
+package downloaders
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/op/go-logging"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Extensions of tar archives, and how they're compressed
+var archiveExtensions = []struct {
+	ext         string
+	compression compression
+}{
+	{".tar", compressionNone},
+	{".tar.gz", compressionGzip},
+	{".tgz", compressionGzip},
+	{".tar.zst", compressionZstd},
+	{".tzst", compressionZstd},
+}
+
+// Returns how the object is compressed if it's a tar archive that's extracted, going by its key's extension
+func (d S3Download) archiveCompression(key string) (compression, bool) {
+	if !d.Extract {
+		return compressionNone, false
+	}
+	for _, a := range archiveExtensions {
+		if strings.HasSuffix(strings.ToLower(key), a.ext) {
+			return a.compression, true
+		}
+	}
+	return compressionNone, false
+}
+
+// Unpacks the tar archive object into dir as its bytes arrive, fetching them with concurrent ranged GETs
+func (d S3Download) extractObject(ctx context.Context, client *s3.Client, j S3ObjectJob, c compression, dir string) error {
+	claim := d.extracted.entryClaimer(j.Key, d.objectRoot(j))
+	return d.consumeObject(ctx, client, j, c, func(r io.Reader) error {
+		if err := extractTar(r, dir, claim, d.Log, d.stats); err != nil {
+			return err
+		}
+		// tar archives are padded out after their last entry
+		_, err := io.Copy(ioutil.Discard, r)
+		return err
+	})
+}
+
+// Returns the path an archive entry is written to, given the path it'd be written to & the decisions made mapping its name
+type entryClaimer func(path string, dir bool, decisions []string) (string, error)
+
+// Paths written by archive entries & the objects downloaded alongside them, which can be claimed by multiple workers.
+// Entries of archives in the same folder, and entries with the path of an object, would otherwise overwrite each other,
+// so whichever is written second goes through the --on-conflict policy
+type extractedPaths struct {
+	mapping PathMapping
+	report  *tsvReport
+
+	// files are claimed by the key of the archive or object that wrote them
+	*claimedPaths
+}
+
+func newExtractedPaths(mapping PathMapping, report *tsvReport) *extractedPaths {
+	return &extractedPaths{mapping: mapping, report: report, claimedPaths: newClaimedPaths()}
+}
+
+// Returns the path to write to for key, which is path unless it's been claimed, in which case it goes through the
+// --on-conflict policy. The decision is one of renamed or sidecar, or empty when path is free
+func (p *extractedPaths) resolve(key, root, path string, dir bool) (string, string, error) {
+	if p == nil || p.claim(key, path, dir) {
+		return path, "", nil
+	}
+
+	resolved, decision := "", ""
+	switch p.mapping.Conflicts {
+	case ConflictRename:
+		resolved, decision = path+p.mapping.RenameSuffix, decisionRenamed
+	case ConflictSidecar:
+		rel, err := filepath.Rel(root, path)
+		if err == nil {
+			resolved, decision = filepath.Join(root, p.mapping.SidecarDir, rel), decisionSidecar
+		}
+	}
+	if len(resolved) != 0 {
+		resolved = p.claimUnique(key, resolved, dir)
+	}
+	if len(resolved) == 0 {
+		if err := p.report.Write(key, path, decisionConflict); err != nil {
+			return "", "", err
+		}
+		return "", "", fmt.Errorf("%s has the same path as an extracted archive entry or another object, see --on-conflict", path)
+	}
+	return resolved, decision, nil
+}
+
+// Returns the path the object is written to, which only differs from path when an archive entry has already been written there
+func (p *extractedPaths) objectPath(key, root, path string) (string, error) {
+	resolved, decision, err := p.resolve(key, root, path, false)
+	if err != nil || len(decision) == 0 {
+		return resolved, err
+	}
+	return resolved, p.report.Write(key, resolved, decision)
+}
+
+// Returns the entryClaimer for the archive's entries, which are written to the mapping report against the archive's key
+func (p *extractedPaths) entryClaimer(key, root string) entryClaimer {
+	return func(path string, dir bool, decisions []string) (string, error) {
+		resolved, decision, err := p.resolve(key, root, path, dir)
+		if err != nil || p == nil {
+			return resolved, err
+		}
+		extracted := []string{decisionExtracted}
+		if len(decision) != 0 {
+			extracted = append(extracted, decision)
+		}
+		return resolved, p.report.Write(key, resolved, strings.Join(append(extracted, decisions...), ","))
+	}
+}
+
+// Writes the files & folders in the tar archive to dir. Entry names go through the same rules as keys,
+// so entries can't be written outside of dir, and the paths they're written to are claimed with claim unless it's nil.
+// Hard links are written as copies of the file they link to. Symbolic links & devices are skipped
+func extractTar(r io.Reader, dir string, claim entryClaimer, log *logging.Logger, stats *Stats) error {
+	// paths the archive's files were written to, by their name, for the hard links to them
+	written := map[string]string{}
+
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if h.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		if h.Typeflag != tar.TypeDir && h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeLink {
+			log.Warningf("Skipping the archive entry %q, only files, folders & hard links are extracted\n", h.Name)
+			continue
+		}
+
+		name := archiveMemberName(h.Name)
+		if name == "." {
+			continue
+		}
+		rel, decisions, err := safeRelativePath(name)
+		if err != nil {
+			log.Warningf("Skipping the archive entry %q: %v\n", h.Name, err)
+			continue
+		}
+
+		target, linked := written[archiveMemberName(h.Linkname)]
+		if h.Typeflag == tar.TypeLink && !linked {
+			log.Warningf("Skipping the archive entry %q, it links to %q which isn't a file extracted before it\n", h.Name, h.Linkname)
+			continue
+		}
+
+		path := filepath.Join(dir, rel)
+		if claim != nil {
+			if path, err = claim(path, h.Typeflag == tar.TypeDir, decisions); err != nil {
+				return err
+			}
+		}
+
+		if h.Typeflag == tar.TypeDir {
+			if err := os.MkdirAll(path, os.ModePerm); err != nil {
+				return err
+			}
+			continue
+		}
+		if h.Typeflag == tar.TypeLink {
+			if target == path {
+				continue
+			}
+			err = copyExtracted(target, path, stats)
+		} else {
+			err = extractFile(tr, h, path, stats)
+		}
+		if err != nil {
+			return err
+		}
+		written[name] = path
+	}
+}
+
+// Writes the entry's bytes from r to path, keeping its permissions & modification time
+func extractFile(r io.Reader, h *tar.Header, path string, stats *Stats) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(h.Mode).Perm()|0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(statsWriter{w: f, stats: stats}, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if h.ModTime.IsZero() {
+		return nil
+	}
+	return os.Chtimes(path, h.ModTime, h.ModTime)
+}
+
+// Writes a copy of the extracted file at target to path, for a hard link to it
+func copyExtracted(target, path string, stats *Stats) error {
+	f, err := os.Open(target)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return extractFile(f, &tar.Header{Mode: int64(info.Mode().Perm()), ModTime: info.ModTime()}, path, stats)
+}
@@ -0,0 +1,243 @@
+package downloaders
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"github.com/op/go-logging"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns a tar archive of the given entries, each of which is a file unless its header says otherwise
+func tarBytes(t *testing.T, entries []tar.Header, bodies map[string][]byte) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range entries {
+		h := h
+		if h.Typeflag == tar.TypeReg {
+			h.Size = int64(len(bodies[h.Name]))
+		}
+		if err := tw.WriteHeader(&h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(bodies[h.Name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractTar(t *testing.T) {
+	mtime := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	archive := tarBytes(t, []tar.Header{
+		{Name: "./", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "./data/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "./data/a.txt", Typeflag: tar.TypeReg, Mode: 0640, ModTime: mtime},
+		{Name: "../escape.txt", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "/etc/absolute.txt", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "data/link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"},
+		{Name: "data/hard.txt", Typeflag: tar.TypeLink, Linkname: "./data/a.txt"},
+		{Name: "data/dangling.txt", Typeflag: tar.TypeLink, Linkname: "missing.txt"},
+	}, map[string][]byte{
+		"./data/a.txt":      []byte("a"),
+		"../escape.txt":     []byte("escape"),
+		"/etc/absolute.txt": []byte("absolute"),
+	})
+
+	dir := t.TempDir()
+	if err := extractTar(bytes.NewReader(archive), dir, nil, logging.MustGetLogger("s3pd-test"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"data/a.txt":        "a",
+		"data/hard.txt":     "a",
+		"%2E%2E/escape.txt": "escape",
+		"etc/absolute.txt":  "absolute",
+	}
+	for name, expected := range files {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(data) != expected {
+			t.Errorf("Expected %s to hold %q, got %q %v", name, expected, data, err)
+		}
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "data/a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 || !info.ModTime().Equal(mtime) {
+		t.Errorf("Expected the entry's mode & mtime to be kept, got %v %v", info.Mode(), info.ModTime())
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "data/link")); !os.IsNotExist(err) {
+		t.Error("Expected symbolic links to be skipped")
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "data/dangling.txt")); !os.IsNotExist(err) {
+		t.Error("Expected hard links to files that weren't extracted to be skipped")
+	}
+}
+
+func TestExtractedPaths(t *testing.T) {
+	p := newExtractedPaths(PathMapping{Conflicts: ConflictFail}, &tsvReport{})
+	claims := []struct {
+		key, path string
+		dir, ok   bool
+	}{
+		{"a.tar", "/dest/a/x.txt", false, true},
+		{"a.tar", "/dest/a/x.txt", false, true},
+		{"b.tar", "/dest/a/x.txt", false, false},
+		{"b.tar", "/dest/a", true, true},
+		{"b.tar", "/dest/a", false, false},
+		{"b.tar", "/dest/a/x.txt/y.txt", false, false},
+		{"b.tar", "/dest/a/x.txt", true, false},
+		{"c.txt", "/dest/c.txt", false, true},
+	}
+	for _, c := range claims {
+		if ok := p.claim(c.key, c.path, c.dir); ok != c.ok {
+			t.Errorf("Expected claiming %s for %s to be %v, got %v", c.path, c.key, c.ok, ok)
+		}
+	}
+}
+
+func TestExtractTarConflicts(t *testing.T) {
+	archive := tarBytes(t, []tar.Header{
+		{Name: "a.txt", Typeflag: tar.TypeReg, Mode: 0644},
+	}, map[string][]byte{"a.txt": []byte("archive")})
+
+	policies := map[ConflictPolicy]struct{ path, decision string }{
+		ConflictRename:  {"a.txt.file", decisionRenamed},
+		ConflictSidecar: {".conflicts/a.txt", decisionSidecar},
+	}
+	for policy, expected := range policies {
+		dir := t.TempDir()
+		report := filepath.Join(dir, "report.tsv")
+		r, err := newTSVReport(report, "key", "path", "decision")
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := newExtractedPaths(PathMapping{Conflicts: policy, RenameSuffix: ".file", SidecarDir: ".conflicts"}, r)
+
+		// the object written before the archive keeps its path
+		if path, err := p.objectPath("a.txt", dir, filepath.Join(dir, "a.txt")); err != nil || path != filepath.Join(dir, "a.txt") {
+			t.Fatalf("Expected the object to keep its path, got %s %v", path, err)
+		}
+		claim := p.entryClaimer("shard.tar", dir)
+		if err := extractTar(bytes.NewReader(archive), dir, claim, logging.MustGetLogger("s3pd-test"), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if data, err := ioutil.ReadFile(filepath.Join(dir, expected.path)); err != nil || string(data) != "archive" {
+			t.Errorf("Expected the entry to be written to %s with %s, got %v", expected.path, policy, err)
+		}
+		data, err := ioutil.ReadFile(report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		row := "shard.tar\t" + filepath.Join(dir, expected.path) + "\textracted," + expected.decision + "\n"
+		if !strings.Contains(string(data), row) {
+			t.Errorf("Expected the report to hold %q, got %q", row, data)
+		}
+	}
+
+	dir := t.TempDir()
+	p := newExtractedPaths(PathMapping{Conflicts: ConflictFail}, &tsvReport{})
+	for _, key := range []string{"shard-0.tar", "shard-1.tar"} {
+		err := extractTar(bytes.NewReader(archive), dir, p.entryClaimer(key, dir), logging.MustGetLogger("s3pd-test"), nil)
+		if key == "shard-1.tar" && err == nil {
+			t.Error("Expected entries of archives in the same folder to conflict with --on-conflict=fail")
+		}
+	}
+	// the object written after the archive is the one that conflicts
+	if _, err := p.objectPath("a.txt", dir, filepath.Join(dir, "a.txt")); err == nil {
+		t.Error("Expected an object with the path of an archive entry to conflict")
+	}
+}
+
+func TestArchiveCompression(t *testing.T) {
+	d := S3Download{Extract: true}
+	archives := map[string]compression{
+		"shards/0001.tar":     compressionNone,
+		"shards/0001.tar.gz":  compressionGzip,
+		"shards/0001.TGZ":     compressionGzip,
+		"shards/0001.tar.zst": compressionZstd,
+	}
+	for key, expected := range archives {
+		if c, ok := d.archiveCompression(key); !ok || c != expected {
+			t.Errorf("Expected %s to be an archive compressed with %q, got %q", key, expected, c)
+		}
+	}
+	for _, key := range []string{"shards/0001.gz", "shards/tar", "shards/0001.zip"} {
+		if _, ok := d.archiveCompression(key); ok {
+			t.Errorf("Expected %s not to be an archive", key)
+		}
+	}
+	if _, ok := (S3Download{}).archiveCompression("shards/0001.tar"); ok {
+		t.Error("Expected archives to only be extracted with --extract")
+	}
+}
+
+func TestS3DownloadExtract(t *testing.T) {
+	clientConfig := testS3ClientConfig(t)
+	client, err := NewS3Client(context.Background(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	big := bytes.Repeat([]byte("big"), 1024*1024)
+	archive := tarBytes(t, []tar.Header{
+		{Name: "big.bin", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "sub/small.txt", Typeflag: tar.TypeReg, Mode: 0644},
+	}, map[string][]byte{"big.bin": big, "sub/small.txt": []byte("small")})
+	createTestObjects(t, client, "s3pd-test", map[string][]byte{
+		"extract/shard-0.tar":         archive,
+		"extract/gz/shard-1.tar.gz":   gzipBytes(t, archive),
+		"extract/zst/shard-2.tar.zst": zstdBytes(t, archive),
+		"extract/readme.txt":          []byte("readme"),
+	})
+
+	dir := t.TempDir()
+	d := S3Download{
+		Bucket:    "s3pd-test",
+		Prefix:    "extract/",
+		Writepath: dir,
+		Workers:   2,
+		Threads:   3,
+		Partsize:  1024 * 1024,
+		MaxList:   10,
+		Client:    clientConfig,
+		Extract:   true,
+		Bar:       newTestBar(),
+		Log:       logging.MustGetLogger("s3pd-test"),
+	}
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, folder := range []string{"", "gz", "zst"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, folder, "big.bin"))
+		if err != nil || !bytes.Equal(data, big) {
+			t.Errorf("Expected big.bin to be extracted into %q, got %v", folder, err)
+		}
+		data, err = ioutil.ReadFile(filepath.Join(dir, folder, "sub/small.txt"))
+		if err != nil || string(data) != "small" {
+			t.Errorf("Expected sub/small.txt to be extracted into %q, got %v", folder, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "shard-0.tar")); !os.IsNotExist(err) {
+		t.Error("Expected the archive itself not to be written")
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "readme.txt")); err != nil || string(data) != "readme" {
+		t.Errorf("Expected objects that aren't archives to be downloaded, got %v", err)
+	}
+}
@@ -0,0 +1,621 @@
+package downloaders
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/cheggaaa/pb/v3"
+	"github.com/op/go-logging"
+	"golang.org/x/sync/errgroup"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// S3 multipart uploads can have at most 10,000 parts, all but the last of at least 5MiB
+const (
+	maxUploadParts    = 10000
+	minUploadPartsize = 5 * 1024 * 1024
+)
+
+// Number of errors kept in each destination's summary
+const maxSummaryErrors = 10
+
+// Copies objects or files from one source to several destinations, reading each part from the source once.
+// A destination failing to write an object doesn't stop the object being written to the other destinations
+type FanOut struct {
+	// Source, either an S3 Bucket & Prefix, or a local Readpath
+	Bucket   string
+	Prefix   string
+	Readpath string
+
+	Destinations []FanOutDestination
+	Workers      uint
+	Threads      uint
+	Partsize     int64
+	MaxList      int
+
+	SourceClient      S3ClientConfig
+	DestinationClient S3ClientConfig
+	Request           S3RequestOptions
+
+	Bar   *pb.ProgressBar
+	Log   *logging.Logger
+	stats *Stats
+
+	// Counts the objects copied to every destination, the objects that failed, and the requests made, when set
+	Summary *RunSummary
+
+	summaries []*FanOutSummary
+}
+
+// Local path, or S3 bucket & prefix, objects are copied to
+type FanOutDestination struct {
+	Path   string
+	Bucket string
+	Prefix string
+}
+
+func (d FanOutDestination) isS3() bool {
+	return len(d.Bucket) != 0
+}
+
+func (d FanOutDestination) String() string {
+	if d.isS3() {
+		return "s3://" + d.Bucket + "/" + d.Prefix
+	}
+	return d.Path
+}
+
+// What was written to a destination
+type FanOutSummary struct {
+	Destination string
+	Objects     int64
+	Bytes       int64
+	Failed      int64
+
+	// First few errors the destination had
+	Errors []string
+
+	mu sync.Mutex
+}
+
+func (s *FanOutSummary) succeeded(size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Objects++
+	s.Bytes += size
+}
+
+func (s *FanOutSummary) failed(name string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Failed++
+	if len(s.Errors) < maxSummaryErrors {
+		s.Errors = append(s.Errors, fmt.Sprintf("%s: %s", name, err))
+	}
+}
+
+// Object or file being copied
+type fanOutJob struct {
+	// Path relative to the source, which is also the path relative to each destination
+	Name string
+	Size int64
+
+	// Where the source is read from, Key when the source is S3, otherwise Filepath
+	Key      string
+	Filepath string
+
+	// Whether the object is a directory marker
+	Dir bool
+}
+
+func (d *FanOut) Start(ctx context.Context) error {
+	d.stats = newStats()
+	defer d.stats.finish()
+	if len(d.Destinations) == 0 {
+		return errors.New("no destinations to copy to")
+	}
+
+	d.summaries = nil
+	for _, dest := range d.Destinations {
+		if dest.isS3() && d.Partsize < minUploadPartsize {
+			return fmt.Errorf("--partsize must be at least %d bytes to write to %s", minUploadPartsize, dest)
+		}
+		d.summaries = append(d.summaries, &FanOutSummary{Destination: dest.String()})
+	}
+
+	connections := int(d.Workers * d.Threads)
+	var source, destination *s3.Client
+	var err error
+	if len(d.Bucket) != 0 {
+		if source, err = d.newClient(ctx, d.SourceClient, connections); err != nil {
+			return err
+		}
+	}
+	for _, dest := range d.Destinations {
+		if dest.isS3() {
+			if destination, err = d.newClient(ctx, d.DestinationClient, connections*len(d.Destinations)); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	jobs := make(chan fanOutJob, d.MaxList*3)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	eg, ctx := errgroup.WithContext(ctx)
+	for w := 1; w <= int(d.Workers); w++ {
+		w := w
+		eg.Go(func() error {
+			return d.worker(ctx, w, source, destination, jobs)
+		})
+	}
+
+	// Start the progress bar
+	d.Bar.Start()
+
+	// Queue up copy tasks
+	if err := d.list(source, jobs); err != nil {
+		// if error stop the workers, and wait for them to exit before returning the error
+		cancel()
+		close(jobs)
+		eg.Wait()
+		return err
+	}
+
+	// Indicate that we listed every single object and there's no more objs needing to be queued
+	close(jobs)
+
+	// Wait till all copies finish, or until we get our first error reading from the source
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+	d.Bar.Finish()
+
+	var failed int
+	for _, s := range d.summaries {
+		d.Log.Noticef("%s: %d objects, %.2fMiB written, %d failed\n",
+			s.Destination, s.Objects, float64(s.Bytes)/1024/1024, s.Failed)
+		for _, e := range s.Errors {
+			d.Log.Errorf("%s: %s\n", s.Destination, e)
+		}
+		if s.Failed != 0 {
+			failed++
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d of %d destinations failed to write every object", failed, len(d.summaries))
+	}
+	return nil
+}
+
+// Returns what was written to each destination
+func (d FanOut) Summaries() []*FanOutSummary {
+	return d.summaries
+}
+
+func (d FanOut) newClient(ctx context.Context, c S3ClientConfig, connections int) (*s3.Client, error) {
+	// Keep enough idle connections around for every concurrent request
+	if c.HTTP.MaxIdleConnsPerHost == 0 {
+		c.HTTP.MaxIdleConnsPerHost = connections
+	}
+	c.Stats = d.stats
+	c.Summary = d.Summary
+	return NewS3Client(ctx, c)
+}
+
+// Lists the source, reusing the S3 & filesystem listings
+func (d FanOut) list(client *s3.Client, jobs chan<- fanOutJob) error {
+	if len(d.Bucket) != 0 {
+		lister := S3Download{Bucket: d.Bucket, Prefix: d.Prefix, MaxList: d.MaxList, Request: d.Request, Log: d.Log, Bar: d.Bar}
+		listed := make(chan S3ObjectJob, d.MaxList)
+		errs := make(chan error, 1)
+		go func() {
+			errs <- lister.list(client, listed)
+			close(listed)
+		}()
+		for j := range listed {
+			jobs <- fanOutJob{
+				Name: lister.relativePath(j.Key),
+				Size: j.Size,
+				Key:  j.Key,
+				Dir:  isDirectoryMarker(j.Key),
+			}
+		}
+		return <-errs
+	}
+
+	lister := FilesystemDownload{Readpath: d.Readpath, Log: d.Log, Bar: d.Bar}
+	listed := make(chan FileCopyJob, d.MaxList)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- lister.list(listed)
+		close(listed)
+	}()
+	for j := range listed {
+		name := strings.TrimPrefix(filepath.ToSlash(j.Filepath[len(j.Readpath):]), "/")
+		if len(name) == 0 {
+			// Readpath is the file being copied
+			name = j.Name
+		}
+		jobs <- fanOutJob{Name: name, Size: j.Size, Filepath: j.Filepath}
+	}
+	return <-errs
+}
+
+func (d FanOut) worker(ctx context.Context, id int, source, destination *s3.Client, jobs <-chan fanOutJob) error {
+	buffers := sync.Pool{New: func() interface{} { return make([]byte, d.Partsize) }}
+
+	for j := range jobs {
+		d.Log.Debugf("worker-%d copying %s to %d destinations [%.2fMiB]\n",
+			id, j.Name, len(d.Destinations), float64(j.Size)/1024/1024)
+		start := time.Now()
+		copied, err := d.copyObject(ctx, j, source, destination, &buffers)
+		if err != nil {
+			d.Summary.objectFailed()
+			return err
+		}
+		if copied {
+			d.Summary.objectDone(j.Size, time.Since(start))
+		} else {
+			d.Summary.objectFailed()
+		}
+	}
+	return nil
+}
+
+// Copies the object to every destination, returning whether every destination was written. Only errors reading from the source are returned,
+// errors writing to a destination are recorded in the destination's summary
+func (d FanOut) copyObject(ctx context.Context, j fanOutJob, source, destination *s3.Client, buffers *sync.Pool) (bool, error) {
+	read, closeSource, err := d.openSource(ctx, j, source)
+	if err != nil {
+		return false, err
+	}
+	defer closeSource()
+
+	// Open a sink for each destination, a nil sink has failed
+	sinks := make([]*liveSink, len(d.Destinations))
+	fail := func(i int, err error) {
+		if sinks[i].abort(ctx) {
+			d.summaries[i].failed(j.Name, err)
+		}
+	}
+	for i, dest := range d.Destinations {
+		sink, err := d.openSink(dest, j, destination)
+		if err != nil {
+			d.summaries[i].failed(j.Name, err)
+		}
+		sinks[i] = &liveSink{sink: sink}
+	}
+
+	// Read each part once, writing it to every destination
+	eg, egCtx := errgroup.WithContext(ctx)
+	parts := make(chan int64, d.Threads)
+	for t := 1; t <= int(d.Threads); t++ {
+		eg.Go(func() error {
+			for offset := range parts {
+				buf := buffers.Get().([]byte)
+				n, err := read(egCtx, buf, offset)
+				if err != nil {
+					buffers.Put(buf)
+					return err
+				}
+				d.Bar.Add(n)
+
+				partNumber := int32(offset/d.Partsize) + 1
+				for i, sink := range sinks {
+					written, err := sink.writePart(egCtx, partNumber, offset, buf[:n])
+					if err != nil {
+						fail(i, err)
+					} else if written {
+						d.stats.addWritten(int64(n))
+					}
+				}
+				buffers.Put(buf)
+			}
+			return nil
+		})
+	}
+	for offset := int64(0); offset < j.Size; offset += d.Partsize {
+		select {
+		case parts <- offset:
+		case <-egCtx.Done():
+		}
+	}
+	close(parts)
+
+	if err := eg.Wait(); err != nil {
+		for _, sink := range sinks {
+			sink.abort(ctx)
+		}
+		return false, err
+	}
+
+	// every write has finished, so the sinks still alive can be closed
+	copied := true
+	for i, sink := range sinks {
+		if sink.sink == nil {
+			copied = false
+			continue
+		}
+		if err := sink.sink.Close(ctx); err != nil {
+			fail(i, err)
+			copied = false
+			continue
+		}
+		d.summaries[i].succeeded(j.Size)
+	}
+	return copied, nil
+}
+
+// Sink of a destination that parts are written to concurrently. Once a write fails the sink is marked as failed,
+// so that no more parts are written to it, and it's aborted once the writes already in flight to it have finished
+type liveSink struct {
+	// nil once aborted, or if it couldn't be opened
+	sink   fanOutSink
+	failed atomic.Bool
+
+	// held for reading while writing a part, and for writing while aborting
+	mu sync.RWMutex
+}
+
+// Writes the part, returning whether it was written to a sink that hasn't failed
+func (s *liveSink) writePart(ctx context.Context, partNumber int32, offset int64, data []byte) (bool, error) {
+	if s.failed.Load() {
+		return false, nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.sink == nil {
+		return false, nil
+	}
+	return true, s.sink.WritePart(ctx, partNumber, offset, data)
+}
+
+// Marks the sink as failed, and aborts it once the writes in flight have finished. Returns false if it had already failed
+func (s *liveSink) abort(ctx context.Context) bool {
+	if !s.failed.CompareAndSwap(false, true) {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sink == nil {
+		return false
+	}
+	s.sink.Abort(ctx)
+	s.sink = nil
+	return true
+}
+
+// Returns a function that reads the part at offset into buf, and a function to close the source
+func (d FanOut) openSource(ctx context.Context, j fanOutJob, client *s3.Client) (func(context.Context, []byte, int64) (int, error), func(), error) {
+	size := func(offset int64) int64 {
+		if j.Size-offset < d.Partsize {
+			return j.Size - offset
+		}
+		return d.Partsize
+	}
+
+	if len(j.Key) != 0 {
+		read := func(ctx context.Context, buf []byte, offset int64) (int, error) {
+			n := size(offset)
+			input := &s3.GetObjectInput{
+				Bucket: aws.String(d.Bucket),
+				Key:    aws.String(j.Key),
+				Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+n-1)),
+			}
+			d.Request.applyGet(input)
+			out, err := client.GetObject(ctx, input)
+			if err != nil {
+				return 0, err
+			}
+			defer out.Body.Close()
+			return io.ReadFull(out.Body, buf[:n])
+		}
+		return read, func() {}, nil
+	}
+
+	f, err := os.Open(j.Filepath)
+	if err != nil {
+		return nil, nil, err
+	}
+	read := func(ctx context.Context, buf []byte, offset int64) (int, error) {
+		n, err := f.ReadAt(buf[:size(offset)], offset)
+		if err == io.EOF && int64(n) == size(offset) {
+			err = nil
+		}
+		return n, err
+	}
+	return read, func() { f.Close() }, nil
+}
+
+// Where a destination's copy of an object is written to
+type fanOutSink interface {
+	WritePart(ctx context.Context, partNumber int32, offset int64, data []byte) error
+
+	// Finishes writing the object
+	Close(ctx context.Context) error
+
+	// Cleans up a partially written object
+	Abort(ctx context.Context)
+}
+
+func (d FanOut) openSink(dest FanOutDestination, j fanOutJob, client *s3.Client) (fanOutSink, error) {
+	if dest.isS3() {
+		if (j.Size+d.Partsize-1)/d.Partsize > maxUploadParts {
+			return nil, fmt.Errorf("object would be uploaded in more than %d parts, increase --partsize", maxUploadParts)
+		}
+		key := path.Join(dest.Prefix, j.Name)
+		if j.Dir {
+			if key = strings.TrimSuffix(key, "/") + "/"; key == "/" {
+				// marker of the bucket's root
+				return nopSink{}, nil
+			}
+		}
+		return &s3Sink{client: client, bucket: dest.Bucket, key: key, request: d.Request}, nil
+	}
+
+	rel, _, err := safeRelativePath(j.Name)
+	if err != nil {
+		// the path being copied is a directory marker
+		rel = ""
+	}
+	p := filepath.Join(dest.Path, rel)
+	if j.Dir || len(rel) == 0 {
+		if err := os.MkdirAll(p, os.ModePerm); err != nil {
+			return nil, err
+		}
+		return nopSink{}, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(p)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSink{f: f}, nil
+}
+
+type fileSink struct {
+	f *os.File
+}
+
+func (s *fileSink) WritePart(ctx context.Context, partNumber int32, offset int64, data []byte) error {
+	_, err := s.f.WriteAt(data, offset)
+	return err
+}
+
+func (s *fileSink) Close(ctx context.Context) error {
+	return s.f.Close()
+}
+
+func (s *fileSink) Abort(ctx context.Context) {
+	s.f.Close()
+	os.Remove(s.f.Name())
+}
+
+// Sink for directories, which have nothing written to them
+type nopSink struct{}
+
+func (nopSink) WritePart(ctx context.Context, partNumber int32, offset int64, data []byte) error {
+	return nil
+}
+func (nopSink) Close(ctx context.Context) error { return nil }
+func (nopSink) Abort(ctx context.Context)       {}
+
+// Uploads the object's parts as a multipart upload, which is created when the first part is written
+type s3Sink struct {
+	client  *s3.Client
+	bucket  string
+	key     string
+	request S3RequestOptions
+
+	mu       sync.Mutex
+	uploadId *string
+	parts    []s3types.CompletedPart
+}
+
+func (s *s3Sink) upload(ctx context.Context) (*string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.uploadId != nil {
+		return s.uploadId, nil
+	}
+
+	input := &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key),
+	}
+	s.request.applyCreateMultipartUpload(input)
+	out, err := s.client.CreateMultipartUpload(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	s.uploadId = out.UploadId
+	return s.uploadId, nil
+}
+
+func (s *s3Sink) WritePart(ctx context.Context, partNumber int32, offset int64, data []byte) error {
+	uploadId, err := s.upload(ctx)
+	if err != nil {
+		return err
+	}
+
+	input := &s3.UploadPartInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(s.key),
+		UploadId:      uploadId,
+		PartNumber:    aws.Int32(partNumber),
+		Body:          bytes.NewReader(data),
+		ContentLength: aws.Int64(int64(len(data))),
+	}
+	s.request.applyUploadPart(input)
+	out, err := s.client.UploadPart(ctx, input)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.parts = append(s.parts, s3types.CompletedPart{ETag: out.ETag, PartNumber: aws.Int32(partNumber)})
+	return nil
+}
+
+func (s *s3Sink) Close(ctx context.Context) error {
+	// Empty objects have no parts, so are put rather than uploaded
+	if s.uploadId == nil {
+		input := &s3.PutObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(s.key),
+			Body:   bytes.NewReader(nil),
+		}
+		s.request.applyPut(input)
+		_, err := s.client.PutObject(ctx, input)
+		return err
+	}
+
+	sort.Slice(s.parts, func(i, j int) bool { return *s.parts[i].PartNumber < *s.parts[j].PartNumber })
+	input := &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(s.key),
+		UploadId:        s.uploadId,
+		MultipartUpload: &s3types.CompletedMultipartUpload{Parts: s.parts},
+	}
+	s.request.applyCompleteMultipartUpload(input)
+	_, err := s.client.CompleteMultipartUpload(ctx, input)
+	return err
+}
+
+func (s *s3Sink) Abort(ctx context.Context) {
+	s.mu.Lock()
+	uploadId := s.uploadId
+	s.mu.Unlock()
+	if uploadId == nil {
+		return
+	}
+
+	input := &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(s.key),
+		UploadId: uploadId,
+	}
+	s.request.applyAbortMultipartUpload(input)
+	s.client.AbortMultipartUpload(ctx, input)
+}
+
+func (d FanOut) Stats() *Stats {
+	return d.stats
+}
@@ -0,0 +1,225 @@
+package downloaders
+
+import (
+	"bytes"
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/op/go-logging"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var fanOutFiles = map[string][]byte{
+	"a.bin":     bytes.Repeat([]byte("a"), 3*1024+5),
+	"sub/b.bin": []byte("b"),
+	"sub/c.bin": {},
+}
+
+// Writes the files under dir, creating any missing folders
+func writeTestFiles(t *testing.T, dir string, files map[string][]byte) {
+	for name, data := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFanOutFilesystem(t *testing.T) {
+	src := t.TempDir()
+	writeTestFiles(t, src, fanOutFiles)
+
+	dest := t.TempDir()
+	good := []string{filepath.Join(dest, "one"), filepath.Join(dest, "two")}
+
+	// a file in place of the sub folder, so that only sub/* fails to be written
+	bad := filepath.Join(dest, "bad")
+	writeTestFiles(t, bad, map[string][]byte{"sub": []byte("not a folder")})
+
+	d := FanOut{
+		Readpath: src,
+		Destinations: []FanOutDestination{
+			{Path: good[0]},
+			{Path: bad},
+			{Path: good[1]},
+		},
+		Workers:  2,
+		Threads:  3,
+		Partsize: 1024,
+		MaxList:  10,
+		Bar:      newTestBar(),
+		Log:      logging.MustGetLogger("s3pd-test"),
+		Summary:  NewRunSummary(),
+	}
+	err := d.Start(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "1 of 3 destinations") {
+		t.Errorf("Expected the bad destination to fail, got %v", err)
+	}
+
+	for _, root := range good {
+		for name, body := range fanOutFiles {
+			data, err := ioutil.ReadFile(filepath.Join(root, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, body) {
+				t.Errorf("%s in %s doesn't match the source", name, root)
+			}
+		}
+	}
+
+	summaries := d.Summaries()
+	if summaries[0].Objects != 3 || summaries[0].Bytes != 3*1024+6 || summaries[0].Failed != 0 {
+		t.Errorf("Unexpected summary for %s: %+v", good[0], summaries[0])
+	}
+	if summaries[1].Objects != 1 || summaries[1].Failed != 2 || len(summaries[1].Errors) != 2 {
+		t.Errorf("Unexpected summary for %s: %+v", bad, summaries[1])
+	}
+
+	// only the objects written to every destination count as transferred
+	if totals := d.Summary.Totals(); totals.Objects != 1 || totals.Failed != 2 {
+		t.Errorf("Expected 1 object transferred & 2 failed, got %+v", totals)
+	}
+
+	// Each part is read from the source once
+	if total := d.Bar.Current(); total != 3*1024+6 {
+		t.Errorf("Expected %d bytes to be read, got %d", 3*1024+6, total)
+	}
+}
+
+func TestFanOutS3(t *testing.T) {
+	clientConfig := testS3ClientConfig(t)
+	client, err := NewS3Client(context.Background(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	objects := map[string][]byte{
+		"fanout/a.bin":     bytes.Repeat([]byte("a"), 11*1024*1024),
+		"fanout/sub/b.bin": []byte("b"),
+		"fanout/sub/c.bin": {},
+	}
+	createTestObjects(t, client, "s3pd-test", objects)
+
+	dir := t.TempDir()
+	d := FanOut{
+		Bucket: "s3pd-test",
+		Prefix: "fanout/",
+		Destinations: []FanOutDestination{
+			{Path: dir},
+			{Bucket: "s3pd-test", Prefix: "mirror"},
+		},
+		Workers:           2,
+		Threads:           2,
+		Partsize:          5 * 1024 * 1024,
+		MaxList:           2,
+		SourceClient:      clientConfig,
+		DestinationClient: clientConfig,
+		Bar:               newTestBar(),
+		Log:               logging.MustGetLogger("s3pd-test"),
+	}
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, body := range objects {
+		name := strings.TrimPrefix(key, "fanout/")
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, body) {
+			t.Errorf("Copied %s doesn't match the source object", key)
+		}
+
+		out, err := client.GetObject(context.Background(), &s3.GetObjectInput{
+			Bucket: aws.String("s3pd-test"),
+			Key:    aws.String("mirror/" + name),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err = ioutil.ReadAll(out.Body)
+		out.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, body) {
+			t.Errorf("Mirrored %s doesn't match the source object", key)
+		}
+	}
+}
+
+// Sink whose writes block until released, recording whether it was aborted during a write
+type blockingSink struct {
+	release chan struct{}
+	writing sync.WaitGroup
+
+	mu              sync.Mutex
+	inFlight        int
+	abortedMidWrite bool
+	aborted         bool
+}
+
+func (s *blockingSink) WritePart(ctx context.Context, partNumber int32, offset int64, data []byte) error {
+	s.mu.Lock()
+	s.inFlight++
+	s.mu.Unlock()
+	s.writing.Done()
+
+	<-s.release
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inFlight--
+	return nil
+}
+
+func (s *blockingSink) Close(ctx context.Context) error { return nil }
+
+func (s *blockingSink) Abort(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.aborted = true
+	s.abortedMidWrite = s.inFlight != 0
+}
+
+func TestLiveSinkAbortWaitsForWrites(t *testing.T) {
+	blocking := &blockingSink{release: make(chan struct{})}
+	blocking.writing.Add(1)
+	sink := &liveSink{sink: blocking}
+
+	go sink.writePart(context.Background(), 1, 0, []byte("a"))
+	blocking.writing.Wait()
+
+	aborted := make(chan bool)
+	go func() { aborted <- sink.abort(context.Background()) }()
+	for !sink.failed.Load() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Parts written after the sink failed are skipped, rather than waiting for the abort
+	if written, err := sink.writePart(context.Background(), 2, 1, []byte("b")); written || err != nil {
+		t.Errorf("Expected writes to a failed sink to be skipped, got %v %v", written, err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	close(blocking.release)
+	if !<-aborted {
+		t.Error("Expected the first abort to abort the sink")
+	}
+	if !blocking.aborted || blocking.abortedMidWrite {
+		t.Errorf("Expected the sink to be aborted once its write finished, aborted %v mid-write %v", blocking.aborted, blocking.abortedMidWrite)
+	}
+	if sink.abort(context.Background()) {
+		t.Error("Expected the sink to only be aborted once")
+	}
+}
@@ -3,6 +3,7 @@ package downloaders
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/cheggaaa/pb/v3"
 	"github.com/op/go-logging"
 	"golang.org/x/sync/errgroup"
@@ -12,6 +13,8 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -23,9 +26,23 @@ type FilesystemDownload struct {
 	Partsize    int64
 	MaxList     int
 	IsBenchmark bool
-	Bar         *pb.ProgressBar
-	Log         *logging.Logger
-	StartTime   time.Time
+
+	// Output path template & rename rules applied to each file's path
+	Mapping PathMapping
+
+	// Destination roots files are spread across, when writing to more than one
+	Stripe StripeOptions
+
+	// Writes a JSON line per file copied, with where it was written & how it was copied, to this file when set
+	Manifest string
+	manifest *jsonlReport
+
+	// Counts the files copied & failed when set
+	Summary *RunSummary
+
+	Bar   *pb.ProgressBar
+	Log   *logging.Logger
+	stats *Stats
 }
 
 type FileCopyJob struct {
@@ -33,19 +50,37 @@ type FileCopyJob struct {
 	Filepath string
 	Name     string
 	Size     int64
+
+	// Path the file is written to relative to Writepath, after the output template & rename rules. The path under Readpath when empty
+	Path string
 }
 
 func (d *FilesystemDownload) Start(ctx context.Context) error {
-	d.StartTime = time.Now()
+	d.stats = newStats()
+	defer d.stats.finish()
 
 	// Instantiate download workers
 	// Set job's channel length to 3x max files we'll get in a list op
 	// if the job queue ends up filling up, we'll stall doing additional list ops until the queue has more messages completed
+	stripe, err := newStriper(d.Writepath, d.Stripe)
+	if err != nil {
+		return err
+	}
+	defer stripe.Close()
+
+	if d.manifest, err = newJSONLReport(d.Manifest); err != nil {
+		return err
+	}
+	defer d.manifest.Close()
+
 	jobs := make(chan FileCopyJob, d.MaxList*3)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	eg, ctx := errgroup.WithContext(ctx)
 	for w := 1; w <= int(d.Workers); w++ {
+		w := w
 		eg.Go(func() error {
-			return d.worker(int(w), jobs)
+			return d.worker(int(w), stripe, jobs)
 		})
 	}
 
@@ -53,10 +88,15 @@ func (d *FilesystemDownload) Start(ctx context.Context) error {
 	d.Bar.Start()
 
 	// Queue up download tasks
-	if err := d.list(jobs); err != nil {
-		// if error clean up workers and return the error
+	list := d.list
+	if d.Mapping.rewrites() {
+		list = d.listRewritten
+	}
+	if err := list(jobs); err != nil {
+		// if error stop the workers, and wait for them to exit before returning the error
+		cancel()
 		close(jobs)
-		ctx.Done()
+		eg.Wait()
 		return err
 	}
 
@@ -68,8 +108,11 @@ func (d *FilesystemDownload) Start(ctx context.Context) error {
 		return err
 	}
 
+	if err := d.manifest.Close(); err != nil {
+		return err
+	}
 	d.Bar.Finish()
-	return nil
+	return stripe.Close()
 }
 
 func (d FilesystemDownload) list(jobs chan<- FileCopyJob) error {
@@ -104,13 +147,81 @@ func (d FilesystemDownload) list(jobs chan<- FileCopyJob) error {
 	})
 }
 
+// Lists every file, then queues them with the path they're written to after the output template & rename rules.
+// Files that end up with the same path, or the path of another file's folder, are handled by the conflict policy.
+// Rewritten paths aren't in the order files are listed in, so nothing is queued until every file has been listed
+func (d FilesystemDownload) listRewritten(jobs chan<- FileCopyJob) error {
+	listed := make(chan FileCopyJob, d.MaxList)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- d.list(listed)
+		close(listed)
+	}()
+
+	files := map[string]FileCopyJob{}
+	var all []keyConflict
+	for j := range listed {
+		files[j.Filepath] = j
+		all = append(all, newKeyConflict(S3ObjectJob{Key: j.Filepath, Size: j.Size}, d.rewrite(j)))
+	}
+	if err := <-errs; err != nil {
+		return err
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].name < all[j].name })
+
+	var detector conflictDetector
+	var decided []keyConflict
+	for _, k := range all {
+		decided = append(decided, detector.add(k)...)
+	}
+	decided = append(decided, detector.flush()...)
+
+	// renamed & sidecar paths are made unique among every other file's path
+	paths := newClaimedPaths()
+	var keys, resolved []mappedKey
+	for _, k := range decided {
+		rel, decisions, err := d.Mapping.mapPath(k, "")
+		if err != nil {
+			return fmt.Errorf("%s: %w", k.job.Key, err)
+		}
+		m := mappedKey{job: k.job, path: rel, decisions: decisions}
+		if k.conflict && d.Mapping.resolvesConflicts() {
+			resolved = append(resolved, m)
+			continue
+		}
+		paths.claim(k.job.Key, rel, false)
+		keys = append(keys, m)
+	}
+
+	var conflicts []string
+	mapped := make([]FileCopyJob, 0, len(decided))
+	for _, m := range append(keys, claimUniquePaths(paths, resolved)...) {
+		if m.decisions[0] == decisionConflict {
+			conflicts = append(conflicts, m.job.Key)
+			continue
+		}
+		j := files[m.job.Key]
+		j.Path = filepath.ToSlash(m.path)
+		mapped = append(mapped, j)
+	}
+	if len(conflicts) != 0 {
+		return conflictsError(conflicts)
+	}
+
+	for _, j := range mapped {
+		jobs <- j
+	}
+	return nil
+}
+
 type PartCopyJob struct {
 	Source      *os.File
 	Destination *os.File
 	Offset      int64
+	crc         *writtenCRC
 }
 
-func (d FilesystemDownload) worker(id int, jobs <-chan FileCopyJob) error {
+func (d FilesystemDownload) worker(id int, stripe *striper, jobs <-chan FileCopyJob) error {
 	// startup concurrent writers
 	// jobs := make(chan FileCopyJob, d.Threads)
 	// for t := 1; w < int(d.Threads); t++ {
@@ -119,8 +230,13 @@ func (d FilesystemDownload) worker(id int, jobs <-chan FileCopyJob) error {
 
 	for j := range jobs {
 		relativePath := j.Filepath[len(j.Readpath):]
-		absoluteWritepath := path.Join(d.Writepath, relativePath)
+		if len(j.Path) != 0 {
+			relativePath = j.Path
+		}
+		root := stripe.assign(j.Filepath[len(j.Readpath):], j.Size)
+		absoluteWritepath := path.Join(root, relativePath)
 		absoluteReadpath := j.Filepath
+		e := manifestEntry{Key: absoluteReadpath, Size: j.Size, Start: time.Now()}
 		d.Log.Debugf("Job in worker %d reading file %s and writing it to %s of size %dBytes",
 			id, absoluteReadpath, absoluteWritepath, j.Size)
 
@@ -135,18 +251,23 @@ func (d FilesystemDownload) worker(id int, jobs <-chan FileCopyJob) error {
 		}
 
 		var destination *os.File = nil
+		var crc *writtenCRC
 		if !d.IsBenchmark {
 			var err error
 			destination, err = os.OpenFile(absoluteWritepath, os.O_CREATE|os.O_WRONLY, 0644)
 			if err != nil {
 				return err
 			}
+			if d.manifest.enabled() {
+				crc = newWrittenCRC()
+			}
 		}
 
 		// Startup the copy threadpool
 		eg, _ := errgroup.WithContext(context.Background())
 		partsToCopy := make(chan PartCopyJob, d.Threads*2)
 		for t := 1; t <= int(d.Threads); t++ {
+			t := t
 			eg.Go(func() error {
 				return d.partCopyWorker(int(t), partsToCopy)
 			})
@@ -159,6 +280,7 @@ func (d FilesystemDownload) worker(id int, jobs <-chan FileCopyJob) error {
 				Source:      source,
 				Destination: destination,
 				Offset:      offset,
+				crc:         crc,
 			}
 			offset += d.Partsize
 		}
@@ -167,12 +289,32 @@ func (d FilesystemDownload) worker(id int, jobs <-chan FileCopyJob) error {
 		// Block & wait till all parts are copied
 		// If err occurs pass it back
 		if err := eg.Wait(); err != nil {
+			d.Summary.objectFailed()
+			return err
+		}
+		d.Summary.objectDone(j.Size, time.Since(e.Start))
+
+		written := writtenObject{Dest: absoluteWritepath, CRC: crc, Size: j.Size}
+		if err := recordTransfer(d.manifest, e, written, nil); err != nil {
+			return err
+		}
+		if err := stripe.record(j.Filepath, root, absoluteWritepath); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// Returns the file's name relative to Writepath after applying the output template & rename rules
+func (d FilesystemDownload) rewrite(j FileCopyJob) string {
+	key := strings.TrimPrefix(filepath.ToSlash(j.Filepath[len(j.Readpath):]), "/")
+	if len(key) == 0 {
+		// Readpath is the file being copied
+		key = j.Name
+	}
+	return d.Mapping.rewrite(pathVars{Key: key, Path: key, Rel: key})
+}
+
 // Copies the parts sent to the partsToCopy channel
 func (d FilesystemDownload) partCopyWorker(id int, partsToCopy <-chan PartCopyJob) error {
 	buffer := make([]byte, d.Partsize, d.Partsize)
@@ -187,12 +329,15 @@ func (d FilesystemDownload) partCopyWorker(id int, partsToCopy <-chan PartCopyJo
 
 		if d.IsBenchmark {
 			ioutil.Discard.Write(buffer[:bytesRead])
+			d.stats.addWritten(int64(bytesRead))
 		} else {
 			bytesWritten, err := p.Destination.WriteAt(buffer[:bytesRead], p.Offset)
 			if err != nil {
 				return err
 			}
 
+			d.stats.addWritten(int64(bytesWritten))
+			p.crc.add(buffer[:bytesWritten], p.Offset)
 			if bytesRead != bytesWritten {
 				return errors.New("Different number of bytes read & write")
 			}
@@ -203,6 +348,6 @@ func (d FilesystemDownload) partCopyWorker(id int, partsToCopy <-chan PartCopyJo
 	return nil
 }
 
-func (d FilesystemDownload) Throughput() float64 {
-	return float64(d.Bar.Total()) * 8 / 1024 / 1024 / 1024 / time.Since(d.StartTime).Seconds()
+func (d FilesystemDownload) Stats() *Stats {
+	return d.stats
 }
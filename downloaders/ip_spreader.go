@@ -0,0 +1,252 @@
+package downloaders
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// S3's DNS returns a handful of IPs per lookup, rotating them between lookups.
+// Go's dialer will use the first IP returned, meaning most connections end up pinned
+// to the same S3 front end. IPSpreader keeps a pool of the distinct IPs seen for a host,
+// re-resolving it regularly, and spreads new connections across the pool.
+type IPSpreader struct {
+	// How often a host is re-resolved to discover new IPs
+	RefreshInterval time.Duration
+
+	// Max number of distinct IPs kept in a host's pool
+	MaxIPs int
+
+	// Resolves a hostname, defaults to net.DefaultResolver
+	lookup func(ctx context.Context, host string) ([]net.IP, error)
+
+	mu    sync.Mutex
+	hosts map[string]*hostPool
+	stats map[string]*IPStats
+}
+
+// Pool of the distinct IPs a host has resolved to
+type hostPool struct {
+	// IPs ordered from least to most recently seen
+	ips         []net.IP
+	lastRefresh time.Time
+	refreshing  bool
+}
+
+// Per remote IP connection statistics
+type IPStats struct {
+	IP            string
+	Connections   int64
+	Active        int64
+	DialErrors    int64
+	BytesReceived int64
+	BytesSent     int64
+}
+
+func NewIPSpreader(refreshInterval time.Duration, maxIPs int) *IPSpreader {
+	return &IPSpreader{
+		RefreshInterval: refreshInterval,
+		MaxIPs:          maxIPs,
+		lookup: func(ctx context.Context, host string) ([]net.IP, error) {
+			addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			ips := make([]net.IP, len(addrs))
+			for i, addr := range addrs {
+				ips[i] = addr.IP
+			}
+			return ips, nil
+		},
+		hosts: make(map[string]*hostPool),
+		stats: make(map[string]*IPStats),
+	}
+}
+
+// Returns a DialContext function which spreads connections across the IPs of the host being dialed.
+// Each returned dialer keeps its own round robin position, so when used per NIC
+// every NIC spreads its connections across all of the host's IPs.
+func (s *IPSpreader) DialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	var counter uint32
+	onlyV4 := false
+	if tcpAddr, ok := dialer.LocalAddr.(*net.TCPAddr); ok && tcpAddr.IP.To4() != nil {
+		onlyV4 = true
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		// Nothing to spread if we've been given an IP
+		if net.ParseIP(host) != nil {
+			return dialer.DialContext(ctx, network, addr)
+		}
+
+		ips, err := s.ips(ctx, host, onlyV4)
+		if err != nil {
+			return nil, err
+		}
+
+		// Try each IP in the pool once, starting at our round robin position
+		start := atomic.AddUint32(&counter, 1)
+		var dialErr error
+		for i := 0; i < len(ips); i++ {
+			ip := ips[(int(start)+i)%len(ips)].String()
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			if err != nil {
+				s.ipStats(ip).recordDialError()
+				dialErr = err
+				if ctx.Err() != nil {
+					break
+				}
+				continue
+			}
+			return newCountingConn(conn, s.ipStats(ip)), nil
+		}
+		return nil, dialErr
+	}
+}
+
+// Returns the pool of IPs for the host, resolving it if it has never been seen
+// and triggering a background re-resolve if the pool is stale
+func (s *IPSpreader) ips(ctx context.Context, host string, onlyV4 bool) ([]net.IP, error) {
+	s.mu.Lock()
+	pool, ok := s.hosts[host]
+	if !ok {
+		s.mu.Unlock()
+		if err := s.refresh(ctx, host); err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		pool = s.hosts[host]
+	} else if time.Since(pool.lastRefresh) > s.RefreshInterval && !pool.refreshing {
+		pool.refreshing = true
+		go s.refresh(context.Background(), host)
+	}
+
+	ips := make([]net.IP, 0, len(pool.ips))
+	for _, ip := range pool.ips {
+		if !onlyV4 || ip.To4() != nil {
+			ips = append(ips, ip)
+		}
+	}
+	s.mu.Unlock()
+
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no usable IPs found for %s", host)
+	}
+	return ips, nil
+}
+
+// Resolves the host and merges the IPs found into its pool
+func (s *IPSpreader) refresh(ctx context.Context, host string) error {
+	resolved, err := s.lookup(ctx, host)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pool, ok := s.hosts[host]
+	if !ok {
+		if err != nil {
+			return err
+		}
+		pool = &hostPool{}
+		s.hosts[host] = pool
+	}
+	pool.refreshing = false
+	pool.lastRefresh = time.Now()
+
+	// Keep the old pool on lookup failures, a later dial will retry the lookup
+	if err != nil {
+		return err
+	}
+
+	for _, ip := range resolved {
+		// Move IPs seen again to the back, so the least recently seen IPs get evicted first
+		for i, known := range pool.ips {
+			if known.Equal(ip) {
+				pool.ips = append(pool.ips[:i], pool.ips[i+1:]...)
+				break
+			}
+		}
+		pool.ips = append(pool.ips, ip)
+	}
+	if s.MaxIPs > 0 && len(pool.ips) > s.MaxIPs {
+		pool.ips = pool.ips[len(pool.ips)-s.MaxIPs:]
+	}
+	return nil
+}
+
+func (s *IPSpreader) ipStats(ip string) *IPStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.stats[ip]
+	if !ok {
+		st = &IPStats{IP: ip}
+		s.stats[ip] = st
+	}
+	return st
+}
+
+// Returns a snapshot of the connection statistics of each remote IP connected to
+func (s *IPSpreader) Stats() []IPStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]IPStats, 0, len(s.stats))
+	for _, st := range s.stats {
+		out = append(out, IPStats{
+			IP:            st.IP,
+			Connections:   atomic.LoadInt64(&st.Connections),
+			Active:        atomic.LoadInt64(&st.Active),
+			DialErrors:    atomic.LoadInt64(&st.DialErrors),
+			BytesReceived: atomic.LoadInt64(&st.BytesReceived),
+			BytesSent:     atomic.LoadInt64(&st.BytesSent),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].IP < out[j].IP })
+	return out
+}
+
+func (st *IPStats) recordDialError() {
+	atomic.AddInt64(&st.DialErrors, 1)
+}
+
+// net.Conn which records the bytes sent & received to its remote IP
+type countingConn struct {
+	net.Conn
+	stats  *IPStats
+	closed int32
+}
+
+func newCountingConn(conn net.Conn, stats *IPStats) *countingConn {
+	atomic.AddInt64(&stats.Connections, 1)
+	atomic.AddInt64(&stats.Active, 1)
+	return &countingConn{Conn: conn, stats: stats}
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.stats.BytesReceived, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.stats.BytesSent, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		atomic.AddInt64(&c.stats.Active, -1)
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,114 @@
+package downloaders
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// Returns a spreader whose lookups cycle through the given responses
+func newTestSpreader(maxIPs int, responses ...[]string) (*IPSpreader, *int) {
+	s := NewIPSpreader(time.Hour, maxIPs)
+	lookups := 0
+	s.lookup = func(ctx context.Context, host string) ([]net.IP, error) {
+		resp := responses[lookups%len(responses)]
+		lookups++
+		ips := make([]net.IP, len(resp))
+		for i, ip := range resp {
+			ips[i] = net.ParseIP(ip)
+		}
+		return ips, nil
+	}
+	return s, &lookups
+}
+
+func TestIPSpreaderPool(t *testing.T) {
+	s, lookups := newTestSpreader(3,
+		[]string{"10.0.0.1", "10.0.0.2"},
+		[]string{"10.0.0.2", "10.0.0.3", "10.0.0.4"})
+
+	ips, err := s.ips(context.Background(), "mybucket.s3.amazonaws.com", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 2 || *lookups != 1 {
+		t.Fatalf("Expected 2 IPs after 1 lookup, got %v after %d lookups", ips, *lookups)
+	}
+
+	// Cached pool should be used until it goes stale
+	s.ips(context.Background(), "mybucket.s3.amazonaws.com", false)
+	if *lookups != 1 {
+		t.Errorf("Expected pool to be cached, got %d lookups", *lookups)
+	}
+
+	// Re-resolving merges in new IPs, evicting the least recently seen past MaxIPs
+	if err := s.refresh(context.Background(), "mybucket.s3.amazonaws.com"); err != nil {
+		t.Fatal(err)
+	}
+	ips, _ = s.ips(context.Background(), "mybucket.s3.amazonaws.com", false)
+	expected := []string{"10.0.0.2", "10.0.0.3", "10.0.0.4"}
+	if len(ips) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, ips)
+	}
+	for i := range expected {
+		if ips[i].String() != expected[i] {
+			t.Errorf("Expected %v, got %v", expected, ips)
+		}
+	}
+}
+
+func TestIPSpreaderOnlyV4(t *testing.T) {
+	s, _ := newTestSpreader(16, []string{"10.0.0.1", "2600:1fa0::1"})
+	ips, err := s.ips(context.Background(), "mybucket.s3.amazonaws.com", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || ips[0].String() != "10.0.0.1" {
+		t.Errorf("Expected only the IPv4 address, got %v", ips)
+	}
+}
+
+func TestIPSpreaderDial(t *testing.T) {
+	// Every address in 127.0.0.0/8 is routed to the loopback interface on linux
+	listener, err := net.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("hello"))
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	s, _ := newTestSpreader(16, []string{"127.0.0.1", "127.0.0.2"})
+	dial := s.DialContext(&net.Dialer{})
+	for i := 0; i < 4; i++ {
+		conn, err := dial(context.Background(), "tcp", net.JoinHostPort("s3.test", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 5)
+		if _, err := conn.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+
+	stats := s.Stats()
+	if len(stats) != 2 {
+		t.Fatalf("Expected connections to be spread across 2 IPs, got %v", stats)
+	}
+	for _, st := range stats {
+		if st.Connections != 2 || st.Active != 0 || st.BytesReceived != 10 {
+			t.Errorf("Unexpected stats for %s: %+v", st.IP, st)
+		}
+	}
+}
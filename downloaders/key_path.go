@@ -0,0 +1,163 @@
+package downloaders
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode/utf8"
+)
+
+// Longest file or folder name most filesystems allow, in bytes
+const maxNameLength = 255
+
+// Decisions made when mapping a key to a safe path, written to the mapping report
+const (
+	decisionEscaped   = "escaped"
+	decisionHashed    = "hashed"
+	decisionDirectory = "directory"
+)
+
+// Whether the key is a directory marker, a zero byte object created by the S3 console to represent a folder
+func isDirectoryMarker(key string) bool {
+	return strings.HasSuffix(key, "/")
+}
+
+// Name empty folders, from leading or repeated slashes, are written as
+const emptyName = "%"
+
+// Converts a key, relative to the download path, into a relative path that's safe to write to:
+//   - a trailing slash, of a directory marker, is dropped
+//   - empty names from leading or repeated slashes are written as "%"
+//   - "." & ".." are percent-encoded, so that keys can't write outside of the download path
+//   - bytes filesystems don't allow in names are percent-encoded, along with any "%" in the same name
+//   - names longer than 255 bytes are shortened & suffixed with a hash of the full name
+//
+// Names that don't need escaping are used as is, even when they look escaped, so distinct keys can map to the same path.
+// Those are found as conflicts. Returns the decisions made, none when the key is used as is
+func safeRelativePath(key string) (string, []string, error) {
+	key = strings.TrimSuffix(key, "/")
+	if len(key) == 0 {
+		return "", nil, errors.New("key has no file name")
+	}
+
+	var names []string
+	var escaped, hashed bool
+	for _, name := range strings.Split(key, "/") {
+		if len(name) == 0 {
+			names = append(names, emptyName)
+			escaped = true
+			continue
+		}
+
+		safe := escapeName(name)
+		if safe != name {
+			escaped = true
+		}
+		if len(safe) > maxNameLength {
+			safe = hashName(safe)
+			hashed = true
+		}
+		names = append(names, safe)
+	}
+
+	var decisions []string
+	if escaped {
+		decisions = append(decisions, decisionEscaped)
+	}
+	if hashed {
+		decisions = append(decisions, decisionHashed)
+	}
+	return filepath.Join(names...), decisions, nil
+}
+
+// Percent-encodes the parts of the name that can't be used as is. Names that can be are returned unchanged,
+// otherwise "%" is encoded too so that the escaped name can be decoded
+func escapeName(name string) string {
+	// Would refer to the current or parent folder
+	if name == "." || name == ".." {
+		return strings.Repeat("%2E", len(name))
+	}
+	if !needsEscaping(name) {
+		return name
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(name); {
+		r, size := utf8.DecodeRuneInString(name[i:])
+		if r == utf8.RuneError && size <= 1 {
+			// invalid UTF-8 isn't allowed by some filesystems, e.g. APFS
+			fmt.Fprintf(&b, "%%%02X", name[i])
+			i++
+			continue
+		}
+		if size == 1 && (name[i] == '%' || isIllegalByte(name[i])) {
+			fmt.Fprintf(&b, "%%%02X", name[i])
+		} else {
+			b.WriteString(name[i : i+size])
+		}
+		i += size
+	}
+	return b.String()
+}
+
+// Whether the name has invalid UTF-8, or bytes that can't be used in a file name
+func needsEscaping(name string) bool {
+	if !utf8.ValidString(name) {
+		return true
+	}
+	for i := 0; i < len(name); i++ {
+		if isIllegalByte(name[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the byte can't, or shouldn't, be used in a file name
+func isIllegalByte(c byte) bool {
+	// NUL terminates names, and control characters break terminals & scripts
+	if c < 0x20 || c == 0x7f {
+		return true
+	}
+	if runtime.GOOS == "windows" {
+		return strings.IndexByte(`<>:"\|?*`, c) != -1
+	}
+	return false
+}
+
+// Returns an archive member's name relative to the folder it's extracted to. Names are often relative to the folder
+// the archive was made in, E.g. ./data/file.txt, and some archivers keep the leading slash of absolute paths
+func archiveMemberName(name string) string {
+	for {
+		switch {
+		case strings.HasPrefix(name, "./"):
+			name = name[len("./"):]
+		case strings.HasPrefix(name, "/"):
+			name = name[len("/"):]
+		default:
+			return name
+		}
+	}
+}
+
+// Shortens the name to 255 bytes, keeping its start & extension, with a hash of the full name in between
+func hashName(name string) string {
+	digest := sha256.Sum256([]byte(name))
+	hash := "~" + hex.EncodeToString(digest[:8])
+
+	ext := filepath.Ext(name)
+	if len(ext) > 16 {
+		ext = ""
+	}
+
+	// cut at the start of a rune, so that the shortened name is still valid UTF-8
+	keep := maxNameLength - len(hash) - len(ext)
+	for keep > 0 && !utf8.RuneStart(name[keep]) {
+		keep--
+	}
+	return name[:keep] + hash + ext
+}
@@ -0,0 +1,152 @@
+package downloaders
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSafeRelativePath(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	tests := []struct {
+		key       string
+		path      string
+		decisions []string
+	}{
+		{key: "file.txt", path: "file.txt"},
+		{key: "/sub/file.txt", path: "%/sub/file.txt", decisions: []string{decisionEscaped}},
+		{key: "sub//file.txt", path: "sub/%/file.txt", decisions: []string{decisionEscaped}},
+		{key: "sub//", path: "sub/%", decisions: []string{decisionEscaped}},
+		{key: "sub/", path: "sub"},
+		{key: "../file.txt", path: "%2E%2E/file.txt", decisions: []string{decisionEscaped}},
+		{key: "sub/../../file.txt", path: "sub/%2E%2E/%2E%2E/file.txt", decisions: []string{decisionEscaped}},
+		{key: "./file.txt", path: "%2E/file.txt", decisions: []string{decisionEscaped}},
+		{key: "..file.txt", path: "..file.txt"},
+		{key: "nul\x00byte", path: "nul%00byte", decisions: []string{decisionEscaped}},
+		{key: "new\nline\x7f", path: "new%0Aline%7F", decisions: []string{decisionEscaped}},
+		{key: "bad\xffutf8", path: "bad%FFutf8", decisions: []string{decisionEscaped}},
+		{key: "naïve/日本.txt", path: "naïve/日本.txt"},
+		{key: "100%.txt", path: "100%.txt"},
+		{key: "100%\x00.txt", path: "100%25%00.txt", decisions: []string{decisionEscaped}},
+		{key: "sub/" + long + ".txt", path: "sub/" + hashName(long+".txt"), decisions: []string{decisionHashed}},
+		{key: long + "\x00", path: hashName(long + "%00"), decisions: []string{decisionEscaped, decisionHashed}},
+	}
+
+	for _, test := range tests {
+		path, decisions, err := safeRelativePath(test.key)
+		if err != nil {
+			t.Errorf("%q: %v", test.key, err)
+			continue
+		}
+		if path != filepath.FromSlash(test.path) {
+			t.Errorf("%q: expected path %q, got %q", test.key, test.path, path)
+		}
+		if !reflect.DeepEqual(decisions, test.decisions) {
+			t.Errorf("%q: expected decisions %v, got %v", test.key, test.decisions, decisions)
+		}
+	}
+}
+
+func TestSafeRelativePathNoName(t *testing.T) {
+	for _, key := range []string{"", "/"} {
+		if _, _, err := safeRelativePath(key); err == nil {
+			t.Errorf("%q: expected keys without a name to be rejected", key)
+		}
+	}
+}
+
+func TestSafeRelativePathDistinct(t *testing.T) {
+	// Keys which would write to the same path if empty names were dropped
+	pairs := [][2]string{
+		{"a//b", "a/b"},
+		{"/a", "a"},
+		{"a//", "a/"},
+		{"100%\x00", "100%\x01"},
+	}
+	for _, pair := range pairs {
+		first, _, err := safeRelativePath(pair[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, _, err := safeRelativePath(pair[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first == second {
+			t.Errorf("Expected %q & %q to map to different paths, both map to %q", pair[0], pair[1], first)
+		}
+	}
+}
+
+func TestSafeRelativePathLiteralPercent(t *testing.T) {
+	// Names that look escaped are used as is, so these map to the same path & are found as conflicts
+	pairs := [][2]string{
+		{"..", "%2E%2E"},
+		{"a/./b", "a/%2E/b"},
+		{"nul\x00", "nul%00"},
+		{"a//b", "a/%/b"},
+	}
+	for _, pair := range pairs {
+		first, _, err := safeRelativePath(pair[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, decisions, err := safeRelativePath(pair[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first != second || len(decisions) != 0 {
+			t.Errorf("Expected %q to be used as is, and map to the same path as %q, got %q & %q", pair[1], pair[0], second, first)
+		}
+	}
+}
+
+func TestArchiveMemberName(t *testing.T) {
+	tests := map[string]string{
+		"data/file.txt":   "data/file.txt",
+		"./data/file.txt": "data/file.txt",
+		"/data/file.txt":  "data/file.txt",
+		".//./data/":      "data/",
+		"data/./file.txt": "data/./file.txt",
+		"..":              "..",
+	}
+	for name, expected := range tests {
+		if actual := archiveMemberName(name); actual != expected {
+			t.Errorf("archiveMemberName(%q) = %q, expected %q", name, actual, expected)
+		}
+	}
+}
+
+func TestHashName(t *testing.T) {
+	long := strings.Repeat("a", 300) + ".tar.gz"
+	hashed := hashName(long)
+	if len(hashed) != maxNameLength {
+		t.Errorf("Expected a %d byte name, got %d bytes", maxNameLength, len(hashed))
+	}
+	if !strings.HasSuffix(hashed, ".gz") || !strings.HasPrefix(hashed, "aaaa") {
+		t.Errorf("Expected the name's start & extension to be kept, got %q", hashed)
+	}
+	if hashName(strings.Repeat("a", 300)+"b.tar.gz") == hashed {
+		t.Error("Expected names differing after the cut to hash differently")
+	}
+
+	// Multi-byte runes aren't cut in half
+	runes := hashName(strings.Repeat("日", 100))
+	if !utf8.ValidString(runes) || len(runes) > maxNameLength {
+		t.Errorf("Expected a valid UTF-8 name of at most %d bytes, got %q", maxNameLength, runes)
+	}
+
+	// Long extensions aren't kept
+	longExt := hashName("name." + strings.Repeat("x", 300))
+	if len(longExt) != maxNameLength {
+		t.Errorf("Expected a %d byte name, got %d bytes", maxNameLength, len(longExt))
+	}
+}
+
+func TestIsDirectoryMarker(t *testing.T) {
+	if !isDirectoryMarker("a/b/") || isDirectoryMarker("a/b") {
+		t.Error("Expected only keys ending in a slash to be directory markers")
+	}
+}
@@ -0,0 +1,272 @@
+package downloaders
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"github.com/aws/smithy-go/middleware"
+	"hash/crc32"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Line of the transfer manifest, written as each object finishes being transferred
+type manifestEntry struct {
+	Key            string    `json:"key"`
+	VersionId      string    `json:"version_id,omitempty"`
+	ETag           string    `json:"etag,omitempty"`
+	Size           int64     `json:"size"`
+	Dest           string    `json:"dest"`
+	Start          time.Time `json:"start"`
+	End            time.Time `json:"end"`
+	BytesPerSecond float64   `json:"bytes_per_second"`
+	Retries        int64     `json:"retries"`
+	NICs           []string  `json:"nics,omitempty"`
+
+	// Base64 encoded CRC32C of the bytes written, in the same format as S3's x-amz-checksum-crc32c
+	CRC32C string `json:"crc32c,omitempty"`
+}
+
+// Where an object's bytes were written, and their checksum for the manifest
+type writtenObject struct {
+	// destination reported in the manifest
+	Dest string
+
+	// checksum of the bytes as they were written, nil when the object wasn't written to a file,
+	// E.g. when streaming or extracting archives. Size bytes were written, or however many were when Size is -1
+	CRC  *writtenCRC
+	Size int64
+}
+
+// Requests made while transferring an object, counted by the S3 client's middleware & HTTP client from the request's context
+type transferStats struct {
+	operations int64
+	attempts   int64
+
+	mu   sync.Mutex
+	nics []string
+}
+
+type transferStatsKey struct{}
+
+// Returns a context which counts the requests made with it towards the returned stats
+func withTransferStats(ctx context.Context) (context.Context, *transferStats) {
+	t := &transferStats{}
+	return context.WithValue(ctx, transferStatsKey{}, t), t
+}
+
+func transferStatsFrom(ctx context.Context) *transferStats {
+	t, _ := ctx.Value(transferStatsKey{}).(*transferStats)
+	return t
+}
+
+// Attempts made beyond the first of each operation
+func (t *transferStats) retries() int64 {
+	return atomic.LoadInt64(&t.attempts) - atomic.LoadInt64(&t.operations)
+}
+
+func (t *transferStats) useNIC(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, n := range t.nics {
+		if n == name {
+			return
+		}
+	}
+	t.nics = append(t.nics, name)
+}
+
+func (t *transferStats) usedNICs() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.nics...)
+}
+
+// Adds middleware counting each operation, and each attempt the retryer makes at it, towards the stats in the request's context
+func addTransferStatsMiddleware(stack *middleware.Stack) error {
+	countOperations := middleware.InitializeMiddlewareFunc("S3pdCountOperations", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+		if t := transferStatsFrom(ctx); t != nil {
+			atomic.AddInt64(&t.operations, 1)
+		}
+		return next.HandleInitialize(ctx, in)
+	})
+	if err := stack.Initialize.Add(countOperations, middleware.Before); err != nil {
+		return err
+	}
+
+	// middleware after the retryer runs once per attempt
+	countAttempts := middleware.FinalizeMiddlewareFunc("S3pdCountAttempts", func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+		if t := transferStatsFrom(ctx); t != nil {
+			atomic.AddInt64(&t.attempts, 1)
+		}
+		return next.HandleFinalize(ctx, in)
+	})
+	return stack.Finalize.Insert(countAttempts, "Retry", middleware.After)
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Checksums an object's bytes as they're written, which can be in parts written out of order by concurrent requests.
+// Each part's CRC32C is computed as it's written, and the parts' CRCs are combined once the object's been written,
+// so the manifest doesn't read the bytes back. Safe for concurrent use, and methods are safe to call on a nil writtenCRC
+type writtenCRC struct {
+	mu sync.Mutex
+	// CRC of each write, by its offset from the start of the object
+	parts map[int64]crcPart
+	// offset of the next sequential write
+	next int64
+}
+
+type crcPart struct {
+	size int64
+	crc  uint32
+}
+
+func newWrittenCRC() *writtenCRC {
+	return &writtenCRC{parts: map[int64]crcPart{}}
+}
+
+// Adds the bytes written at offset. A part written again at the same offset replaces it
+func (c *writtenCRC) add(p []byte, offset int64) {
+	if c == nil || len(p) == 0 {
+		return
+	}
+	part := crcPart{size: int64(len(p)), crc: crc32.Checksum(p, crc32cTable)}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.parts[offset] = part
+}
+
+// Adds bytes written after the last sequential write
+func (c *writtenCRC) append(p []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	offset := c.next
+	c.next += int64(len(p))
+	c.mu.Unlock()
+	c.add(p, offset)
+}
+
+// Returns the base64 encoded CRC32C of the object, in the same format as S3's x-amz-checksum-crc32c, and false when
+// the parts written don't cover the object from its start to size, or to the end of the last part when size is -1
+func (c *writtenCRC) sum(size int64) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	offsets := make([]int64, 0, len(c.parts))
+	for offset := range c.parts {
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	var crc uint32
+	var end int64
+	for _, offset := range offsets {
+		if offset != end {
+			return "", false
+		}
+		part := c.parts[offset]
+		crc = crc32cCombine(crc, part.crc, part.size)
+		end += part.size
+	}
+	if size >= 0 && end != size {
+		return "", false
+	}
+	return base64.StdEncoding.EncodeToString(binary.BigEndian.AppendUint32(nil, crc)), true
+}
+
+// Powers of x^(2^n) modulo the reflected Castagnoli polynomial, for combining CRCs
+var crc32cX2N = func() (table [32]uint32) {
+	p := uint32(1) << 30 // x^1
+	table[0] = p
+	for n := 1; n < 32; n++ {
+		p = crc32cMultModP(p, p)
+		table[n] = p
+	}
+	return table
+}()
+
+// Multiplies a & b modulo the reflected Castagnoli polynomial
+func crc32cMultModP(a, b uint32) uint32 {
+	m := uint32(1) << 31
+	var p uint32
+	for {
+		if a&m != 0 {
+			p ^= b
+			if a&(m-1) == 0 {
+				return p
+			}
+		}
+		m >>= 1
+		if b&1 != 0 {
+			b = b>>1 ^ 0x82f63b78
+		} else {
+			b >>= 1
+		}
+	}
+}
+
+// Returns the CRC32C of bytes a followed by bytes b, given their CRCs & the length of b, as zlib's crc32_combine does
+func crc32cCombine(crcA, crcB uint32, lenB int64) uint32 {
+	// x^(8*lenB), shifting crcA past b's bits
+	p := uint32(1) << 31 // x^0
+	for n, k := lenB, 3; n != 0; n, k = n>>1, k+1 {
+		if n&1 != 0 {
+			p = crc32cMultModP(crc32cX2N[k&31], p)
+		}
+	}
+	return crc32cMultModP(p, crcA) ^ crcB
+}
+
+// Writes to w, checksumming the bytes written at offsets from base
+type crcWriterAt struct {
+	w    io.WriterAt
+	crc  *writtenCRC
+	base int64
+}
+
+func (c crcWriterAt) WriteAt(p []byte, offset int64) (int, error) {
+	n, err := c.w.WriteAt(p, offset)
+	c.crc.add(p[:n], offset-c.base)
+	return n, err
+}
+
+// Writes to w, checksumming the bytes written in order
+type crcWriter struct {
+	w   io.Writer
+	crc *writtenCRC
+}
+
+func (c crcWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.crc.append(p[:n])
+	return n, err
+}
+
+// Writes the entry for an object that's finished being transferred
+func recordTransfer(manifest *jsonlReport, e manifestEntry, w writtenObject, t *transferStats) error {
+	if !manifest.enabled() {
+		return nil
+	}
+
+	e.End = time.Now()
+	e.Dest = w.Dest
+	if elapsed := e.End.Sub(e.Start).Seconds(); elapsed > 0 {
+		e.BytesPerSecond = float64(e.Size) / elapsed
+	}
+	if t != nil {
+		e.Retries = t.retries()
+		e.NICs = t.usedNICs()
+	}
+	// the checksum's left out rather than being wrong if the parts written didn't cover the object
+	e.CRC32C, _ = w.CRC.sum(w.Size)
+	return manifest.Write(e)
+}
@@ -0,0 +1,178 @@
+package downloaders
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/op/go-logging"
+	"hash/crc32"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWrittenCRC(t *testing.T) {
+	// CRC32C check value of "123456789" is 0xe3069283, written in parts out of order
+	c := newWrittenCRC()
+	c.add([]byte("789"), 6)
+	c.add([]byte("12"), 0)
+	c.add([]byte("3456"), 2)
+	for _, size := range []int64{9, -1} {
+		if sum, ok := c.sum(size); !ok || sum != "4waSgw==" {
+			t.Errorf("Expected the CRC32C of the parts with size %d to be 4waSgw==, got %s %v", size, sum, ok)
+		}
+	}
+	if _, ok := c.sum(10); ok {
+		t.Error("Expected parts that don't reach the size to have no checksum")
+	}
+
+	gap := newWrittenCRC()
+	gap.add([]byte("12"), 0)
+	gap.add([]byte("789"), 6)
+	if _, ok := gap.sum(-1); ok {
+		t.Error("Expected parts with a gap between them to have no checksum")
+	}
+
+	sequential := newWrittenCRC()
+	w := crcWriter{w: ioutil.Discard, crc: sequential}
+	w.Write([]byte("1234"))
+	w.Write([]byte("56789"))
+	if sum, ok := sequential.sum(-1); !ok || sum != "4waSgw==" {
+		t.Errorf("Expected the CRC32C of sequential writes to be 4waSgw==, got %s %v", sum, ok)
+	}
+
+	if sum, ok := newWrittenCRC().sum(0); !ok || sum != "AAAAAA==" {
+		t.Errorf("Expected the CRC32C of an empty object to be AAAAAA==, got %s %v", sum, ok)
+	}
+	if _, ok := (*writtenCRC)(nil).sum(-1); ok {
+		t.Error("Expected objects that weren't checksummed to have no checksum")
+	}
+}
+
+func TestCRC32CCombine(t *testing.T) {
+	data := make([]byte, 100000)
+	rand.Read(data)
+	for _, split := range []int{0, 1, 7, 4096, 99999, 100000} {
+		a := crc32.Checksum(data[:split], crc32cTable)
+		b := crc32.Checksum(data[split:], crc32cTable)
+		if combined, expected := crc32cCombine(a, b, int64(len(data)-split)), crc32.Checksum(data, crc32cTable); combined != expected {
+			t.Errorf("Expected combining at %d to give %x, got %x", split, expected, combined)
+		}
+	}
+}
+
+func TestTransferStatsRetries(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Length", "4")
+		w.Header().Set("ETag", "\"abc\"")
+	}))
+	defer server.Close()
+
+	client, err := NewS3Client(context.Background(), S3ClientConfig{EndpointURL: server.URL, ForcePathStyle: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, transfer := withTransferStats(context.Background())
+	if _, err := client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String("bucket"), Key: aws.String("key")}); err != nil {
+		t.Fatal(err)
+	}
+	if transfer.retries() != 1 {
+		t.Errorf("Expected 1 retry, got %d", transfer.retries())
+	}
+
+	// requests without stats in their context aren't counted
+	if _, err := client.HeadObject(context.Background(), &s3.HeadObjectInput{Bucket: aws.String("bucket"), Key: aws.String("key")}); err != nil {
+		t.Fatal(err)
+	}
+	if transfer.retries() != 1 {
+		t.Errorf("Expected requests made with other contexts not to be counted, got %d retries", transfer.retries())
+	}
+}
+
+func TestS3DownloadManifest(t *testing.T) {
+	clientConfig := testS3ClientConfig(t)
+	client, err := NewS3Client(context.Background(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects := map[string][]byte{
+		"manifest/a.txt": []byte("123456789"),
+		"manifest/b.txt": []byte("b"),
+	}
+	createTestObjects(t, client, "s3pd-test", objects)
+
+	dir := t.TempDir()
+	manifest := filepath.Join(t.TempDir(), "manifest.jsonl")
+	d := S3Download{
+		Bucket:    "s3pd-test",
+		Prefix:    "manifest/",
+		Writepath: dir,
+		Workers:   2,
+		Threads:   1,
+		Partsize:  1024 * 1024,
+		MaxList:   10,
+		Client:    clientConfig,
+		Manifest:  manifest,
+		Summary:   NewRunSummary(),
+		Bar:       newTestBar(),
+		Log:       logging.MustGetLogger("s3pd-test"),
+	}
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	entries := map[string]manifestEntry{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e manifestEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		entries[e.Key] = e
+	}
+	if len(entries) != len(objects) {
+		t.Fatalf("Expected a line per object, got %v", entries)
+	}
+
+	a := entries["manifest/a.txt"]
+	if a.Dest != filepath.Join(dir, "a.txt") || a.Size != 9 || len(a.ETag) == 0 {
+		t.Errorf("Unexpected manifest line %+v", a)
+	}
+	if a.CRC32C != "4waSgw==" {
+		t.Errorf("Expected the CRC32C of the file written, got %s", a.CRC32C)
+	}
+	if a.End.Before(a.Start) || a.Retries != 0 {
+		t.Errorf("Unexpected timings or retries in %+v", a)
+	}
+
+	if d.Stats().BytesWritten() != 10 || d.Stats().BytesReceived() < 10 {
+		t.Errorf("Expected 10 bytes written & received, got %d written & %d received", d.Stats().BytesWritten(), d.Stats().BytesReceived())
+	}
+
+	totals := d.Summary.Totals()
+	if totals.Objects != 2 || totals.Bytes != 10 || totals.Requests["ListObjectsV2"] != 1 || totals.Requests["GetObject"] < 2 {
+		t.Errorf("Unexpected summary %+v", totals)
+	}
+}
@@ -0,0 +1,172 @@
+package downloaders
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Prefix of the extended attributes S3 object metadata is stored in
+const xattrPrefix = "user.s3."
+
+// S3 object metadata which is kept in a downloaded file's extended attributes,
+// so that it can be restored when the file is uploaded back to S3
+type ObjectMetadata struct {
+	ETag               string
+	ContentType        string
+	ContentEncoding    string
+	ContentDisposition string
+	ContentLanguage    string
+	CacheControl       string
+
+	// x-amz-meta-* headers, keyed without the x-amz-meta- prefix
+	UserMetadata map[string]string
+
+	// Object tags, only populated when requested as they need an extra GetObjectTagging request
+	Tags map[string]string
+}
+
+// Returns the metadata as extended attributes, E.g. user.s3.content-type & user.s3.meta.<name>
+func (m ObjectMetadata) xattrs() map[string][]byte {
+	attrs := make(map[string][]byte)
+	headers := map[string]string{
+		"etag":                m.ETag,
+		"content-type":        m.ContentType,
+		"content-encoding":    m.ContentEncoding,
+		"content-disposition": m.ContentDisposition,
+		"content-language":    m.ContentLanguage,
+		"cache-control":       m.CacheControl,
+	}
+	for name, value := range headers {
+		if len(value) != 0 {
+			attrs[xattrPrefix+name] = []byte(value)
+		}
+	}
+	for name, value := range m.UserMetadata {
+		attrs[xattrPrefix+"meta."+name] = []byte(value)
+	}
+	for name, value := range m.Tags {
+		attrs[xattrPrefix+"tag."+name] = []byte(value)
+	}
+	return attrs
+}
+
+// Parses metadata from a file's extended attributes, ignoring attributes not set by s3pd
+func metadataFromXattrs(attrs map[string][]byte) ObjectMetadata {
+	m := ObjectMetadata{UserMetadata: map[string]string{}, Tags: map[string]string{}}
+	for attr, value := range attrs {
+		if !strings.HasPrefix(attr, xattrPrefix) {
+			continue
+		}
+
+		name := attr[len(xattrPrefix):]
+		switch {
+		case name == "etag":
+			m.ETag = string(value)
+		case name == "content-type":
+			m.ContentType = string(value)
+		case name == "content-encoding":
+			m.ContentEncoding = string(value)
+		case name == "content-disposition":
+			m.ContentDisposition = string(value)
+		case name == "content-language":
+			m.ContentLanguage = string(value)
+		case name == "cache-control":
+			m.CacheControl = string(value)
+		case strings.HasPrefix(name, "meta."):
+			m.UserMetadata[name[len("meta."):]] = string(value)
+		case strings.HasPrefix(name, "tag."):
+			m.Tags[name[len("tag."):]] = string(value)
+		}
+	}
+	return m
+}
+
+// Returns the tags in the URL query format PutObject expects E.g. "key1=value1&key2=value2"
+func (m ObjectMetadata) tagging() *string {
+	if len(m.Tags) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(m.Tags))
+	for name := range m.Tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = url.QueryEscape(name) + "=" + url.QueryEscape(m.Tags[name])
+	}
+	return aws.String(strings.Join(pairs, "&"))
+}
+
+// Writes the metadata to the file's extended attributes
+func writeMetadataXattrs(path string, m ObjectMetadata) error {
+	for attr, value := range m.xattrs() {
+		if err := setXattr(path, attr, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reads the metadata stored in the file's extended attributes
+func readMetadataXattrs(path string) (ObjectMetadata, error) {
+	attrs, err := getXattrs(path, xattrPrefix)
+	if err != nil {
+		return ObjectMetadata{}, err
+	}
+	return metadataFromXattrs(attrs), nil
+}
+
+// Gets the object's metadata with a HeadObject request, and optionally its tags
+func (d S3Download) objectMetadata(ctx context.Context, client *s3.Client, j S3ObjectJob) (ObjectMetadata, error) {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(d.Bucket),
+		Key:    aws.String(j.Key),
+	}
+	if len(j.VersionId) != 0 {
+		input.VersionId = aws.String(j.VersionId)
+	}
+	d.Request.applyHead(input)
+
+	head, err := client.HeadObject(ctx, input)
+	if err != nil {
+		return ObjectMetadata{}, err
+	}
+
+	m := ObjectMetadata{
+		ETag:               trimETag(aws.ToString(head.ETag)),
+		ContentType:        aws.ToString(head.ContentType),
+		ContentEncoding:    aws.ToString(head.ContentEncoding),
+		ContentDisposition: aws.ToString(head.ContentDisposition),
+		ContentLanguage:    aws.ToString(head.ContentLanguage),
+		CacheControl:       aws.ToString(head.CacheControl),
+		UserMetadata:       head.Metadata,
+	}
+
+	if d.XattrTags {
+		tagInput := &s3.GetObjectTaggingInput{
+			Bucket: aws.String(d.Bucket),
+			Key:    aws.String(j.Key),
+		}
+		if len(j.VersionId) != 0 {
+			tagInput.VersionId = aws.String(j.VersionId)
+		}
+		d.Request.applyGetTagging(tagInput)
+
+		tagging, err := client.GetObjectTagging(ctx, tagInput)
+		if err != nil {
+			return ObjectMetadata{}, err
+		}
+		m.Tags = make(map[string]string, len(tagging.TagSet))
+		for _, tag := range tagging.TagSet {
+			m.Tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+		}
+	}
+	return m, nil
+}
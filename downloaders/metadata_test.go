@@ -0,0 +1,61 @@
+package downloaders
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMetadataXattrs(t *testing.T) {
+	m := ObjectMetadata{
+		ETag:         "9b2cf535f27731c974343645a3985328",
+		ContentType:  "image/jpeg",
+		CacheControl: "max-age=60",
+		UserMetadata: map[string]string{"camera": "nikon"},
+		Tags:         map[string]string{"project": "cats & dogs"},
+	}
+
+	attrs := m.xattrs()
+	if string(attrs["user.s3.content-type"]) != "image/jpeg" || string(attrs["user.s3.meta.camera"]) != "nikon" {
+		t.Errorf("Unexpected xattrs: %v", attrs)
+	}
+	if _, ok := attrs["user.s3.content-encoding"]; ok {
+		t.Error("Empty headers shouldn't be stored")
+	}
+
+	// Attributes not set by s3pd are ignored
+	attrs["user.other"] = []byte("ignored")
+	if parsed := metadataFromXattrs(attrs); !reflect.DeepEqual(parsed, m) {
+		t.Errorf("Expected %+v, got %+v", m, parsed)
+	}
+
+	if tagging := *m.tagging(); tagging != "project=cats+%26+dogs" {
+		t.Errorf("Unexpected tagging %q", tagging)
+	}
+}
+
+func TestMetadataXattrsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := ObjectMetadata{
+		ETag:         "9b2cf535f27731c974343645a3985328",
+		ContentType:  "text/plain",
+		UserMetadata: map[string]string{"owner": "data-team"},
+		Tags:         map[string]string{},
+	}
+	if err := writeMetadataXattrs(path, m); err != nil {
+		t.Skipf("extended attributes not supported: %v", err)
+	}
+
+	read, err := readMetadataXattrs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, m) {
+		t.Errorf("Expected %+v, got %+v", m, read)
+	}
+}
@@ -2,13 +2,46 @@ package downloaders
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"sync/atomic"
+	"time"
 )
 
+// Tunables applied to the SDK's default http.Transport of every HTTP client we create.
+// Zero connection limits are unlimited, and zero timeouts are no timeout.
+type HTTPOptions struct {
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	IdleConnTimeout       time.Duration
+	KeepAlive             time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+
+	// Size of the kernel's socket buffers (SO_RCVBUF & SO_SNDBUF) in bytes
+	SocketReadBuffer  int
+	SocketWriteBuffer int
+
+	// Proxy URL, when left empty the HTTP_PROXY, HTTPS_PROXY & NO_PROXY environment variables are used
+	Proxy string
+
+	// When set, new connections are spread across the distinct IPs a host resolves to
+	Spreader *IPSpreader
+
+	// Skips verifying the server's TLS certificate
+	InsecureSkipVerify bool
+
+	// Path to a PEM file of CA certificates trusted in addition to the system's
+	CABundle string
+}
+
 func getIP(ifaceName string) (ip net.IP, mask net.IPMask, err error) {
 	iface, err := net.InterfaceByName(ifaceName)
 	if err != nil {
@@ -46,31 +79,149 @@ func getNicIP(ip net.IP) (string, error) {
 	return "", fmt.Errorf("No IPv4 or IPv6 address for Nic's IP's")
 }
 
-func createHttpClient(ip net.IP) (*http.Client, error) {
-	// Get our Client
-	addr, nicErr := getNicIP(ip)
-	if nicErr != nil {
-		return nil, nicErr
+// Returns the SDK's default HTTP client, with its dialer, TLS trust & connection limits replaced by ours.
+// Everything else, E.g. the minimum TLS version & HTTP/2, is left as the SDK sets it
+func createHttpClient(ip net.IP, opts HTTPOptions) (*awshttp.BuildableClient, error) {
+	dialer := &net.Dialer{Timeout: awshttp.DefaultDialConnectTimeout, KeepAlive: opts.KeepAlive}
+
+	// When a NIC's IP is given, bind our outgoing connections to it
+	if ip != nil {
+		addr, nicErr := getNicIP(ip)
+		if nicErr != nil {
+			return nil, nicErr
+		}
+
+		// :0 tells linux to dynamically assign us an unused port
+		// https://www.lifewire.com/port-0-in-tcp-and-udp-818145
+		tcpAddr, resolveErr := net.ResolveTCPAddr("tcp", addr+":0")
+		if resolveErr != nil {
+			return nil, resolveErr
+		}
+		dialer.LocalAddr = tcpAddr
 	}
 
-	// :0 tells linux to dynamically assign us an unused port
-	// https://www.lifewire.com/port-0-in-tcp-and-udp-818145
-	tcpAddr, resolveErr := net.ResolveTCPAddr("tcp", addr+":0")
-	if resolveErr != nil {
-		return nil, resolveErr
+	dial := dialer.DialContext
+	if opts.Spreader != nil {
+		dial = opts.Spreader.DialContext(dialer)
 	}
 
 	// Configure how to connect to the NIC's address & ephemeral TCP port we've allocated
-	dialer := &net.Dialer{LocalAddr: tcpAddr}
 	dialContext := func(ctx context.Context, network, dailAddr string) (net.Conn, error) {
-		conn, err := dialer.Dial(network, dailAddr)
-		return conn, err
+		conn, err := dial(ctx, network, dailAddr)
+		if err != nil {
+			return nil, err
+		}
+		if err := setSocketBuffers(conn, opts); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+
+	var proxy func(*http.Request) (*url.URL, error)
+	if len(opts.Proxy) != 0 {
+		proxyURL, err := url.Parse(opts.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url %q: %w", opts.Proxy, err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	rootCAs, err := loadCABundle(opts.CABundle)
+	if err != nil {
+		return nil, err
+	}
+
+	client := awshttp.NewBuildableClient().WithTransportOptions(func(t *http.Transport) {
+		t.DialContext = dialContext
+		if proxy != nil {
+			t.Proxy = proxy
+		}
+
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+		t.TLSClientConfig.InsecureSkipVerify = opts.InsecureSkipVerify
+		if rootCAs != nil {
+			t.TLSClientConfig.RootCAs = rootCAs
+		}
+
+		// 0 leaves the number of idle connections unlimited
+		t.MaxIdleConns = opts.MaxIdleConns
+		if opts.MaxIdleConnsPerHost != 0 {
+			t.MaxIdleConnsPerHost = opts.MaxIdleConnsPerHost
+		}
+		// don't cap connections below the number of requests we'll make at once
+		if t.MaxConnsPerHost != 0 && t.MaxConnsPerHost < opts.MaxIdleConnsPerHost {
+			t.MaxConnsPerHost = opts.MaxIdleConnsPerHost
+		}
+		t.IdleConnTimeout = opts.IdleConnTimeout
+		t.TLSHandshakeTimeout = opts.TLSHandshakeTimeout
+		t.ResponseHeaderTimeout = opts.ResponseHeaderTimeout
+	})
+	return client, nil
+}
+
+// Returns the system's CA certificates along with those in the PEM file at path, nil when path is empty
+func loadCABundle(path string) (*x509.CertPool, error) {
+	if len(path) == 0 {
+		return nil, nil
+	}
+
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fallback to an empty pool, as the system pool isn't available on every OS
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificates found in CA bundle %s", path)
+	}
+	return pool, nil
+}
+
+// Sets the kernel socket buffer sizes on a freshly dialed connection
+func setSocketBuffers(conn net.Conn, opts HTTPOptions) error {
+	if cc, ok := conn.(*countingConn); ok {
+		conn = cc.Conn
 	}
 
-	// Create HTTP client using our dialer
-	transport := &http.Transport{DialContext: dialContext}
-	client := &http.Client{
-		Transport: transport,
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	if opts.SocketReadBuffer > 0 {
+		if err := tcpConn.SetReadBuffer(opts.SocketReadBuffer); err != nil {
+			return err
+		}
+	}
+	if opts.SocketWriteBuffer > 0 {
+		if err := tcpConn.SetWriteBuffer(opts.SocketWriteBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns a HTTP client with the given transport settings. If NICs are given
+// the client load balances requests across them
+func NewHTTPClient(nicNames []string, opts HTTPOptions) (HTTPClient, error) {
+	if len(nicNames) != 0 {
+		mn, err := NewMultiNicHTTPClient(nicNames, opts)
+		if err != nil {
+			return nil, err
+		}
+		return mn, nil
+	}
+
+	client, err := createHttpClient(nil, opts)
+	if err != nil {
+		return nil, err
 	}
 	return client, nil
 }
@@ -83,18 +234,21 @@ type MultiNicHTTPClient struct {
 	// List of NICs we're load balancing traffic across
 	NICs []net.IP
 
+	// Names of the NICs, reported in the transfer manifest
+	names []string
+
 	// HTTP Clients corresponding to said NICs
-	httpClients []*http.Client
+	httpClients []*awshttp.BuildableClient
 
 	//if this overflows a-ok as we'll start back at 0
 	// only using it for shuffling traffic.
 	counter uint32
 }
 
-func NewMultiNicHTTPClient(nicNames []string) (*MultiNicHTTPClient, error) {
-	mn := MultiNicHTTPClient{}
+func NewMultiNicHTTPClient(nicNames []string, opts HTTPOptions) (*MultiNicHTTPClient, error) {
+	mn := MultiNicHTTPClient{names: nicNames}
 	mn.NICs = make([]net.IP, len(nicNames), len(nicNames))
-	mn.httpClients = make([]*http.Client, len(nicNames), len(nicNames))
+	mn.httpClients = make([]*awshttp.BuildableClient, len(nicNames), len(nicNames))
 
 	// Get NicIPs & create httplients
 	for i, nic := range nicNames {
@@ -104,7 +258,7 @@ func NewMultiNicHTTPClient(nicNames []string) (*MultiNicHTTPClient, error) {
 		}
 		mn.NICs[i] = ip
 
-		httpClient, err := createHttpClient(ip)
+		httpClient, err := createHttpClient(ip, opts)
 		if err != nil {
 			return nil, err
 		}
@@ -119,15 +273,20 @@ func NewMultiNicHTTPClient(nicNames []string) (*MultiNicHTTPClient, error) {
  * The Client's Transport typically has internal state (cached TCP connections), so Clients should be reused instead of created as needed.
  * Clients are safe for concurrent use by multiple goroutines.
  */
-func (mn *MultiNicHTTPClient) Client() *http.Client {
-	// load balance across the NICs
-	i := atomic.AddUint32(&mn.counter, 1) % uint32(len(mn.NICs))
-	return mn.httpClients[i]
+func (mn *MultiNicHTTPClient) Client() *awshttp.BuildableClient {
+	return mn.httpClients[mn.next()]
+}
 
+// Returns the index of the NIC to send the next request over, load balancing across the NICs
+func (mn *MultiNicHTTPClient) next() uint32 {
+	return atomic.AddUint32(&mn.counter, 1) % uint32(len(mn.NICs))
 }
 
 // Load balances traffic across the HTTP Clients
 func (mn *MultiNicHTTPClient) Do(req *http.Request) (*http.Response, error) {
-	client := mn.Client()
-	return client.Do(req)
+	i := mn.next()
+	if t := transferStatsFrom(req.Context()); t != nil && int(i) < len(mn.names) {
+		t.useNIC(mn.names[i])
+	}
+	return mn.httpClients[i].Do(req)
 }
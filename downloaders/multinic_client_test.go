@@ -1,43 +1,55 @@
 package downloaders
 
 import (
+	"crypto/tls"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"testing"
+	"time"
 )
 
+// Skips the test when the host doesn't have the network interface being tested against
+func requireNic(t *testing.T, name string) {
+	if _, err := net.InterfaceByName(name); err != nil {
+		t.Skipf("network interface %s not available: %v", name, err)
+	}
+}
+
 func TestNewMultiNicHTTPClient(t *testing.T) {
-	_, err := NewMultiNicHTTPClient([]string{"en0"})
+	requireNic(t, "en0")
+	_, err := NewMultiNicHTTPClient([]string{"en0"}, HTTPOptions{})
 	if err != nil {
 		t.Error(err)
 	}
 }
 
 func TestMakeClient(t *testing.T) {
-	mn, err := NewMultiNicHTTPClient([]string{"en0"})
+	requireNic(t, "en0")
+	mn, err := NewMultiNicHTTPClient([]string{"en0"}, HTTPOptions{})
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	_, err = mn.Client()
-	if err != nil {
-		t.Error(err)
+	if mn.Client() == nil {
+		t.Error("No client returned")
 	}
 }
 
 func TestMakeHTTPCall(t *testing.T) {
-	mn, err := NewMultiNicHTTPClient([]string{"en0"})
+	requireNic(t, "en0")
+	mn, err := NewMultiNicHTTPClient([]string{"en0"}, HTTPOptions{})
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 
-	client, err := mn.Client()
-	if err != nil {
-		t.Error(err)
-	}
+	client := mn.Client()
 
 	// http request
-	response, err := client.Get("https://api.ipify.org/") // get my IP address
+	req, _ := http.NewRequest("GET", "https://api.ipify.org/", nil) // get my IP address
+	response, err := client.Do(req)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 
 	data, err := ioutil.ReadAll(response.Body)
@@ -51,16 +63,63 @@ func TestMakeHTTPCall(t *testing.T) {
 }
 
 func TestMakeClientSpeed(t *testing.T) {
+	requireNic(t, "en0")
 	br := testing.Benchmark(func(b *testing.B) {
-		mn, err := NewMultiNicHTTPClient([]string{"en0"})
+		mn, err := NewMultiNicHTTPClient([]string{"en0"}, HTTPOptions{})
 		if err != nil {
-			b.Error(err)
+			b.Fatal(err)
 		}
 
-		_, err = mn.Client()
-		if err != nil {
-			b.Error(err)
+		if mn.Client() == nil {
+			b.Error("No client returned")
 		}
 	})
 	t.Logf("Time it took to create new HTTP Client: %s\n", br)
 }
+
+func TestHTTPOptions(t *testing.T) {
+	opts := HTTPOptions{
+		MaxIdleConns:          300,
+		MaxIdleConnsPerHost:   200,
+		IdleConnTimeout:       time.Minute,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 20 * time.Second,
+		Proxy:                 "http://proxy.internal:3128",
+		InsecureSkipVerify:    true,
+	}
+	client, err := NewHTTPClient(nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport := client.(*awshttp.BuildableClient).GetTransport()
+	if transport.MaxIdleConns != 300 || transport.MaxIdleConnsPerHost != 200 {
+		t.Errorf("Idle connection limits not applied: %d, %d", transport.MaxIdleConns, transport.MaxIdleConnsPerHost)
+	}
+	if transport.IdleConnTimeout != time.Minute {
+		t.Errorf("Idle timeout not applied: %s", transport.IdleConnTimeout)
+	}
+	if transport.TLSHandshakeTimeout != 5*time.Second || transport.ResponseHeaderTimeout != 20*time.Second {
+		t.Errorf("Timeouts not applied: %s, %s", transport.TLSHandshakeTimeout, transport.ResponseHeaderTimeout)
+	}
+	// the SDK's defaults are kept for everything else
+	if !transport.TLSClientConfig.InsecureSkipVerify || transport.TLSClientConfig.MinVersion != tls.VersionTLS12 || !transport.ForceAttemptHTTP2 {
+		t.Errorf("Expected the SDK's TLS & HTTP/2 defaults with verification skipped, got %+v", transport.TLSClientConfig)
+	}
+	if transport.MaxConnsPerHost < 200 {
+		t.Errorf("Expected connections per host not to be capped below the idle limit, got %d", transport.MaxConnsPerHost)
+	}
+
+	req, _ := http.NewRequest("GET", "https://mybucket.s3.amazonaws.com/", nil)
+	proxyURL, err := transport.Proxy(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxyURL.String() != "http://proxy.internal:3128" {
+		t.Errorf("Proxy not applied: %s", proxyURL)
+	}
+
+	if _, err := NewHTTPClient(nil, HTTPOptions{Proxy: "://bad"}); err == nil {
+		t.Error("Expected an error for an invalid proxy url")
+	}
+}
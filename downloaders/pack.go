@@ -0,0 +1,242 @@
+package downloaders
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	s3manager "github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Size of a tar block. Entries are padded to a whole number of blocks, and archives end with two zero blocks
+const tarBlockSize = 512
+
+// Name of the index of which shard, and where in it, each object was packed into
+const packIndexName = "index.tsv"
+
+// Packs objects into tar shards rather than writing a file per object
+type PackOptions struct {
+	Enabled bool
+
+	// Bytes a shard is filled to before starting the next one. A single object bigger than this gets a shard to itself
+	ShardSize int64
+
+	// Keep objects with the same key stem, e.g. 0001.jpg & 0001.json, next to each other in the same shard, as WebDataset expects
+	GroupByStem bool
+}
+
+// Tar shard that objects are written into at offsets reserved for them as they're listed
+type packShard struct {
+	name string
+	f    *os.File
+
+	// objects are only added to the index once they've been written into the shard
+	index *tsvReport
+
+	mu sync.Mutex
+	// offset the next entry's header is written at
+	end     int64
+	entries int
+	// objects that have a place in the shard but haven't been written yet
+	pending int
+	// no more objects are added once sealed, and the shard is finished once every pending object has been written
+	sealed bool
+}
+
+func newPackShard(dir string, n int, index *tsvReport) (*packShard, error) {
+	name := fmt.Sprintf("shard-%06d.tar", n)
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	return &packShard{name: name, f: f, index: index}, nil
+}
+
+// Writes the entry's header, and returns the offset its data is to be written at
+func (s *packShard) add(header []byte, size int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.f.WriteAt(header, s.end); err != nil {
+		return 0, err
+	}
+	offset := s.end + int64(len(header))
+	s.end = offset + tarPadded(size)
+	s.entries++
+	s.pending++
+	return offset, nil
+}
+
+// Marks the object as written, adding it to the index, and finishes the shard if it's sealed & was the last one
+func (s *packShard) release(j S3ObjectJob) error {
+	if err := s.index.Write(j.Key, s.name, strconv.FormatInt(j.Offset, 10), strconv.FormatInt(j.Size, 10)); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending--
+	return s.finishIfDone()
+}
+
+// Stops objects being added, finishing the shard once every object has been written
+func (s *packShard) seal() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sealed = true
+	return s.finishIfDone()
+}
+
+// Writes the end of archive blocks & closes the shard once it's sealed and every object's been written.
+// Padding after each entry is left as a hole in the file, which reads back as zeros
+func (s *packShard) finishIfDone() error {
+	if !s.sealed || s.pending != 0 {
+		return nil
+	}
+	if _, err := s.f.WriteAt(make([]byte, 2*tarBlockSize), s.end); err != nil {
+		s.f.Close()
+		return err
+	}
+	return s.f.Close()
+}
+
+// Rounds size up to a whole number of tar blocks
+func tarPadded(size int64) int64 {
+	return (size + tarBlockSize - 1) / tarBlockSize * tarBlockSize
+}
+
+// Returns the tar header blocks of a file entry
+func tarHeader(name string, size int64, mtime time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	// headers are written as soon as they're given to the writer, the entry's data is written separately
+	tw := tar.NewWriter(&buf)
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  mtime,
+	})
+	return buf.Bytes(), err
+}
+
+// Returns the key without the extensions of its name, which WebDataset groups a sample's files by. E.g. train/0001 for train/0001.seg.png
+func sampleStem(key string) string {
+	dir, name := path.Split(key)
+	if i := strings.Index(name, "."); i >= 0 {
+		name = name[:i]
+	}
+	return dir + name
+}
+
+// Moves objects from the listed channel to the jobs channel, in key order, reserving each object's place in a shard.
+// Shards are filled to the shard size, without splitting up samples when grouping by stem. Closes jobs once every listed object has been moved over.
+func (d S3Download) packShards(ctx context.Context, listed <-chan S3ObjectJob, jobs chan<- S3ObjectJob) error {
+	defer close(jobs)
+	defer func() {
+		// keep draining after a failure, so that listing isn't blocked on a full channel
+		for range listed {
+		}
+	}()
+
+	var shard *packShard
+	var shards int
+	var stem string
+	err := inKeyOrder(d.Bucket, listed, func(j S3ObjectJob) error {
+		// folders don't need an entry of their own, the files in them have the full path
+		if isDirectoryMarker(j.Key) {
+			d.Bar.Add64(j.Size)
+			return nil
+		}
+
+		// names go through the same rules as paths, so that extracting the shards can't write outside of the folder they're extracted to
+		name, _, err := safeRelativePath(d.mappedName(j))
+		if err != nil {
+			return fmt.Errorf("s3://%s/%s can't be packed: %w", d.Bucket, j.Key, err)
+		}
+		name = filepath.ToSlash(name)
+		header, err := tarHeader(name, j.Size, j.LastModified)
+		if err != nil {
+			return fmt.Errorf("s3://%s/%s can't be packed: %w", d.Bucket, j.Key, err)
+		}
+
+		full := shard != nil && shard.entries != 0 && shard.end+int64(len(header))+tarPadded(j.Size) > d.Pack.ShardSize
+		if shard == nil || (full && (!d.Pack.GroupByStem || sampleStem(name) != stem)) {
+			if shard != nil {
+				if err := shard.seal(); err != nil {
+					return err
+				}
+			}
+			if shard, err = newPackShard(d.Writepath, shards, d.packIndex); err != nil {
+				return err
+			}
+			shards++
+		}
+		stem = sampleStem(name)
+
+		offset, err := shard.add(header, j.Size)
+		if err != nil {
+			return err
+		}
+		j.Path = filepath.Join(d.Writepath, shard.name)
+		j.Offset = offset
+		j.shard = shard
+		select {
+		case jobs <- j:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if shard != nil {
+		return shard.seal()
+	}
+	return nil
+}
+
+// Writes the object into its place in its shard
+func (d S3Download) packObject(ctx context.Context, downloader *s3manager.Downloader, j S3ObjectJob, crc *writtenCRC) error {
+	if j.Size != 0 {
+		input := &s3.GetObjectInput{
+			Bucket: aws.String(d.Bucket),
+			Key:    aws.String(j.Key),
+		}
+		if len(j.VersionId) != 0 {
+			input.VersionId = aws.String(j.VersionId)
+		}
+		// the object's size can't change after its place in the shard has been reserved
+		if len(j.ETag) != 0 {
+			input.IfMatch = aws.String("\"" + j.ETag + "\"")
+		}
+		d.Request.applyGet(input)
+
+		shard := crcWriterAt{w: offsetWriterAt{w: j.shard.f, offset: j.Offset}, crc: crc}
+		w := NewLogProgressWriteBuffer(d.Bar, statsWriterAt{w: shard, stats: d.stats})
+		if _, err := downloader.Download(ctx, w, input); err != nil {
+			return err
+		}
+	}
+	return j.shard.release(j)
+}
+
+// Writes to w, offset by offset
+type offsetWriterAt struct {
+	w      *os.File
+	offset int64
+}
+
+func (o offsetWriterAt) WriteAt(p []byte, offset int64) (int, error) {
+	return o.w.WriteAt(p, o.offset+offset)
+}
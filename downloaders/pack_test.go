@@ -0,0 +1,238 @@
+package downloaders
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"github.com/op/go-logging"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Returns the names & contents of the entries in the tar file
+func readTestTar(t *testing.T, path string) map[string][]byte {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	entries := map[string][]byte{}
+	tr := tar.NewReader(f)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[h.Name] = data
+	}
+}
+
+func TestSampleStem(t *testing.T) {
+	stems := map[string]string{
+		"train/0001.jpg":     "train/0001",
+		"train/0001.seg.png": "train/0001",
+		"train/0001":         "train/0001",
+		"train.v2/0001.json": "train.v2/0001",
+	}
+	for key, expected := range stems {
+		if stem := sampleStem(key); stem != expected {
+			t.Errorf("Expected the stem of %s to be %s, got %s", key, expected, stem)
+		}
+	}
+}
+
+func TestPackShards(t *testing.T) {
+	dir := t.TempDir()
+	d := S3Download{
+		Prefix:    "train/",
+		Writepath: dir,
+		Pack:      PackOptions{Enabled: true, ShardSize: 3*1536 + 100, GroupByStem: true},
+		Bar:       newTestBar(),
+		Log:       logging.MustGetLogger("s3pd-test"),
+	}
+
+	objects := map[string][]byte{}
+	keys := []string{"train/", "train/0001.jpg", "train/0001.json", "train/0002.jpg", "train/0002.json", "train/0003.jpg"}
+	listed := make(chan S3ObjectJob, len(keys))
+	jobs := make(chan S3ObjectJob, len(keys))
+	for i, key := range keys {
+		if !isDirectoryMarker(key) {
+			objects[key] = bytes.Repeat([]byte{byte('a' + i)}, 700+i)
+		}
+		listed <- S3ObjectJob{Key: key, Size: int64(len(objects[key]))}
+	}
+	close(listed)
+
+	index, err := newTSVReport(filepath.Join(dir, packIndexName), "key", "shard", "offset", "size")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.packIndex = index
+	if err := d.packShards(context.Background(), listed, jobs); err != nil {
+		t.Fatal(err)
+	}
+	// write each object into the place reserved for it, as the workers do
+	shards := map[string][]string{}
+	for j := range jobs {
+		if _, err := j.shard.f.WriteAt(objects[j.Key], j.Offset); err != nil {
+			t.Fatal(err)
+		}
+		if err := j.shard.release(j); err != nil {
+			t.Fatal(err)
+		}
+		shards[filepath.Base(j.Path)] = append(shards[filepath.Base(j.Path)], j.Key)
+	}
+	if err := index.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 0002.json would overflow the first shard, but stays with 0002.jpg
+	expected := map[string][]string{
+		"shard-000000.tar": {"train/0001.jpg", "train/0001.json", "train/0002.jpg", "train/0002.json"},
+		"shard-000001.tar": {"train/0003.jpg"},
+	}
+	if !reflect.DeepEqual(shards, expected) {
+		t.Errorf("Expected shards %v, got %v", expected, shards)
+	}
+	for shard, keys := range expected {
+		entries := readTestTar(t, filepath.Join(dir, shard))
+		for _, key := range keys {
+			if !bytes.Equal(entries[key[len("train/"):]], objects[key]) {
+				t.Errorf("Expected %s to be packed into %s", key, shard)
+			}
+		}
+	}
+
+	// the index has the offset of each object's data in its shard
+	f, err := os.Open(filepath.Join(dir, packIndexName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.Comma = '\t'
+	rows, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 6 {
+		t.Fatalf("Expected a header & 5 objects in the index, got %v", rows)
+	}
+	for _, row := range rows[1:] {
+		data, err := ioutil.ReadFile(filepath.Join(dir, row[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var offset, size int
+		fmt.Sscan(row[2], &offset)
+		fmt.Sscan(row[3], &size)
+		if !bytes.Equal(data[offset:offset+size], objects[row[0]]) {
+			t.Errorf("Expected the index to point at %s's data", row[0])
+		}
+	}
+}
+
+func TestPackShardIndex(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, packIndexName)
+	index, err := newTSVReport(path, "key", "shard", "offset", "size")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shard, err := newPackShard(dir, 0, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := []S3ObjectJob{{Key: "written", Size: 10}, {Key: "failed", Size: 10}}
+	for i, j := range jobs {
+		header, err := tarHeader(j.Key, j.Size, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if jobs[i].Offset, err = shard.add(header, j.Size); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// only the object that was written is released
+	if err := shard.release(jobs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Close(); err != nil {
+		t.Fatal(err)
+	}
+	shard.f.Close()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf("key\tshard\toffset\tsize\nwritten\tshard-000000.tar\t%d\t10\n", jobs[0].Offset)
+	if string(data) != expected {
+		t.Errorf("Expected only written objects in the index, got %q", data)
+	}
+}
+
+func TestS3DownloadPack(t *testing.T) {
+	clientConfig := testS3ClientConfig(t)
+	client, err := NewS3Client(context.Background(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	objects := map[string][]byte{}
+	for i := 0; i < 20; i++ {
+		objects[fmt.Sprintf("pack/%04d.bin", i)] = bytes.Repeat([]byte{byte(i)}, 50*1024+i)
+	}
+	createTestObjects(t, client, "s3pd-test", objects)
+
+	dir := t.TempDir()
+	d := S3Download{
+		Bucket:    "s3pd-test",
+		Prefix:    "pack/",
+		Writepath: dir,
+		Workers:   4,
+		Threads:   2,
+		Partsize:  1024 * 1024,
+		MaxList:   5,
+		Client:    clientConfig,
+		Pack:      PackOptions{Enabled: true, ShardSize: 256 * 1024},
+		Bar:       newTestBar(),
+		Log:       logging.MustGetLogger("s3pd-test"),
+	}
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	shards, err := filepath.Glob(filepath.Join(dir, "shard-*.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shards) != 4 {
+		t.Errorf("Expected 5 objects in each of 4 shards, got %d shards", len(shards))
+	}
+	packed := map[string][]byte{}
+	for _, shard := range shards {
+		for name, data := range readTestTar(t, shard) {
+			packed["pack/"+name] = data
+		}
+	}
+	if !reflect.DeepEqual(packed, objects) {
+		t.Error("Expected every object to be packed into the shards")
+	}
+}
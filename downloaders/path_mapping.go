@@ -0,0 +1,398 @@
+package downloaders
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// What to do with an object whose path is also a folder of other objects, e.g. a/test.txt & a/test.txt/other,
+// or is the path of another object once renamed. POSIX filesystems can't hold a file & a folder with the same path
+type ConflictPolicy string
+
+const (
+	// Stop queueing objects once a conflict is found, failing with every conflicting key once listing finishes.
+	// Objects queued before the conflict was found are still downloaded
+	ConflictFail ConflictPolicy = "fail"
+
+	// Fail before downloading anything, listing every conflicting key. Holds every listed object in memory until listing finishes
+	ConflictFailUpfront ConflictPolicy = "fail-upfront"
+
+	// Write the conflicting object next to the folder, with PathMapping.RenameSuffix appended to its name
+	ConflictRename ConflictPolicy = "rename"
+
+	// Write the conflicting object under PathMapping.SidecarDir instead
+	ConflictSidecar ConflictPolicy = "sidecar"
+)
+
+// How object keys are mapped to the paths they're written to
+type PathMapping struct {
+	Conflicts ConflictPolicy
+
+	// Appended to the names of conflicting objects with the rename policy
+	RenameSuffix string
+
+	// Folder, relative to the download path, conflicting objects are written under with the sidecar policy
+	SidecarDir string
+
+	// File every mapping decision is written to as tab separated key, path & decisions lines, when set
+	Report string
+
+	// Output path template, e.g. {prefix_1}/{basename}. Paths are the key without the prefix's folder, {path}, when empty
+	Template string
+
+	// Regex substitutions applied in order to the path, after the template
+	Rules []RenameRule
+}
+
+// Decisions written to the mapping report
+const (
+	decisionMapped   = "mapped"
+	decisionRenamed  = "renamed"
+	decisionSidecar  = "sidecar"
+	decisionConflict = "conflict"
+	decisionRejected = "rejected"
+
+	// Written against the key of the archive the entry was extracted from
+	decisionExtracted = "extracted"
+)
+
+// Object along with the name it's written to, relative to the download path, the safe path that name is written to,
+// and whether that path is also the folder of another object, or the path of another object
+type keyConflict struct {
+	job      S3ObjectJob
+	name     string
+	path     string
+	conflict bool
+}
+
+// Returns the object along with its name & the slash separated safe path of the name. Names that can't be written have no path
+func newKeyConflict(j S3ObjectJob, name string) keyConflict {
+	path, _, _ := safeRelativePath(name)
+	return keyConflict{job: j, name: name, path: filepath.ToSlash(path)}
+}
+
+// Finds paths which are also folders of other paths, e.g. a/test.txt & a/test.txt/other, or are the same as other paths.
+// Names must be added in lexicographic order, the order ListObjectsV2 returns keys in. Names which could still be the folder
+// of a name that's yet to be added are held back, e.g. a/test.txt is held while a/test.txt-1 is added, as a/test.txt/other comes later.
+// Conflicts are found between the safe paths of the names, the paths objects are actually written to
+type conflictDetector struct {
+	// each held name is a prefix of the names held after it
+	held []keyConflict
+}
+
+// Returns the objects that have been decided on
+func (c *conflictDetector) add(k keyConflict) (decided []keyConflict) {
+	for len(c.held) > 0 {
+		top := c.held[len(c.held)-1]
+		if len(top.path) != 0 && (strings.HasPrefix(k.path, top.path+"/") || k.path == top.path) {
+			top.conflict = true
+			decided = append(decided, top)
+		} else if strings.HasPrefix(k.name, top.name) {
+			// a name that sorts between top & top's folder, top's folder could still be added
+			break
+		} else {
+			decided = append(decided, top)
+		}
+		c.held = c.held[:len(c.held)-1]
+	}
+	c.held = append(c.held, k)
+	return decided
+}
+
+// Returns the held objects once every name has been added
+func (c *conflictDetector) flush() (decided []keyConflict) {
+	for i := len(c.held) - 1; i >= 0; i-- {
+		decided = append(decided, c.held[i])
+	}
+	c.held = nil
+	return decided
+}
+
+// Paths objects are written to, and the folders they're in, which can be claimed by multiple workers.
+// Renamed & sidecar paths are claimed once every other path has been, so that they can be made unique
+type claimedPaths struct {
+	mu sync.Mutex
+	// key of the object each file was written by
+	files map[string]string
+	dirs  map[string]bool
+}
+
+func newClaimedPaths() *claimedPaths {
+	return &claimedPaths{files: map[string]string{}, dirs: map[string]bool{}}
+}
+
+// Claims path for key, returning false if it's a file written for another key, or is a file & also a folder of claimed paths
+func (p *claimedPaths) claim(key, path string, dir bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if owner, ok := p.files[path]; ok && (dir || owner != key) {
+		return false
+	}
+	if !dir && p.dirs[path] {
+		return false
+	}
+	if p.underFile(path) {
+		return false
+	}
+
+	if dir {
+		p.dirs[path] = true
+	} else {
+		p.files[path] = key
+	}
+	for parent := filepath.Dir(path); parent != filepath.Dir(parent); parent = filepath.Dir(parent) {
+		p.dirs[parent] = true
+	}
+	return true
+}
+
+// Claims path for key, or when it's taken the first of path-1, path-2... that isn't.
+// Returns an empty path when every suffix is taken, as one of path's folders is a file
+func (p *claimedPaths) claimUnique(key, path string, dir bool) string {
+	unique := path
+	for n := 1; !p.claim(key, unique, dir); n++ {
+		p.mu.Lock()
+		blocked := p.underFile(path)
+		p.mu.Unlock()
+		if blocked {
+			return ""
+		}
+		unique = fmt.Sprintf("%s-%d", path, n)
+	}
+	return unique
+}
+
+// Whether one of the path's folders is a claimed file. Called with mu held
+func (p *claimedPaths) underFile(path string) bool {
+	for parent := filepath.Dir(path); parent != filepath.Dir(parent); parent = filepath.Dir(parent) {
+		if _, ok := p.files[parent]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the path of the object relative to the download path, the object's key without the prefix's folder
+func (d S3Download) relativePath(key string) string {
+	return key[len(directoryListPrefix(d.Prefix)):]
+}
+
+// Returns the name the object is written to, relative to the download path, after the template & rename rules
+func (d S3Download) mappedName(j S3ObjectJob) string {
+	name := d.relativePath(j.Key)
+	if d.Mapping.rewrites() {
+		name = d.Mapping.rewrite(pathVars{
+			Key:  j.Key,
+			Path: name,
+			Rel:  strings.TrimPrefix(j.Key, d.Prefix),
+			ETag: j.ETag,
+		})
+	}
+
+	// decompressed files are written without the compressed extension
+	if d.Decompress {
+		name = trimCompressionExtension(name)
+	}
+	return name
+}
+
+// Returns the path the object is written to under root & the decisions made
+func (m PathMapping) mapPath(k keyConflict, root string) (string, []string, error) {
+	rel := k.name
+
+	// Directory markers are created as folders, so never conflict with the objects inside them
+	if isDirectoryMarker(k.job.Key) {
+		path, decisions, err := safeRelativePath(rel)
+		if err != nil {
+			// marker of the folder being downloaded
+			return root, []string{decisionDirectory}, nil
+		}
+		return filepath.Join(root, path), append(decisions, decisionDirectory), nil
+	}
+
+	var decisions []string
+	if k.conflict {
+		switch m.Conflicts {
+		case ConflictRename:
+			rel += m.RenameSuffix
+			decisions = append(decisions, decisionRenamed)
+		case ConflictSidecar:
+			root = filepath.Join(root, m.SidecarDir)
+			decisions = append(decisions, decisionSidecar)
+		default:
+			decisions = append(decisions, decisionConflict)
+		}
+	}
+
+	path, safeDecisions, err := safeRelativePath(rel)
+	if err != nil {
+		return "", nil, err
+	}
+	decisions = append(decisions, safeDecisions...)
+	if len(decisions) == 0 {
+		decisions = append(decisions, decisionMapped)
+	}
+	return filepath.Join(root, path), decisions, nil
+}
+
+// Moves objects from the listed channel to the jobs channel, setting the path each object is written to.
+// Objects are moved over as they're listed, unless the bucket is a directory bucket, paths are rewritten, or the
+// policy is fail-upfront. Renamed & sidecar objects are moved over once listing finishes, so that their paths can be
+// made unique among every listed object's. Closes jobs once every listed object has been moved over.
+func (d S3Download) mapPaths(ctx context.Context, listed <-chan S3ObjectJob, jobs chan<- S3ObjectJob) error {
+	defer close(jobs)
+	defer func() {
+		// keep draining after a failure, so that listing isn't blocked on a full channel
+		for range listed {
+		}
+	}()
+
+	// With fail-upfront, objects are held back until every conflict has been found
+	upfront := d.Mapping.Conflicts == ConflictFailUpfront
+	var conflicts []string
+	var mapped []S3ObjectJob
+	send := func(j S3ObjectJob, root, path string, decisions []string) error {
+		if err := d.mappingReport.Write(j.Key, path, strings.Join(decisions, ",")); err != nil {
+			return err
+		}
+		if decisions[0] == decisionConflict {
+			conflicts = append(conflicts, j.Key)
+		}
+
+		// Once a conflict's found nothing else is queued, the rest of the listing is only checked for conflicts
+		if len(conflicts) != 0 {
+			return nil
+		}
+		j.Path = path
+		j.Root = root
+		if upfront {
+			mapped = append(mapped, j)
+			return nil
+		}
+
+		select {
+		case jobs <- j:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// Renamed & sidecar paths could be the path of an object that's yet to be listed, so every path is claimed,
+	// and objects with renamed & sidecar paths are held back until listing finishes
+	resolving := d.Mapping.resolvesConflicts()
+	paths := newClaimedPaths()
+	var resolved []mappedKey
+	emit := func(decided []keyConflict) error {
+		for _, k := range decided {
+			root := d.stripe.assign(k.job.Key, k.job.Size)
+			path, decisions, err := d.Mapping.mapPath(k, root)
+			if err != nil {
+				d.Log.Warningf("Skipping s3://%s/%s: %s\n", d.Bucket, k.job.Key, err)
+				d.Summary.objectSkipped()
+				if err := d.mappingReport.Write(k.job.Key, "", decisionRejected); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if resolving {
+				if k.conflict {
+					resolved = append(resolved, mappedKey{job: k.job, root: root, path: path, decisions: decisions})
+					continue
+				}
+				paths.claim(k.job.Key, path, isDirectoryMarker(k.job.Key))
+			}
+			if err := send(k.job, root, path, decisions); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var detector conflictDetector
+	if IsDirectoryBucket(d.Bucket) || d.Mapping.rewrites() {
+		// Directory buckets don't list keys in order, and rewritten names aren't in the order keys are listed in,
+		// so their objects can't be decided on as they're listed
+		for _, k := range d.sortListed(listed) {
+			if err := emit(detector.add(k)); err != nil {
+				return err
+			}
+		}
+	} else {
+		for j := range listed {
+			if err := emit(detector.add(newKeyConflict(j, d.mappedName(j)))); err != nil {
+				return err
+			}
+		}
+	}
+	if err := emit(detector.flush()); err != nil {
+		return err
+	}
+	for _, m := range claimUniquePaths(paths, resolved) {
+		if err := send(m.job, m.root, m.path, m.decisions); err != nil {
+			return err
+		}
+	}
+
+	if len(conflicts) != 0 {
+		return conflictsError(conflicts)
+	}
+	for _, j := range mapped {
+		select {
+		case jobs <- j:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Object along with the path it's written to under root, and the decisions made mapping it
+type mappedKey struct {
+	job       S3ObjectJob
+	root      string
+	path      string
+	decisions []string
+}
+
+// Whether conflicting objects are renamed or written to the sidecar folder, rather than failing the download
+func (m PathMapping) resolvesConflicts() bool {
+	return m.Conflicts == ConflictRename || m.Conflicts == ConflictSidecar
+}
+
+// Claims the renamed or sidecar path of each object once every other path has been claimed, suffixing paths that are
+// taken with -1, -2... until they're unique. Objects whose paths can't be made unique are decided to be conflicts
+func claimUniquePaths(paths *claimedPaths, resolved []mappedKey) []mappedKey {
+	for i, r := range resolved {
+		if unique := paths.claimUnique(r.job.Key, r.path, false); len(unique) != 0 {
+			resolved[i].path = unique
+		} else {
+			resolved[i].path = ""
+			resolved[i].decisions = []string{decisionConflict}
+		}
+	}
+	return resolved
+}
+
+// Returns the error listing every conflicting key or file
+func conflictsError(conflicts []string) error {
+	sort.Strings(conflicts)
+	return fmt.Errorf("%d objects have the same path as another object, or a folder of other objects, see --on-conflict:\n%s",
+		len(conflicts), strings.Join(conflicts, "\n"))
+}
+
+// Returns every listed object along with its name, sorted by name
+func (d S3Download) sortListed(listed <-chan S3ObjectJob) []keyConflict {
+	var all []keyConflict
+	for j := range listed {
+		all = append(all, newKeyConflict(j, d.mappedName(j)))
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].name < all[j].name })
+	return all
+}
@@ -0,0 +1,334 @@
+package downloaders
+
+import (
+	"context"
+	"github.com/op/go-logging"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Keys in the order ListObjectsV2 returns them
+var conflictingKeys = []string{
+	"data/a/test.txt",
+	"data/a/test.txt-1",
+	"data/a/test.txt/other",
+	"data/a/test.txt/other/nested",
+	"data/b.txt",
+}
+
+func TestConflictDetector(t *testing.T) {
+	var c conflictDetector
+	var decided []keyConflict
+	for _, key := range conflictingKeys {
+		decided = append(decided, c.add(newKeyConflict(S3ObjectJob{Key: key}, key))...)
+	}
+	decided = append(decided, c.flush()...)
+
+	conflicts := map[string]bool{}
+	for _, k := range decided {
+		conflicts[k.job.Key] = k.conflict
+	}
+	expected := map[string]bool{
+		"data/a/test.txt":              true,
+		"data/a/test.txt-1":            false,
+		"data/a/test.txt/other":        true,
+		"data/a/test.txt/other/nested": false,
+		"data/b.txt":                   false,
+	}
+	if !reflect.DeepEqual(conflicts, expected) {
+		t.Errorf("Expected conflicts %v, got %v", expected, conflicts)
+	}
+}
+
+func TestConflictDetectorSafePaths(t *testing.T) {
+	// "." is escaped to "%2E", so isn't a string prefix of its own folder's safe path once ".-" is added
+	keys := []string{".", ".-", "./y", "a", "a/"}
+
+	var c conflictDetector
+	var decided []keyConflict
+	for _, key := range keys {
+		decided = append(decided, c.add(newKeyConflict(S3ObjectJob{Key: key}, key))...)
+	}
+	decided = append(decided, c.flush()...)
+
+	conflicts := map[string]bool{}
+	for _, k := range decided {
+		conflicts[k.job.Key] = k.conflict
+	}
+	expected := map[string]bool{".": true, ".-": false, "./y": false, "a": true, "a/": false}
+	if !reflect.DeepEqual(conflicts, expected) {
+		t.Errorf("Expected conflicts %v, got %v", expected, conflicts)
+	}
+}
+
+// Runs the listed keys through mapPaths, returning the path of each key
+func mapTestPaths(t *testing.T, d S3Download, keys []string) (map[string]string, error) {
+	d.Log = logging.MustGetLogger("s3pd-test")
+	stripe, err := newStriper(d.Writepath, d.Stripe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.stripe = stripe
+	if d.mappingReport, err = newTSVReport(d.Mapping.Report, "key", "path", "decision"); err != nil {
+		t.Fatal(err)
+	}
+	listed := make(chan S3ObjectJob, len(keys))
+	jobs := make(chan S3ObjectJob, len(keys))
+	for _, key := range keys {
+		listed <- S3ObjectJob{Key: key}
+	}
+	close(listed)
+
+	err = d.mapPaths(context.Background(), listed, jobs)
+	if closeErr := d.mappingReport.Close(); err == nil {
+		err = closeErr
+	}
+	paths := map[string]string{}
+	for j := range jobs {
+		paths[j.Key] = j.Path
+	}
+	return paths, err
+}
+
+func TestMapPathsFail(t *testing.T) {
+	dir := t.TempDir()
+	report := filepath.Join(dir, "report.tsv")
+	d := S3Download{Prefix: "data/", Writepath: "/dest", Mapping: PathMapping{Conflicts: ConflictFail, Report: report}}
+
+	paths, err := mapTestPaths(t, d, conflictingKeys)
+	if err == nil {
+		t.Fatal("Expected conflicts to fail")
+	}
+	if !strings.Contains(err.Error(), "data/a/test.txt\n") || !strings.Contains(err.Error(), "data/a/test.txt/other") {
+		t.Errorf("Expected every conflict to be listed, got %v", err)
+	}
+
+	// Objects decided on before the first conflict was found are still queued, nothing after it is
+	expected := map[string]string{"data/a/test.txt-1": "/dest/a/test.txt-1"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Expected %v to be queued, got %v", expected, paths)
+	}
+
+	data, err := ioutil.ReadFile(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "data/a/test.txt\t/dest/a/test.txt\tconflict\n") {
+		t.Errorf("Expected conflicts in the report, got %q", data)
+	}
+
+	// Without conflicts everything is queued
+	paths, err = mapTestPaths(t, d, []string{"data/b.txt", "data/a.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paths["data/b.txt"] != "/dest/b.txt" || paths["data/a.txt"] != "/dest/a.txt" {
+		t.Errorf("Unexpected paths %v", paths)
+	}
+}
+
+func TestMapPathsFailUpfront(t *testing.T) {
+	d := S3Download{Prefix: "data/", Writepath: "/dest", Mapping: PathMapping{Conflicts: ConflictFailUpfront}}
+
+	paths, err := mapTestPaths(t, d, conflictingKeys)
+	if err == nil {
+		t.Fatal("Expected conflicts to fail")
+	}
+	if len(paths) != 0 {
+		t.Errorf("Nothing should be downloaded when there's conflicts, got %v", paths)
+	}
+
+	paths, err = mapTestPaths(t, d, []string{"data/a.txt", "data/b.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 2 {
+		t.Errorf("Expected everything to be queued without conflicts, got %v", paths)
+	}
+}
+
+func TestMapPathsRename(t *testing.T) {
+	d := S3Download{Prefix: "data/", Writepath: "/dest", Mapping: PathMapping{Conflicts: ConflictRename, RenameSuffix: ".file"}}
+	paths, err := mapTestPaths(t, d, conflictingKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"data/a/test.txt":              "/dest/a/test.txt.file",
+		"data/a/test.txt-1":            "/dest/a/test.txt-1",
+		"data/a/test.txt/other":        "/dest/a/test.txt/other.file",
+		"data/a/test.txt/other/nested": "/dest/a/test.txt/other/nested",
+		"data/b.txt":                   "/dest/b.txt",
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Expected %v, got %v", expected, paths)
+	}
+}
+
+func TestMapPathsSidecar(t *testing.T) {
+	dir := t.TempDir()
+	report := filepath.Join(dir, "report.tsv")
+	d := S3Download{
+		Bucket:    "bucket--usw2-az1--x-s3",
+		Prefix:    "data/",
+		Writepath: "/dest",
+		Mapping:   PathMapping{Conflicts: ConflictSidecar, SidecarDir: ".conflicts", Report: report},
+	}
+
+	// Directory buckets don't list keys in order
+	unordered := []string{"data/b.txt", "data/a/test.txt/other", "data/a/test.txt"}
+	paths, err := mapTestPaths(t, d, unordered)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"data/a/test.txt":       "/dest/.conflicts/a/test.txt",
+		"data/a/test.txt/other": "/dest/a/test.txt/other",
+		"data/b.txt":            "/dest/b.txt",
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Expected %v, got %v", expected, paths)
+	}
+
+	data, err := ioutil.ReadFile(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 4 || lines[0] != "key\tpath\tdecision" {
+		t.Errorf("Expected a header & a line per object, got %q", data)
+	}
+}
+
+func TestMapPathsUnique(t *testing.T) {
+	// a/x makes a conflict, and its renamed & sidecar paths are already taken by listed keys
+	keys := []string{"data/.conflicts/a", "data/a", "data/a.file", "data/a/x"}
+
+	d := S3Download{Prefix: "data/", Writepath: "/dest", Mapping: PathMapping{Conflicts: ConflictRename, RenameSuffix: ".file"}}
+	paths, err := mapTestPaths(t, d, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paths["data/a"] != "/dest/a.file-1" || paths["data/a.file"] != "/dest/a.file" {
+		t.Errorf("Expected the renamed path to be suffixed with -1, got %v", paths)
+	}
+
+	d.Mapping = PathMapping{Conflicts: ConflictSidecar, SidecarDir: ".conflicts"}
+	paths, err = mapTestPaths(t, d, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paths["data/a"] != "/dest/.conflicts/a-1" || paths["data/.conflicts/a"] != "/dest/.conflicts/a" {
+		t.Errorf("Expected the sidecar path to be suffixed with -1, got %v", paths)
+	}
+
+	// no suffix makes the sidecar path unique when the sidecar folder is a file
+	_, err = mapTestPaths(t, d, []string{"data/.conflicts", "data/a", "data/a/x"})
+	if err == nil || !strings.Contains(err.Error(), "data/a") {
+		t.Errorf("Expected data/a to conflict, got %v", err)
+	}
+}
+
+func TestMapPathsUnsafeKeys(t *testing.T) {
+	dir := t.TempDir()
+	report := filepath.Join(dir, "report.tsv")
+	d := S3Download{Prefix: "data/", Writepath: "/dest", Mapping: PathMapping{Conflicts: ConflictRename, RenameSuffix: ".file", Report: report}}
+
+	keys := []string{
+		"data/",
+		"data/../../etc/passwd",
+		"data/a",
+		"data/a/",
+		"data/b\x00c",
+	}
+	paths, err := mapTestPaths(t, d, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"data/":                 "/dest",
+		"data/../../etc/passwd": "/dest/%2E%2E/%2E%2E/etc/passwd",
+		"data/a":                "/dest/a.file",
+		"data/a/":               "/dest/a",
+		"data/b\x00c":           "/dest/b%00c",
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Expected %v, got %v", expected, paths)
+	}
+
+	data, err := ioutil.ReadFile(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "data/a/\t/dest/a\tdirectory\n") ||
+		!strings.Contains(string(data), "/dest/%2E%2E/%2E%2E/etc/passwd\tescaped\n") {
+		t.Errorf("Expected escaped keys & directory markers in the report, got %q", data)
+	}
+}
+
+func TestMapPathsTemplate(t *testing.T) {
+	d := S3Download{
+		Prefix:    "data/",
+		Writepath: "/dest",
+		Mapping: PathMapping{
+			Conflicts:    ConflictRename,
+			RenameSuffix: ".file",
+			Template:     "{basename}",
+		},
+	}
+
+	// Flattening maps both part-0.parquet objects to the same path
+	keys := []string{"data/x/part-0.parquet", "data/y/part-0.parquet", "data/y/part-1.parquet"}
+	paths, err := mapTestPaths(t, d, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"data/x/part-0.parquet": "/dest/part-0.parquet.file",
+		"data/y/part-0.parquet": "/dest/part-0.parquet",
+		"data/y/part-1.parquet": "/dest/part-1.parquet",
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Expected %v, got %v", expected, paths)
+	}
+
+	d.Mapping.Conflicts = ConflictFail
+	if _, err := mapTestPaths(t, d, keys); err == nil {
+		t.Error("Expected objects mapped to the same path to fail")
+	}
+}
+
+func TestMapPathsEscapedKeys(t *testing.T) {
+	d := S3Download{Prefix: "data/", Writepath: "/dest", Mapping: PathMapping{Conflicts: ConflictFail}}
+
+	// Keys that used to map to the same path, overwriting each other
+	keys := []string{"data/..", "data/a/b", "data//a/b", "data/a//b", "data/100%.txt"}
+	paths, err := mapTestPaths(t, d, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"data/..":       "/dest/%2E%2E",
+		"data/a/b":      "/dest/a/b",
+		"data//a/b":     "/dest/%/a/b",
+		"data/a//b":     "/dest/a/%/b",
+		"data/100%.txt": "/dest/100%.txt",
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Expected %v, got %v", expected, paths)
+	}
+
+	// Keys that look escaped are used as is, so conflict with the keys they look escaped from
+	_, err = mapTestPaths(t, d, []string{"data/%2E%2E", "data/.."})
+	if err == nil || !strings.Contains(err.Error(), "data/%2E%2E") {
+		t.Errorf("Expected data/%%2E%%2E to conflict with data/.., got %v", err)
+	}
+}
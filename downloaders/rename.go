@@ -0,0 +1,127 @@
+package downloaders
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Regex substitution applied to the path an object or file is written to, relative to the download path
+type RenameRule struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// Parses a sed style rule, s/pattern/replacement/, where any character can be used in place of /.
+// The delimiter can be escaped with a \ inside the pattern & replacement. The replacement can refer to
+// the pattern's capture groups as $1 or ${name}
+func ParseRenameRule(rule string) (RenameRule, error) {
+	if len(rule) < 2 || rule[0] != 's' {
+		return RenameRule{}, fmt.Errorf("rename rule %q must look like s/pattern/replacement/", rule)
+	}
+	delim := rule[1]
+
+	var parts []string
+	var part strings.Builder
+	for i := 2; i < len(rule); i++ {
+		if rule[i] == '\\' && i+1 < len(rule) && rule[i+1] == delim {
+			part.WriteByte(delim)
+			i++
+			continue
+		}
+		if rule[i] == delim {
+			parts = append(parts, part.String())
+			part.Reset()
+			continue
+		}
+		part.WriteByte(rule[i])
+	}
+	if len(parts) != 2 || part.Len() != 0 {
+		return RenameRule{}, fmt.Errorf("rename rule %q must look like s/pattern/replacement/", rule)
+	}
+
+	pattern, err := regexp.Compile(parts[0])
+	if err != nil {
+		return RenameRule{}, fmt.Errorf("rename rule %q: %w", rule, err)
+	}
+	return RenameRule{Pattern: pattern, Replacement: parts[1]}, nil
+}
+
+// Placeholders in output path templates, e.g. {basename} or {prefix_2}
+var templatePlaceholder = regexp.MustCompile(`\{([a-z]+)(?:_([0-9]+))?\}`)
+
+// Checks the template only uses known placeholders
+func ValidatePathTemplate(template string) error {
+	for _, m := range templatePlaceholder.FindAllStringSubmatch(template, -1) {
+		switch name, n := m[1], m[2]; {
+		case name == "prefix" && len(n) != 0:
+		case len(n) == 0 && (name == "key" || name == "path" || name == "rel" || name == "basename" || name == "etag"):
+		default:
+			return fmt.Errorf("unknown placeholder %s in output template %q", m[0], template)
+		}
+	}
+	return nil
+}
+
+// Values the placeholders of an output path template are replaced with
+type pathVars struct {
+	// Object's key, or the file's path relative to the path being copied
+	Key string
+
+	// Key without the prefix's folder, the path used when there's no template
+	Path string
+
+	// Key without the prefix
+	Rel string
+
+	ETag string
+}
+
+func (v pathVars) expand(template string) string {
+	return templatePlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		m := templatePlaceholder.FindStringSubmatch(placeholder)
+		switch m[1] {
+		case "key":
+			return v.Key
+		case "path":
+			return v.Path
+		case "rel":
+			return v.Rel
+		case "basename":
+			return path.Base(v.Key)
+		case "etag":
+			return v.ETag
+		case "prefix":
+			// the first n folders of the key
+			n, _ := strconv.Atoi(m[2])
+			folders := strings.Split(path.Dir(v.Key), "/")
+			if path.Dir(v.Key) == "." {
+				folders = nil
+			}
+			if n > len(folders) {
+				n = len(folders)
+			}
+			return strings.Join(folders[:n], "/")
+		}
+		return placeholder
+	})
+}
+
+// Returns the path to write to, relative to the download path, after applying the template & rename rules
+func (m PathMapping) rewrite(v pathVars) string {
+	p := v.Path
+	if len(m.Template) != 0 {
+		p = v.expand(m.Template)
+	}
+	for _, rule := range m.Rules {
+		p = rule.Pattern.ReplaceAllString(p, rule.Replacement)
+	}
+	return p
+}
+
+// Whether paths are rewritten, rather than being the object's key without the prefix's folder
+func (m PathMapping) rewrites() bool {
+	return len(m.Template) != 0 || len(m.Rules) != 0
+}
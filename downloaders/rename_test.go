@@ -0,0 +1,185 @@
+package downloaders
+
+import (
+	"github.com/op/go-logging"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRenameRule(t *testing.T) {
+	tests := []struct {
+		rule     string
+		input    string
+		expected string
+	}{
+		{rule: "s/a/b/", input: "aaa", expected: "bbb"},
+		{rule: `s|date=(\d+)-(\d+)-(\d+)/|$1/$2/$3/|`, input: "date=2024-01-01/part-0.parquet", expected: "2024/01/01/part-0.parquet"},
+		{rule: `s/^[^\/]*\///`, input: "top/sub/file", expected: "sub/file"},
+		{rule: "s#(?P<dir>[^/]+)/(?P<file>.*)#${file}.${dir}#", input: "dir/file", expected: "file.dir"},
+		{rule: "s/x//", input: "axbx", expected: "ab"},
+	}
+
+	for _, test := range tests {
+		r, err := ParseRenameRule(test.rule)
+		if err != nil {
+			t.Errorf("%q: %v", test.rule, err)
+			continue
+		}
+		if actual := r.Pattern.ReplaceAllString(test.input, r.Replacement); actual != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.rule, test.expected, actual)
+		}
+	}
+
+	for _, rule := range []string{"", "s", "s/a/", "s/a/b", "s/a/b/c/", "y/a/b/", "s/(/b/"} {
+		if _, err := ParseRenameRule(rule); err == nil {
+			t.Errorf("%q: expected the rule to be rejected", rule)
+		}
+	}
+}
+
+func TestValidatePathTemplate(t *testing.T) {
+	for _, template := range []string{"", "{key}", "{path}", "{rel}", "flat/{basename}", "{prefix_2}/{etag}-{basename}"} {
+		if err := ValidatePathTemplate(template); err != nil {
+			t.Errorf("%q: %v", template, err)
+		}
+	}
+	for _, template := range []string{"{size}", "{prefix}", "{key_1}"} {
+		if err := ValidatePathTemplate(template); err == nil {
+			t.Errorf("%q: expected the template to be rejected", template)
+		}
+	}
+}
+
+func TestPathVarsExpand(t *testing.T) {
+	v := pathVars{
+		Key:  "data/date=2024-01-01/part-0.parquet",
+		Path: "date=2024-01-01/part-0.parquet",
+		Rel:  "2024-01-01/part-0.parquet",
+		ETag: "abc",
+	}
+	tests := map[string]string{
+		"{key}":                  "data/date=2024-01-01/part-0.parquet",
+		"{path}":                 "date=2024-01-01/part-0.parquet",
+		"{rel}":                  "2024-01-01/part-0.parquet",
+		"{basename}":             "part-0.parquet",
+		"{etag}/{basename}":      "abc/part-0.parquet",
+		"{prefix_1}/{basename}":  "data/part-0.parquet",
+		"{prefix_2}/{basename}":  "data/date=2024-01-01/part-0.parquet",
+		"{prefix_9}/{basename}":  "data/date=2024-01-01/part-0.parquet",
+		"{prefix_0}{basename}":   "part-0.parquet",
+		"literal {unknown} text": "literal {unknown} text",
+	}
+	for template, expected := range tests {
+		if actual := v.expand(template); actual != expected {
+			t.Errorf("%q: expected %q, got %q", template, expected, actual)
+		}
+	}
+
+	if actual := (pathVars{Key: "file"}).expand("{prefix_1}/{basename}"); actual != "/file" {
+		t.Errorf("Expected keys without folders to have an empty prefix, got %q", actual)
+	}
+}
+
+func TestPathMappingRewrite(t *testing.T) {
+	rule, err := ParseRenameRule(`s|date=(\d+)-(\d+)-(\d+)|$1/$2/$3|`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := pathVars{Key: "data/date=2024-01-01/part-0.parquet", Path: "date=2024-01-01/part-0.parquet"}
+
+	if actual := (PathMapping{}).rewrite(v); actual != v.Path {
+		t.Errorf("Expected the path to be used as is, got %q", actual)
+	}
+	if actual := (PathMapping{Rules: []RenameRule{rule}}).rewrite(v); actual != "2024/01/01/part-0.parquet" {
+		t.Errorf("Expected the rules to be applied to the path, got %q", actual)
+	}
+	if actual := (PathMapping{Template: "{key}", Rules: []RenameRule{rule}}).rewrite(v); actual != "data/2024/01/01/part-0.parquet" {
+		t.Errorf("Expected the rules to be applied after the template, got %q", actual)
+	}
+}
+
+func TestFilesystemDownloadRewrite(t *testing.T) {
+	rule, err := ParseRenameRule(`s|^\.\./||`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := FilesystemDownload{Mapping: PathMapping{Template: "../{basename}", Rules: []RenameRule{rule}}}
+	if name := d.rewrite(FileCopyJob{Readpath: "/src", Filepath: "/src/a/b.txt", Name: "b.txt"}); name != "b.txt" {
+		t.Errorf("Expected b.txt, got %q", name)
+	}
+
+	// Readpath is the file being copied
+	d.Mapping.Rules = nil
+	if name := d.rewrite(FileCopyJob{Readpath: "/src/a/b.txt", Filepath: "/src/a/b.txt", Name: "b.txt"}); name != "../b.txt" {
+		t.Errorf("Expected ../b.txt, got %q", name)
+	}
+}
+
+// Lists the files under src through listRewritten, returning the path of each file relative to src
+func listRewrittenTestPaths(t *testing.T, d FilesystemDownload, src string) (map[string]string, error) {
+	d.Readpath = src
+	d.MaxList = 10
+	d.Bar = newTestBar()
+	d.Log = logging.MustGetLogger("s3pd-test")
+
+	jobs := make(chan FileCopyJob, 10)
+	err := d.listRewritten(jobs)
+	close(jobs)
+	paths := map[string]string{}
+	for j := range jobs {
+		paths[j.Filepath[len(src)+1:]] = j.Path
+	}
+	return paths, err
+}
+
+func TestFilesystemDownloadListRewritten(t *testing.T) {
+	src := t.TempDir()
+	for _, name := range []string{"x/part-0.parquet", "y/part-0.parquet", "y/part-1.parquet"} {
+		path := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Flattening maps both part-0.parquet files to the same path
+	d := FilesystemDownload{Mapping: PathMapping{Conflicts: ConflictFail, Template: "{basename}"}}
+	paths, err := listRewrittenTestPaths(t, d, src)
+	if err == nil || !strings.Contains(err.Error(), filepath.Join(src, "x/part-0.parquet")) {
+		t.Errorf("Expected files mapped to the same path to fail, got %v", err)
+	}
+	if len(paths) != 0 {
+		t.Errorf("Nothing should be copied when there's conflicts, got %v", paths)
+	}
+
+	d.Mapping.Conflicts = ConflictRename
+	d.Mapping.RenameSuffix = ".file"
+	paths, err = listRewrittenTestPaths(t, d, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"x/part-0.parquet": "part-0.parquet.file",
+		"y/part-0.parquet": "part-0.parquet",
+		"y/part-1.parquet": "part-1.parquet",
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Expected %v, got %v", expected, paths)
+	}
+
+	// Rewritten paths can't leave the destination
+	d.Mapping.Template = "../{path}"
+	paths, err = listRewrittenTestPaths(t, d, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paths["x/part-0.parquet"] != "%2E%2E/x/part-0.parquet" {
+		t.Errorf("Expected %%2E%%2E/x/part-0.parquet, got %v", paths)
+	}
+}
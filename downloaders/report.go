@@ -0,0 +1,114 @@
+package downloaders
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// Tab separated report with a line per object, which can be written to by multiple workers
+type tsvReport struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *csv.Writer
+}
+
+// Returns a report which discards every line when path is empty
+func newTSVReport(path string, header ...string) (*tsvReport, error) {
+	if len(path) == 0 {
+		return &tsvReport{}, nil
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := csv.NewWriter(f)
+	w.Comma = '\t'
+	r := &tsvReport{f: f, w: w}
+	return r, r.Write(header...)
+}
+
+func (r *tsvReport) Write(fields ...string) error {
+	if r.w == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.w.Write(fields)
+}
+
+// Safe to call more than once
+func (r *tsvReport) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	f := r.f
+	r.f = nil
+
+	r.w.Flush()
+	if err := r.w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// JSON lines report with a line per object, which can be written to by multiple workers
+type jsonlReport struct {
+	mu  sync.Mutex
+	f   *os.File
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+// Returns a report which discards every line when path is empty
+func newJSONLReport(path string) (*jsonlReport, error) {
+	if len(path) == 0 {
+		return &jsonlReport{}, nil
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	return &jsonlReport{f: f, w: w, enc: json.NewEncoder(w)}, nil
+}
+
+// Whether lines are written anywhere
+func (r *jsonlReport) enabled() bool {
+	return r.enc != nil
+}
+
+func (r *jsonlReport) Write(v interface{}) error {
+	if r.enc == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.enc.Encode(v)
+}
+
+// Safe to call more than once
+func (r *jsonlReport) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	f := r.f
+	r.f = nil
+
+	if err := r.w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,155 @@
+package downloaders
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"strings"
+	"time"
+)
+
+// Where a S3 client gets its credentials from. When left empty the default credential chain is used:
+// environment variables, shared config & credential files, then the EC2 instance role.
+type S3Credentials struct {
+	// Named profile from the shared config & credential files
+	Profile string
+
+	// IAM role to assume, using the profile's (or default chain's) credentials
+	RoleARN         string
+	RoleSessionName string
+	ExternalID      string
+}
+
+// Settings used to build every S3 client s3pd creates
+type S3ClientConfig struct {
+	// Note, if region is an empty string, then will ignore the region value and use the region from system config
+	Region string
+
+	// Sends requests to an S3 compatible endpoint (E.g. MinIO, Ceph RGW, R2 or a VPC interface endpoint)
+	// instead of the AWS S3 endpoint for the region
+	EndpointURL string
+
+	// Addresses buckets as https://endpoint/bucket/key instead of https://bucket.endpoint/key
+	ForcePathStyle bool
+
+	NICs        []string
+	HTTP        HTTPOptions
+	Credentials S3Credentials
+
+	// Counts the requests made by API towards the run's summary when set
+	Summary *RunSummary
+
+	// Counts the requests in flight & bytes received towards the run's stats when set
+	Stats *Stats
+}
+
+// Creates a S3 client with the given settings
+func NewS3Client(ctx context.Context, c S3ClientConfig) (*s3.Client, error) {
+	opts := []func(*config.LoadOptions) error{config.WithRegion(c.Region)}
+	if len(c.Credentials.Profile) != 0 {
+		opts = append(opts, config.WithSharedConfigProfile(c.Credentials.Profile))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	// S3 compatible stores generally ignore the region, but requests still need one to be signed
+	if len(cfg.Region) == 0 && len(c.EndpointURL) != 0 {
+		cfg.Region = "us-east-1"
+	}
+
+	// If Multiple NICs requested, this is our custom multi-nic http-client
+	httpClient, err := NewHTTPClient(c.NICs, c.HTTP)
+	if err != nil {
+		return nil, err
+	}
+	if c.Stats != nil {
+		httpClient = statsHTTPClient{client: httpClient, stats: c.Stats}
+	}
+	cfg.HTTPClient = httpClient
+
+	if len(c.Credentials.RoleARN) != 0 {
+		cfg.Credentials = assumeRoleCredentials(cfg, c.Credentials)
+	}
+	if cfg.Credentials != nil {
+		cfg.Credentials = credentialsErrorProvider{provider: cfg.Credentials}
+	}
+
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if len(c.EndpointURL) != 0 {
+			o.BaseEndpoint = aws.String(c.EndpointURL)
+
+			// Many S3 compatible stores don't support the flexible checksums the SDK sends & validates by default
+			o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
+			o.ResponseChecksumValidation = aws.ResponseChecksumValidationWhenRequired
+		}
+		o.UsePathStyle = c.ForcePathStyle
+		o.APIOptions = append(o.APIOptions, addTransferStatsMiddleware)
+		if c.Summary != nil {
+			o.APIOptions = append(o.APIOptions, c.Summary.countRequests)
+		}
+	}), nil
+}
+
+// Returns credentials for the role, which the cache refreshes before they expire
+// so that multi-hour transfers keep working
+func assumeRoleCredentials(cfg aws.Config, c S3Credentials) aws.CredentialsProvider {
+	provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), c.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = c.RoleSessionName
+		if len(c.ExternalID) != 0 {
+			o.ExternalID = aws.String(c.ExternalID)
+		}
+	})
+
+	return aws.NewCredentialsCache(provider, func(o *aws.CredentialsCacheOptions) {
+		o.ExpiryWindow = 5 * time.Minute
+	})
+}
+
+// Error from getting the credentials requests are signed with, E.g. when none could be found or the role couldn't be assumed
+type CredentialsError struct {
+	Err error
+}
+
+func (e *CredentialsError) Error() string {
+	return "get credentials: " + e.Err.Error()
+}
+
+func (e *CredentialsError) Unwrap() error {
+	return e.Err
+}
+
+// Returns the provider's errors as a CredentialsError, as the SDK doesn't give them a type of their own
+type credentialsErrorProvider struct {
+	provider aws.CredentialsProvider
+}
+
+func (p credentialsErrorProvider) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	creds, err := p.provider.Retrieve(ctx)
+	if err != nil {
+		return creds, &CredentialsError{Err: err}
+	}
+	return creds, nil
+}
+
+// S3 Express One Zone directory buckets are named "bucket-base-name--zone-id--x-s3".
+// The SDK authenticates requests to them using CreateSession, caching & refreshing the session credentials.
+func IsDirectoryBucket(bucket string) bool {
+	return strings.HasSuffix(bucket, "--x-s3")
+}
+
+// Directory buckets can only list prefixes ending in a "/". Returns the folder containing the prefix,
+// keys listed from it then need filtering by the full prefix.
+// Note, directory buckets don't return keys in lexicographical order.
+func directoryListPrefix(prefix string) string {
+	i := strings.LastIndex(prefix, "/")
+	if i == -1 {
+		return ""
+	}
+	return prefix[:i+1]
+}
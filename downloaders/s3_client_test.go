@@ -0,0 +1,63 @@
+package downloaders
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsDirectoryBucket(t *testing.T) {
+	if !IsDirectoryBucket("mybucket--usw2-az1--x-s3") {
+		t.Error("Expected --x-s3 suffixed bucket to be a directory bucket")
+	}
+	if IsDirectoryBucket("mybucket") || IsDirectoryBucket("my-ap-hrzrlukc5m36ft7okagglf3gmwluquse1b-s3alias") {
+		t.Error("Expected general purpose buckets & aliases to not be directory buckets")
+	}
+}
+
+func TestDirectoryListPrefix(t *testing.T) {
+	tests := map[string]string{
+		"":                  "",
+		"data":              "",
+		"data/":             "data/",
+		"data/part-":        "data/",
+		"data/2024/01/file": "data/2024/01/",
+	}
+	for prefix, expected := range tests {
+		if actual := directoryListPrefix(prefix); actual != expected {
+			t.Errorf("directoryListPrefix(%q) = %q, expected %q", prefix, actual, expected)
+		}
+	}
+}
+
+func TestCredentialsError(t *testing.T) {
+	// no credentials anywhere in the default chain
+	missing := filepath.Join(t.TempDir(), "missing")
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("AWS_CONFIG_FILE", missing)
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", missing)
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "")
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", "")
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", "")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	client, err := NewS3Client(context.Background(), S3ClientConfig{EndpointURL: server.URL, ForcePathStyle: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.HeadObject(context.Background(), &s3.HeadObjectInput{Bucket: aws.String("bucket"), Key: aws.String("key")})
+	var credsErr *CredentialsError
+	if !errors.As(err, &credsErr) {
+		t.Errorf("Expected a CredentialsError, got %v", err)
+	}
+}
@@ -3,7 +3,6 @@ package downloaders
 import (
 	"context"
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	s3manager "github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
@@ -11,8 +10,10 @@ import (
 	"github.com/op/go-logging"
 	"golang.org/x/sync/errgroup"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -20,85 +21,295 @@ type S3Download struct {
 	Bucket      string
 	Prefix      string
 	Writepath   string
-	Region      string
 	Workers     uint
 	Threads     uint
 	Partsize    int64
 	MaxList     int
 	IsBenchmark bool
-	NICs        []string
-	Bar         *pb.ProgressBar
-	Log         *logging.Logger
-	StartTime   time.Time
+	Client      S3ClientConfig
+	Request     S3RequestOptions
+
+	// Download the newest version of each object as of this time, when not zero
+	AsOf time.Time
+
+	// Download this version of the single object at Prefix, when set
+	VersionId string
+
+	Restore S3RestoreOptions
+
+	// How keys are mapped to the paths objects are written to
+	Mapping       PathMapping
+	mappingReport *tsvReport
+
+	// Paths written by extracted archive entries & the objects alongside them, with Extract
+	extracted *extractedPaths
+
+	// Destination roots objects are spread across, when writing to more than one
+	Stripe StripeOptions
+	stripe *striper
+
+	// Objects are written to Stream one after another, in key order, rather than to files when set. E.g. os.Stdout.
+	// Archived objects being restored are written once they've been restored, so out of order
+	Stream io.Writer
+
+	// Bytes of each object being streamed that can be fetched ahead of what's been written, 2 * Threads parts when 0
+	StreamWindow int64
+
+	// Decompress gzip & zstd objects, found by their extension or Content-Encoding, as they're downloaded
+	Decompress bool
+
+	// Unpack .tar, .tar.gz & .tar.zst objects into the folder they'd be written to, rather than writing the archive
+	Extract bool
+
+	// Download only this range of the single object at Prefix, when set
+	Range *ByteRange
+
+	// Objects are packed into tar shards under Writepath rather than written to files of their own when enabled
+	Pack      PackOptions
+	packIndex *tsvReport
+
+	// Objects are concatenated, in key order, into this file rather than written to files of their own when set
+	Concat     string
+	concatFile *os.File
+
+	// Writes a JSON line per object downloaded, with where it was written & how it was transferred, to this file when set
+	Manifest string
+	manifest *jsonlReport
+
+	// Counts the objects downloaded, skipped & failed, and the requests made, when set
+	Summary *RunSummary
+
+	// Set downloaded files' mtime to the object's LastModified time
+	PreserveMtime bool
+
+	// Store the object's ETag, Content-Type & user metadata, and optionally tags, in the file's user.s3.* xattrs
+	Xattrs    bool
+	XattrTags bool
+
+	Bar   *pb.ProgressBar
+	Log   *logging.Logger
+	stats *Stats
+}
+
+// Object listed from S3 that's queued to be downloaded
+type S3ObjectJob struct {
+	Key          string
+	VersionId    string
+	Size         int64
+	ETag         string
+	LastModified time.Time
+	StorageClass string
+
+	// Path the object is written to, and the destination root it's under, set once the object's key has been mapped
+	Path string
+	Root string
+
+	// Offset the object is written at when concatenating objects into one file, or packing them into shards
+	Offset int64
+
+	// Shard the object is packed into
+	shard *packShard
+}
+
+func newS3ObjectJob(o s3types.Object) S3ObjectJob {
+	return S3ObjectJob{
+		Key:          aws.ToString(o.Key),
+		Size:         aws.ToInt64(o.Size),
+		ETag:         trimETag(aws.ToString(o.ETag)),
+		LastModified: aws.ToTime(o.LastModified),
+		StorageClass: string(o.StorageClass),
+	}
+}
+
+// S3 returns ETags wrapped in quotes
+func trimETag(etag string) string {
+	return strings.Trim(etag, "\"")
 }
 
 func (d *S3Download) Start(ctx context.Context) error {
-	d.StartTime = time.Now()
+	d.stats = newStats()
+	defer d.stats.finish()
+
+	// Keep enough idle connections around for every concurrent request, otherwise
+	// connections get closed & re-opened between each part downloaded
+	clientConfig := d.Client
+	if clientConfig.HTTP.MaxIdleConnsPerHost == 0 {
+		clientConfig.HTTP.MaxIdleConnsPerHost = int(d.Workers * d.Threads)
+	}
+	clientConfig.Summary = d.Summary
+	clientConfig.Stats = d.stats
 
 	// Create s3 client
-	// Note, if region is an empty string, then will ignore the region value and use the region from system config
-	cfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(d.Region))
+	s3Client, err := NewS3Client(ctx, clientConfig)
 	if err != nil {
 		return err
 	}
 
-	// If Multiple NICs requested, use our custom multi-nic http-client
-	if len(d.NICs) != 0 {
-		mnHTTPClient, err := NewMultiNicHTTPClient(d.NICs)
+	if len(d.Concat) != 0 {
+		if err := os.MkdirAll(filepath.Dir(d.Concat), os.ModePerm); err != nil {
+			return err
+		}
+		f, err := os.Create(d.Concat)
 		if err != nil {
 			return err
 		}
-		cfg.HTTPClient = mnHTTPClient
+		defer f.Close()
+		d.concatFile = f
 	}
 
-	s3Client := s3.NewFromConfig(cfg)
+	if d.manifest, err = newJSONLReport(d.Manifest); err != nil {
+		return err
+	}
+	defer d.manifest.Close()
+
+	if d.stripe, err = newStriper(d.Writepath, d.Stripe); err != nil {
+		return err
+	}
+	defer d.stripe.Close()
+
+	if d.mappingReport, err = newTSVReport(d.Mapping.Report, "key", "path", "decision"); err != nil {
+		return err
+	}
+	defer d.mappingReport.Close()
+	index := ""
+	if d.Pack.Enabled {
+		if err := os.MkdirAll(d.Writepath, os.ModePerm); err != nil {
+			return err
+		}
+		index = filepath.Join(d.Writepath, packIndexName)
+	}
+	if d.packIndex, err = newTSVReport(index, "key", "shard", "offset", "size"); err != nil {
+		return err
+	}
+	defer d.packIndex.Close()
+
+	if d.Extract && !d.IsBenchmark {
+		d.extracted = newExtractedPaths(d.Mapping, d.mappingReport)
+	}
 
 	// Instantiate download workers
 	// Set job's channel length to 3x max objects we'll get in a list op
 	// if the job queue ends up filling up, we'll stall doing additional list ops until the queue has more messages completed
-	jobs := make(chan s3types.Object, d.MaxList*3)
+	jobs := make(chan S3ObjectJob, d.MaxList*3)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	eg, ctx := errgroup.WithContext(ctx)
 	downloader := s3manager.NewDownloader(s3Client, func(s3md *s3manager.Downloader) {
 		s3md.PartSize = d.Partsize
 		s3md.Concurrency = int(d.Threads)
 		s3md.BufferProvider = s3manager.NewPooledBufferedWriterReadFromProvider(int(d.Partsize))
 	})
-	for w := 1; w <= int(d.Workers); w++ {
+	// Objects are streamed one at a time so that they're written in order
+	workers := int(d.Workers)
+	if d.Stream != nil {
+		workers = 1
+	}
+	for w := 1; w <= workers; w++ {
+		w := w
 		eg.Go(func() error {
-			return d.worker(int(w), downloader, jobs)
+			return d.worker(ctx, int(w), s3Client, downloader, jobs)
 		})
 	}
 
 	// Start the progress bar
 	d.Bar.Start()
 
+	// When restoring archived objects, listed objects go through the restorer before being downloaded
+	mapped := jobs
+	if d.Restore.Enabled {
+		mapped = make(chan S3ObjectJob, d.MaxList*3)
+		eg.Go(func() error {
+			return d.restore(ctx, s3Client, mapped, jobs)
+		})
+	}
+
+	// Listed objects have their keys mapped to paths, or offsets in the concatenated file, before being restored or downloaded.
+	// Streamed objects are put in key order instead, and nothing is written to files when benchmarking, so there's nothing to map
+	listed := mapped
+	if d.concatFile != nil {
+		listed = make(chan S3ObjectJob, d.MaxList*3)
+		eg.Go(func() error {
+			return d.concatOffsets(ctx, listed, mapped)
+		})
+	} else if d.Pack.Enabled {
+		listed = make(chan S3ObjectJob, d.MaxList*3)
+		eg.Go(func() error {
+			return d.packShards(ctx, listed, mapped)
+		})
+	} else if d.Stream != nil {
+		listed = make(chan S3ObjectJob, d.MaxList*3)
+		eg.Go(func() error {
+			return d.streamOrder(ctx, listed, mapped)
+		})
+	} else if !d.IsBenchmark {
+		listed = make(chan S3ObjectJob, d.MaxList*3)
+		eg.Go(func() error {
+			return d.mapPaths(ctx, listed, mapped)
+		})
+	}
+
 	// Queue up download tasks
-	if err := d.list(s3Client, jobs); err != nil {
-		// if error clean up workers and return the error
-		close(jobs)
-		ctx.Done()
+	list := d.list
+	if len(d.VersionId) != 0 || d.Range != nil {
+		list = d.headObject
+	} else if !d.AsOf.IsZero() {
+		list = d.listVersions
+	}
+	if err := list(s3Client, listed); err != nil {
+		// if error stop the workers, and wait for them to exit before returning the error
+		cancel()
+		close(listed)
+		eg.Wait()
 		return err
 	}
 
 	// Indicate that we listed every single object and there's no more objs needing to be queued
-	close(jobs)
+	close(listed)
 
 	// Wait till all downloads finish, or until we get our first error
 	if err := eg.Wait(); err != nil {
 		return err
 	}
 
+	if d.concatFile != nil {
+		if err := d.concatFile.Close(); err != nil {
+			return err
+		}
+	}
+	if err := d.manifest.Close(); err != nil {
+		return err
+	}
+	if err := d.stripe.Close(); err != nil {
+		return err
+	}
+	if err := d.mappingReport.Close(); err != nil {
+		return err
+	}
+	if err := d.packIndex.Close(); err != nil {
+		return err
+	}
+
 	d.Bar.Finish()
 	return nil
 }
 
-func (d S3Download) list(client *s3.Client, jobs chan<- s3types.Object) error {
+func (d S3Download) list(client *s3.Client, jobs chan<- S3ObjectJob) error {
 	d.Log.Debugf("Listing objects with the prefix of s3://%s/%s\n", d.Bucket, d.Prefix)
-	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+
+	// Directory buckets only support listing prefixes ending in a "/", so list the prefix's
+	// folder and filter out the keys that don't match the full prefix
+	listPrefix := d.Prefix
+	if IsDirectoryBucket(d.Bucket) {
+		listPrefix = directoryListPrefix(d.Prefix)
+	}
+
+	input := &s3.ListObjectsV2Input{
 		Bucket:  &d.Bucket,
-		Prefix:  &d.Prefix,
-		MaxKeys: int32(d.MaxList),
-	})
+		Prefix:  &listPrefix,
+		MaxKeys: aws.Int32(int32(d.MaxList)),
+	}
+	d.Request.applyList(input)
+	paginator := s3.NewListObjectsV2Paginator(client, input)
 
 	var numBytes int64 = 0
 	for paginator.HasMorePages() {
@@ -109,60 +320,196 @@ func (d S3Download) list(client *s3.Client, jobs chan<- s3types.Object) error {
 
 		d.Log.Debugf("Scheduling %d objects to be downloaded\n", len(page.Contents))
 		for _, item := range page.Contents {
-			jobs <- item
-			numBytes += item.Size // size in Bytes
+			if !strings.HasPrefix(*item.Key, d.Prefix) {
+				continue
+			}
+			if isArchived(string(item.StorageClass)) && !d.Restore.Enabled {
+				d.Log.Warningf("s3://%s/%s is in %s and will fail to download unless restored, see --restore\n",
+					d.Bucket, *item.Key, item.StorageClass)
+			}
+			jobs <- newS3ObjectJob(item)
+			numBytes += aws.ToInt64(item.Size) // size in Bytes
 		}
 		d.Bar.SetTotal(numBytes)
 	}
 	return nil
 }
 
-func (d S3Download) worker(id int, downloader *s3manager.Downloader, jobs <-chan s3types.Object) error {
-	// filepath.Dir returns "." if there's no dir in the path
-	prefixDir := filepath.Dir(d.Prefix)
-	if prefixDir == "." {
-		prefixDir = ""
-	}
-
+func (d S3Download) worker(ctx context.Context, id int, client *s3.Client, downloader *s3manager.Downloader, jobs <-chan S3ObjectJob) error {
 	for j := range jobs {
-		objWritePath := filepath.Join(d.Writepath, (*j.Key)[len(prefixDir):])
+		objCtx, transfer := withTransferStats(ctx)
+		e := manifestEntry{Key: j.Key, VersionId: j.VersionId, ETag: j.ETag, Size: j.Size, Start: time.Now()}
+		written, err := d.download(objCtx, id, client, downloader, j)
+		if err != nil {
+			d.Summary.objectFailed()
+			return err
+		}
+		d.Summary.objectDone(j.Size, time.Since(e.Start))
+		if err := recordTransfer(d.manifest, e, written, transfer); err != nil {
+			return err
+		}
+		// only objects that have been written are in the stripe manifest
+		if len(j.Root) != 0 {
+			if err := d.stripe.record(j.Key, j.Root, written.Dest); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
 
-		d.Log.Debugf("worker-%d writing s3://%s/%s to %s [%.2fMiB]\n",
-			id,
-			d.Bucket, *j.Key,
-			objWritePath,
-			(float64(j.Size) / 1024 / 1024))
+// Downloads the object, returning where it was written
+func (d S3Download) download(ctx context.Context, id int, client *s3.Client, downloader *s3manager.Downloader, j S3ObjectJob) (writtenObject, error) {
+	c := d.objectCompression(j)
+	var err error
 
-		var w io.WriterAt
-		if d.IsBenchmark {
-			w = NewDiscardWriteBuffer()
+	if d.Stream != nil {
+		d.Log.Debugf("worker-%d streaming s3://%s/%s [%.2fMiB]\n", id, d.Bucket, j.Key, float64(j.Size)/1024/1024)
+		if c != compressionNone {
+			err = d.decompressObject(ctx, client, j, c, d.Stream)
 		} else {
-			// ensure dir is created. MkdirAll returns nil if folder already exists
-			if err := os.MkdirAll(filepath.Dir(objWritePath), os.ModePerm); err != nil {
-				return err
-			}
+			err = d.streamObject(ctx, client, j, d.Stream)
+		}
+		return writtenObject{Dest: "-"}, err
+	}
 
-			var err error
-			w, err = os.Create(objWritePath)
-			if err != nil {
-				return err
-			}
+	if j.shard != nil {
+		d.Log.Debugf("worker-%d writing s3://%s/%s to %s at offset %d [%.2fMiB]\n",
+			id, d.Bucket, j.Key, j.Path, j.Offset, float64(j.Size)/1024/1024)
+		crc := d.writtenCRC()
+		return writtenObject{Dest: j.Path, CRC: crc, Size: j.Size}, d.packObject(ctx, downloader, j, crc)
+	}
+
+	if d.concatFile != nil {
+		d.Log.Debugf("worker-%d writing s3://%s/%s to %s at offset %d [%.2fMiB]\n",
+			id, d.Bucket, j.Key, d.Concat, j.Offset, float64(j.Size)/1024/1024)
+		crc := d.writtenCRC()
+		return writtenObject{Dest: d.Concat, CRC: crc, Size: j.Size},
+			d.downloadAt(ctx, client, crcWriterAt{w: d.concatFile, crc: crc, base: j.Offset}, j.Offset, j)
+	}
+
+	objWritePath := j.Path
+	if d.IsBenchmark {
+		objWritePath = filepath.Join(d.Writepath, d.relativePath(j.Key))
+	}
+
+	d.Log.Debugf("worker-%d writing s3://%s/%s to %s [%.2fMiB]\n",
+		id,
+		d.Bucket, j.Key,
+		objWritePath,
+		(float64(j.Size) / 1024 / 1024))
+
+	if isDirectoryMarker(j.Key) && !d.IsBenchmark {
+		if j.Size != 0 {
+			d.Log.Warningf("Skipping the %d bytes in directory marker s3://%s/%s\n", j.Size, d.Bucket, j.Key)
+			d.Bar.Add64(j.Size)
 		}
+		return writtenObject{Dest: objWritePath}, os.MkdirAll(objWritePath, os.ModePerm)
+	}
 
-		w = NewLogProgressWriteBuffer(d.Bar, w)
+	if c, ok := d.archiveCompression(j.Key); ok {
+		dir := filepath.Dir(objWritePath)
+		return writtenObject{Dest: dir}, d.extractObject(ctx, client, j, c, dir)
+	}
+
+	// an archive entry may already have been written to the object's path
+	if objWritePath, err = d.extracted.objectPath(j.Key, d.objectRoot(j), objWritePath); err != nil {
+		return writtenObject{}, err
+	}
+
+	var w io.WriterAt
+	var f *os.File
+	var crc *writtenCRC
+	if d.IsBenchmark {
+		w = NewDiscardWriteBuffer()
+	} else {
+		// ensure dir is created. MkdirAll returns nil if folder already exists
+		if err := os.MkdirAll(filepath.Dir(objWritePath), os.ModePerm); err != nil {
+			return writtenObject{}, err
+		}
+
+		var err error
+		f, err = os.Create(objWritePath)
+		if err != nil {
+			return writtenObject{}, err
+		}
+		crc = d.writtenCRC()
+		w = crcWriterAt{w: f, crc: crc}
+	}
 
-		_, err := downloader.Download(context.Background(), w, &s3.GetObjectInput{
+	if d.Range != nil {
+		err = d.downloadAt(ctx, client, w, 0, j)
+	} else if c != compressionNone {
+		var out io.Writer = ioutil.Discard
+		if f != nil {
+			out = crcWriter{w: f, crc: crc}
+		}
+		err = d.decompressObject(ctx, client, j, c, out)
+	} else {
+		input := &s3.GetObjectInput{
 			Bucket: aws.String(d.Bucket),
-			Key:    j.Key,
-		})
+			Key:    aws.String(j.Key),
+		}
+		if len(j.VersionId) != 0 {
+			input.VersionId = aws.String(j.VersionId)
+		}
+		d.Request.applyGet(input)
+		_, err = downloader.Download(ctx, NewLogProgressWriteBuffer(d.Bar, statsWriterAt{w: w, stats: d.stats}), input)
+	}
+	if f != nil {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
 
+	if err != nil {
+		return writtenObject{}, err
+	}
+
+	if d.IsBenchmark {
+		return writtenObject{Dest: objWritePath}, nil
+	}
+	return writtenObject{Dest: objWritePath, CRC: crc, Size: -1}, d.preserveMetadata(client, j, objWritePath, c)
+}
+
+// Returns a checksum of an object's bytes as they're written, or nil when there's no manifest to record it in
+func (d S3Download) writtenCRC() *writtenCRC {
+	if !d.manifest.enabled() {
+		return nil
+	}
+	return newWrittenCRC()
+}
+
+// Returns the destination root the object's written under
+func (d S3Download) objectRoot(j S3ObjectJob) string {
+	if len(j.Root) != 0 {
+		return j.Root
+	}
+	return d.Writepath
+}
+
+// Copies the object's metadata to the downloaded file, which was decompressed unless c is compressionNone
+func (d S3Download) preserveMetadata(client *s3.Client, j S3ObjectJob, path string, c compression) error {
+	if d.Xattrs {
+		m, err := d.objectMetadata(context.Background(), client, j)
 		if err != nil {
 			return err
 		}
+		// the file's no longer encoded, so uploading it with its xattrs mustn't mark it as gzip again
+		if c != compressionNone {
+			m.ContentEncoding = ""
+		}
+		if err := writeMetadataXattrs(path, m); err != nil {
+			return err
+		}
+	}
+
+	if d.PreserveMtime && !j.LastModified.IsZero() {
+		return os.Chtimes(path, j.LastModified, j.LastModified)
 	}
 	return nil
 }
 
-func (d S3Download) Throughput() float64 {
-	return float64(d.Bar.Total()) * 8 / 1024 / 1024 / 1024 / time.Since(d.StartTime).Seconds()
+func (d S3Download) Stats() *Stats {
+	return d.stats
 }
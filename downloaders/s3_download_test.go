@@ -0,0 +1,113 @@
+package downloaders
+
+import (
+	"bytes"
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/cheggaaa/pb/v3"
+	"github.com/op/go-logging"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Tests run against an S3 compatible store such-as a local MinIO container. E.g.
+//
+//	docker run -p 9000:9000 -e MINIO_ROOT_USER=minio -e MINIO_ROOT_PASSWORD=minio123 minio/minio server /data
+//	AWS_ACCESS_KEY_ID=minio AWS_SECRET_ACCESS_KEY=minio123 S3PD_TEST_ENDPOINT=http://localhost:9000 go test ./...
+func testS3ClientConfig(t *testing.T) S3ClientConfig {
+	endpoint := os.Getenv("S3PD_TEST_ENDPOINT")
+	if len(endpoint) == 0 {
+		t.Skip("S3PD_TEST_ENDPOINT not set, skipping tests against an S3 compatible store")
+	}
+	return S3ClientConfig{EndpointURL: endpoint, ForcePathStyle: true}
+}
+
+// Creates the test bucket, and uploads the given objects to it
+func createTestObjects(t *testing.T, client *s3.Client, bucket string, objects map[string][]byte) {
+	// Bucket might be left over from a previous run
+	client.CreateBucket(context.Background(), &s3.CreateBucketInput{Bucket: aws.String(bucket)})
+
+	for key, body := range objects {
+		_, err := client.PutObject(context.Background(), &s3.PutObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader(body),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func newTestBar() *pb.ProgressBar {
+	bar := pb.New(1)
+	bar.SetWriter(ioutil.Discard)
+	return bar
+}
+
+func TestS3DownloadCustomEndpoint(t *testing.T) {
+	clientConfig := testS3ClientConfig(t)
+	client, err := NewS3Client(context.Background(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	objects := map[string][]byte{
+		"dataset/a.bin":     bytes.Repeat([]byte("a"), 3*1024*1024),
+		"dataset/sub/b.bin": bytes.Repeat([]byte("b"), 1024),
+		"dataset/sub/c.bin": []byte{},
+	}
+	createTestObjects(t, client, "s3pd-test", objects)
+
+	dir := t.TempDir()
+	d := S3Download{
+		Bucket:    "s3pd-test",
+		Prefix:    "dataset/",
+		Writepath: dir,
+		Workers:   2,
+		Threads:   2,
+		Partsize:  1024 * 1024,
+		MaxList:   2,
+		Client:    clientConfig,
+		Bar:       newTestBar(),
+		Log:       logging.MustGetLogger("s3pd-test"),
+	}
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, body := range objects {
+		data, err := ioutil.ReadFile(filepath.Join(dir, strings.TrimPrefix(key, "dataset/")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, body) {
+			t.Errorf("Downloaded %s doesn't match the uploaded object", key)
+		}
+	}
+}
+
+func TestS3DownloadListError(t *testing.T) {
+	clientConfig := testS3ClientConfig(t)
+
+	dir := t.TempDir()
+	d := S3Download{
+		Bucket:    "s3pd-test-missing-bucket",
+		Writepath: dir,
+		Manifest:  filepath.Join(dir, "manifest.jsonl"),
+		Workers:   2,
+		Threads:   2,
+		Partsize:  1024 * 1024,
+		MaxList:   2,
+		Client:    clientConfig,
+		Bar:       newTestBar(),
+		Log:       logging.MustGetLogger("s3pd-test"),
+	}
+	if err := d.Start(context.Background()); err == nil {
+		t.Fatal("expected listing a missing bucket to fail")
+	}
+}
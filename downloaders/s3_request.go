@@ -0,0 +1,112 @@
+package downloaders
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Settings applied to every List, Head & Get request s3pd makes
+type S3RequestOptions struct {
+	// Acknowledges that we'll be charged for requests to a requester-pays bucket
+	RequesterPays bool
+
+	// Fails requests with a 403 when the bucket isn't owned by this AWS account ID
+	ExpectedBucketOwner string
+
+	// Algorithm the objects were encrypted with using SSE-C, "AES256"
+	SSECustomerAlgorithm string
+	// Base64 encoded key the objects were encrypted with using SSE-C
+	SSECustomerKey string
+}
+
+func (o S3RequestOptions) requestPayer() s3types.RequestPayer {
+	if o.RequesterPays {
+		return s3types.RequestPayerRequester
+	}
+	return ""
+}
+
+func (o S3RequestOptions) expectedBucketOwner() *string {
+	if len(o.ExpectedBucketOwner) == 0 {
+		return nil
+	}
+	return aws.String(o.ExpectedBucketOwner)
+}
+
+// Returns the SSE-C algorithm, key and the key's MD5 digest, all nil if SSE-C isn't used
+func (o S3RequestOptions) sseCustomer() (algorithm, key, keyMD5 *string) {
+	if len(o.SSECustomerKey) == 0 {
+		return nil, nil, nil
+	}
+
+	// Key is validated when parsing flags
+	raw, _ := base64.StdEncoding.DecodeString(o.SSECustomerKey)
+	digest := md5.Sum(raw)
+	return aws.String(o.SSECustomerAlgorithm), aws.String(o.SSECustomerKey),
+		aws.String(base64.StdEncoding.EncodeToString(digest[:]))
+}
+
+func (o S3RequestOptions) applyList(in *s3.ListObjectsV2Input) {
+	in.RequestPayer = o.requestPayer()
+	in.ExpectedBucketOwner = o.expectedBucketOwner()
+}
+
+func (o S3RequestOptions) applyListVersions(in *s3.ListObjectVersionsInput) {
+	in.RequestPayer = o.requestPayer()
+	in.ExpectedBucketOwner = o.expectedBucketOwner()
+}
+
+func (o S3RequestOptions) applyRestore(in *s3.RestoreObjectInput) {
+	in.RequestPayer = o.requestPayer()
+	in.ExpectedBucketOwner = o.expectedBucketOwner()
+}
+
+func (o S3RequestOptions) applyGetTagging(in *s3.GetObjectTaggingInput) {
+	in.RequestPayer = o.requestPayer()
+	in.ExpectedBucketOwner = o.expectedBucketOwner()
+}
+
+func (o S3RequestOptions) applyHead(in *s3.HeadObjectInput) {
+	in.RequestPayer = o.requestPayer()
+	in.ExpectedBucketOwner = o.expectedBucketOwner()
+	in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = o.sseCustomer()
+}
+
+func (o S3RequestOptions) applyGet(in *s3.GetObjectInput) {
+	in.RequestPayer = o.requestPayer()
+	in.ExpectedBucketOwner = o.expectedBucketOwner()
+	in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = o.sseCustomer()
+}
+
+// Requests made when uploading to S3 use the same bucket owner & SSE-C settings
+func (o S3RequestOptions) applyPut(in *s3.PutObjectInput) {
+	in.RequestPayer = o.requestPayer()
+	in.ExpectedBucketOwner = o.expectedBucketOwner()
+	in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = o.sseCustomer()
+}
+
+func (o S3RequestOptions) applyCreateMultipartUpload(in *s3.CreateMultipartUploadInput) {
+	in.RequestPayer = o.requestPayer()
+	in.ExpectedBucketOwner = o.expectedBucketOwner()
+	in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = o.sseCustomer()
+}
+
+func (o S3RequestOptions) applyUploadPart(in *s3.UploadPartInput) {
+	in.RequestPayer = o.requestPayer()
+	in.ExpectedBucketOwner = o.expectedBucketOwner()
+	in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = o.sseCustomer()
+}
+
+func (o S3RequestOptions) applyCompleteMultipartUpload(in *s3.CompleteMultipartUploadInput) {
+	in.RequestPayer = o.requestPayer()
+	in.ExpectedBucketOwner = o.expectedBucketOwner()
+	in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = o.sseCustomer()
+}
+
+func (o S3RequestOptions) applyAbortMultipartUpload(in *s3.AbortMultipartUploadInput) {
+	in.RequestPayer = o.requestPayer()
+	in.ExpectedBucketOwner = o.expectedBucketOwner()
+}
@@ -0,0 +1,35 @@
+package downloaders
+
+import (
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"testing"
+)
+
+func TestS3RequestOptions(t *testing.T) {
+	o := S3RequestOptions{
+		RequesterPays:        true,
+		ExpectedBucketOwner:  "111111111111",
+		SSECustomerAlgorithm: "AES256",
+		SSECustomerKey:       "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=",
+	}
+
+	get := &s3.GetObjectInput{}
+	o.applyGet(get)
+	if get.RequestPayer != "requester" || *get.ExpectedBucketOwner != "111111111111" {
+		t.Errorf("Request payer & bucket owner not set: %q %q", get.RequestPayer, *get.ExpectedBucketOwner)
+	}
+	if *get.SSECustomerAlgorithm != "AES256" || *get.SSECustomerKey != o.SSECustomerKey {
+		t.Errorf("SSE-C algorithm & key not set: %q %q", *get.SSECustomerAlgorithm, *get.SSECustomerKey)
+	}
+	// echo -n 0123456789abcdef0123456789abcdef | openssl md5 -binary | base64
+	if *get.SSECustomerKeyMD5 != "hRasmdxgYDKV3nvbahU1MA==" {
+		t.Errorf("Unexpected SSE-C key MD5: %q", *get.SSECustomerKeyMD5)
+	}
+
+	// Without options set, requests should be left untouched
+	head := &s3.HeadObjectInput{}
+	S3RequestOptions{}.applyHead(head)
+	if head.RequestPayer != "" || head.ExpectedBucketOwner != nil || head.SSECustomerKey != nil {
+		t.Errorf("Expected no request options set: %+v", head)
+	}
+}
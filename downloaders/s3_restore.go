@@ -0,0 +1,237 @@
+package downloaders
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How objects in the GLACIER & DEEP_ARCHIVE storage classes are restored before being downloaded
+type S3RestoreOptions struct {
+	Enabled bool
+
+	// Retrieval tier: Expedited, Standard or Bulk
+	Tier string
+
+	// Number of days the restored copy is kept available for
+	Days int32
+
+	// How often the objects being restored are checked for availability
+	PollInterval time.Duration
+}
+
+// Objects in these storage classes need to be restored before they can be downloaded
+func isArchived(storageClass string) bool {
+	return storageClass == string(s3types.StorageClassGlacier) ||
+		storageClass == string(s3types.StorageClassDeepArchive)
+}
+
+// Moves objects from the listed channel to the jobs channel. Archived objects are restored,
+// and only moved over once the restored copy is available. Non-archived objects are moved over straight away
+// Closes jobs once every listed object has been moved over.
+func (d S3Download) restore(ctx context.Context, client *s3.Client, listed <-chan S3ObjectJob, jobs chan<- S3ObjectJob) error {
+	defer close(jobs)
+
+	// Stop restoring & polling on the first error
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make(chan error, 1)
+	fail := func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+		cancel()
+	}
+
+	r := restorer{d: d, client: client}
+
+	// Issue the RestoreObject requests concurrently
+	restores := make(chan S3ObjectJob, d.MaxList)
+	var wg sync.WaitGroup
+	for w := 1; w <= int(d.Workers); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range restores {
+				if ctx.Err() != nil {
+					continue
+				}
+				if err := r.start(ctx, j, jobs); err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+	// Poll the objects being restored until they're available
+	pollDone := make(chan struct{})
+	restoresDone := make(chan struct{})
+	go func() {
+		defer close(pollDone)
+		if err := r.poll(ctx, jobs, restoresDone); err != nil {
+			fail(err)
+		}
+	}()
+
+	for j := range listed {
+		// keep draining after a failure, so that listing isn't blocked on a full channel
+		if ctx.Err() != nil {
+			continue
+		}
+
+		if isArchived(j.StorageClass) {
+			restores <- j
+			continue
+		}
+
+		select {
+		case jobs <- j:
+		case <-ctx.Done():
+		}
+	}
+	close(restores)
+	wg.Wait()
+	close(restoresDone)
+	<-pollDone
+
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+type restorer struct {
+	d      S3Download
+	client *s3.Client
+
+	mu      sync.Mutex
+	pending []S3ObjectJob
+}
+
+// Requests the object be restored, queueing it straight away if it's already available
+func (r *restorer) start(ctx context.Context, j S3ObjectJob, jobs chan<- S3ObjectJob) error {
+	input := &s3.RestoreObjectInput{
+		Bucket: aws.String(r.d.Bucket),
+		Key:    aws.String(j.Key),
+		RestoreRequest: &s3types.RestoreRequest{
+			Days: aws.Int32(r.d.Restore.Days),
+			GlacierJobParameters: &s3types.GlacierJobParameters{
+				Tier: s3types.Tier(r.d.Restore.Tier),
+			},
+		},
+	}
+	if len(j.VersionId) != 0 {
+		input.VersionId = aws.String(j.VersionId)
+	}
+	r.d.Request.applyRestore(input)
+
+	_, err := r.client.RestoreObject(ctx, input)
+	var apiErr smithy.APIError
+	if err != nil && !(errors.As(err, &apiErr) && apiErr.ErrorCode() == "RestoreAlreadyInProgress") {
+		return err
+	}
+	r.d.Log.Infof("Restoring s3://%s/%s from %s\n", r.d.Bucket, j.Key, j.StorageClass)
+
+	// Objects which were already restored can be downloaded now
+	ready, err := r.isRestored(ctx, j)
+	if err != nil {
+		return err
+	}
+	if ready {
+		select {
+		case jobs <- j:
+		case <-ctx.Done():
+		}
+		return nil
+	}
+
+	r.mu.Lock()
+	r.pending = append(r.pending, j)
+	r.mu.Unlock()
+	return nil
+}
+
+// Checks the pending objects every poll interval, queueing the ones that have been restored.
+// Returns once restoresDone is closed and every pending object has been queued
+func (r *restorer) poll(ctx context.Context, jobs chan<- S3ObjectJob, restoresDone <-chan struct{}) error {
+	ticker := time.NewTicker(r.d.Restore.PollInterval)
+	defer ticker.Stop()
+
+	finished := false
+	for {
+		r.mu.Lock()
+		numPending := len(r.pending)
+		r.mu.Unlock()
+		if finished && numPending == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-restoresDone:
+			finished = true
+			restoresDone = nil
+			continue
+		case <-ticker.C:
+		}
+
+		r.mu.Lock()
+		pending := r.pending
+		r.pending = nil
+		r.mu.Unlock()
+
+		r.d.Log.Infof("Checking if %d archived objects have been restored\n", len(pending))
+		var stillPending []S3ObjectJob
+		for _, j := range pending {
+			ready, err := r.isRestored(ctx, j)
+			if err != nil {
+				return err
+			}
+			if !ready {
+				stillPending = append(stillPending, j)
+				continue
+			}
+
+			r.d.Log.Infof("s3://%s/%s has been restored\n", r.d.Bucket, j.Key)
+			select {
+			case jobs <- j:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		r.mu.Lock()
+		r.pending = append(r.pending, stillPending...)
+		r.mu.Unlock()
+	}
+}
+
+// Whether a restored copy of the archived object is available to download
+func (r *restorer) isRestored(ctx context.Context, j S3ObjectJob) (bool, error) {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(r.d.Bucket),
+		Key:    aws.String(j.Key),
+	}
+	if len(j.VersionId) != 0 {
+		input.VersionId = aws.String(j.VersionId)
+	}
+	r.d.Request.applyHead(input)
+
+	head, err := r.client.HeadObject(ctx, input)
+	if err != nil {
+		return false, err
+	}
+
+	// E.g. ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"
+	return strings.Contains(aws.ToString(head.Restore), `ongoing-request="false"`), nil
+}
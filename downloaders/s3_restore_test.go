@@ -0,0 +1,109 @@
+package downloaders
+
+import (
+	"context"
+	"fmt"
+	"github.com/op/go-logging"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Fake S3 endpoint with an archived object that becomes available after being polled a few times
+type fakeArchiveS3 struct {
+	mu       sync.Mutex
+	restored map[string]bool
+	heads    map[string]int
+}
+
+var fakeArchiveObjects = map[string]string{
+	"data/hot.txt":  "STANDARD",
+	"data/cold.txt": "GLACIER",
+}
+
+func (f *fakeArchiveS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	switch {
+	case r.Method == "GET" && r.URL.Query().Get("list-type") == "2":
+		fmt.Fprint(w, `<ListBucketResult><Name>bucket</Name><IsTruncated>false</IsTruncated>`)
+		for k, class := range fakeArchiveObjects {
+			fmt.Fprintf(w, `<Contents><Key>%s</Key><Size>%d</Size><StorageClass>%s</StorageClass></Contents>`, k, len(k), class)
+		}
+		fmt.Fprint(w, `</ListBucketResult>`)
+
+	case r.Method == "POST" && r.URL.Query().Has("restore"):
+		f.restored[key] = true
+		w.WriteHeader(http.StatusAccepted)
+
+	case r.Method == "HEAD":
+		f.heads[key]++
+		if f.restored[key] {
+			ongoing := f.heads[key] < 3
+			w.Header().Set("x-amz-restore", fmt.Sprintf(`ongoing-request="%t"`, ongoing))
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(key)))
+
+	case r.Method == "GET":
+		if fakeArchiveObjects[key] == "GLACIER" && (!f.restored[key] || f.heads[key] < 3) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `<Error><Code>InvalidObjectState</Code></Error>`)
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(key)-1, len(key)))
+		w.WriteHeader(http.StatusPartialContent)
+		fmt.Fprint(w, key)
+	}
+}
+
+func TestS3DownloadRestore(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+
+	fake := &fakeArchiveS3{restored: map[string]bool{}, heads: map[string]int{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	dir := t.TempDir()
+	d := S3Download{
+		Bucket:    "bucket",
+		Prefix:    "data/",
+		Writepath: dir,
+		Workers:   2,
+		Threads:   1,
+		Partsize:  1024,
+		MaxList:   10,
+		Client:    S3ClientConfig{EndpointURL: server.URL, ForcePathStyle: true},
+		Restore: S3RestoreOptions{
+			Enabled:      true,
+			Tier:         "Bulk",
+			Days:         1,
+			PollInterval: 10 * time.Millisecond,
+		},
+		Bar: newTestBar(),
+		Log: logging.MustGetLogger("s3pd-test"),
+	}
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for key := range fakeArchiveObjects {
+		data, err := ioutil.ReadFile(filepath.Join(dir, strings.TrimPrefix(key, "data/")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != key {
+			t.Errorf("Unexpected contents of %s: %q", key, data)
+		}
+	}
+	if fake.restored["data/hot.txt"] {
+		t.Error("Objects that aren't archived shouldn't be restored")
+	}
+}
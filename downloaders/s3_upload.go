@@ -0,0 +1,267 @@
+package downloaders
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	s3manager "github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/cheggaaa/pb/v3"
+	"github.com/op/go-logging"
+	"golang.org/x/sync/errgroup"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Uploads files from the local filesystem to S3
+type S3Upload struct {
+	Readpath string
+	Bucket   string
+	Prefix   string
+	Workers  uint
+	Threads  uint
+	Partsize int64
+	MaxList  int
+	Client   S3ClientConfig
+	Request  S3RequestOptions
+	Bar      *pb.ProgressBar
+	Log      *logging.Logger
+	stats    *Stats
+
+	// Restore the metadata stored in each file's user.s3.* xattrs on the uploaded object
+	Xattrs bool
+
+	// Uploaded as the single object at Prefix, rather than the files under Readpath, when set. E.g. os.Stdin
+	Stream io.Reader
+
+	// Counts the files uploaded & failed, and the requests made, when set
+	Summary *RunSummary
+}
+
+func (d *S3Upload) Start(ctx context.Context) error {
+	d.stats = newStats()
+	defer d.stats.finish()
+
+	clientConfig := d.Client
+	if clientConfig.HTTP.MaxIdleConnsPerHost == 0 {
+		clientConfig.HTTP.MaxIdleConnsPerHost = int(d.Workers * d.Threads)
+	}
+	clientConfig.Stats = d.stats
+	clientConfig.Summary = d.Summary
+
+	s3Client, err := NewS3Client(ctx, clientConfig)
+	if err != nil {
+		return err
+	}
+
+	// Instantiate upload workers
+	// Set job's channel length to 3x max files we'll get in a list op
+	// if the job queue ends up filling up, we'll stall doing additional list ops until the queue has more messages completed
+	uploader := s3manager.NewUploader(s3Client, func(u *s3manager.Uploader) {
+		u.PartSize = d.Partsize
+		u.Concurrency = int(d.Threads)
+		u.ClientOptions = append(u.ClientOptions, func(o *s3.Options) {
+			o.APIOptions = append(o.APIOptions, d.countUploaded)
+		})
+	})
+	if d.Stream != nil {
+		return d.uploadStream(ctx, uploader)
+	}
+
+	jobs := make(chan FileCopyJob, d.MaxList*3)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	eg, ctx := errgroup.WithContext(ctx)
+	for w := 1; w <= int(d.Workers); w++ {
+		w := w
+		eg.Go(func() error {
+			return d.worker(ctx, w, uploader, jobs)
+		})
+	}
+
+	// Start the progress bar
+	d.Bar.Start()
+
+	// Queue up upload tasks
+	if err := d.list(jobs); err != nil {
+		// if error stop the workers, and wait for them to exit before returning the error
+		cancel()
+		close(jobs)
+		eg.Wait()
+		return err
+	}
+
+	// Indicate that we listed every single file and there's no more files needing to be queued
+	close(jobs)
+
+	// Wait till all uploads finish, or until we get our first error
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+
+	d.Bar.Finish()
+	return nil
+}
+
+func (d S3Upload) list(jobs chan<- FileCopyJob) error {
+	d.Log.Debugf("Listing files under: %s", d.Readpath)
+
+	var numBytes int64 = 0
+	return filepath.WalkDir(d.Readpath, func(path string, f fs.DirEntry, err error) error {
+		// propegate error, and stop traversing filesystem
+		if err != nil {
+			return err
+		}
+
+		if !f.IsDir() {
+			fileinfo, err := f.Info()
+			if err != nil {
+				return err
+			}
+
+			jobs <- FileCopyJob{
+				Readpath: d.Readpath,
+				Filepath: path,
+				Name:     f.Name(),
+				Size:     fileinfo.Size(),
+			}
+			numBytes += fileinfo.Size()
+			d.Bar.SetTotal(numBytes)
+		}
+		return nil
+	})
+}
+
+// Returns the key a file is uploaded to, the file's path relative to Readpath appended to Prefix
+func (d S3Upload) key(j FileCopyJob) string {
+	relativePath, err := filepath.Rel(j.Readpath, j.Filepath)
+	if err != nil || relativePath == "." {
+		// Readpath is the file being uploaded
+		relativePath = j.Name
+	}
+	return path.Join(d.Prefix, filepath.ToSlash(relativePath))
+}
+
+func (d S3Upload) worker(ctx context.Context, id int, uploader *s3manager.Uploader, jobs <-chan FileCopyJob) error {
+	for j := range jobs {
+		key := d.key(j)
+		d.Log.Debugf("worker-%d uploading %s to s3://%s/%s [%.2fMiB]\n",
+			id, j.Filepath, d.Bucket, key, float64(j.Size)/1024/1024)
+
+		start := time.Now()
+		if err := d.upload(ctx, uploader, j, key); err != nil {
+			d.Summary.objectFailed()
+			return err
+		}
+		d.Summary.objectDone(j.Size, time.Since(start))
+	}
+	return nil
+}
+
+// Uploads the file to key, with its metadata restored from its xattrs when Xattrs is set
+func (d S3Upload) upload(ctx context.Context, uploader *s3manager.Uploader, j FileCopyJob, key string) error {
+	f, err := os.Open(j.Filepath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(d.Bucket),
+		Key:    aws.String(key),
+		Body:   f,
+	}
+	if d.Xattrs {
+		if err := applyXattrMetadata(j.Filepath, input); err != nil {
+			return err
+		}
+	}
+	d.Request.applyPut(input)
+
+	_, err = uploader.Upload(ctx, input)
+	return err
+}
+
+// Uploads d.Stream in parts of Partsize, with up to Threads parts buffered & uploaded at once.
+// Streams smaller than a part are uploaded with a single PutObject
+func (d *S3Upload) uploadStream(ctx context.Context, uploader *s3manager.Uploader) error {
+	if len(d.Prefix) == 0 || strings.HasSuffix(d.Prefix, "/") {
+		return fmt.Errorf("s3://%s/%s needs to be an object's key to upload a stream to", d.Bucket, d.Prefix)
+	}
+	d.Log.Debugf("Uploading stream to s3://%s/%s\n", d.Bucket, d.Prefix)
+
+	d.Bar.Start()
+	input := &s3.PutObjectInput{
+		Bucket: aws.String(d.Bucket),
+		Key:    aws.String(d.Prefix),
+		Body:   newProgressStream(d.Bar, d.Stream),
+	}
+	d.Request.applyPut(input)
+	start := time.Now()
+	if _, err := uploader.Upload(ctx, input); err != nil {
+		d.Summary.objectFailed()
+		return err
+	}
+	d.Summary.objectDone(d.stats.BytesWritten(), time.Since(start))
+
+	d.Bar.Finish()
+	return nil
+}
+
+// Returns middleware adding the bytes of each PutObject & UploadPart to the progress bar & stats once S3 has accepted them.
+// Counting the bytes as they're read would count parts the uploader re-reads for retries & signing more than once
+func (d *S3Upload) countUploaded(stack *middleware.Stack) error {
+	return stack.Build.Add(middleware.BuildMiddlewareFunc("S3pdCountUploaded", func(ctx context.Context, in middleware.BuildInput, next middleware.BuildHandler) (middleware.BuildOutput, middleware.Metadata, error) {
+		var size int64
+		if op := middleware.GetOperationName(ctx); op == "PutObject" || op == "UploadPart" {
+			if req, ok := in.Request.(*smithyhttp.Request); ok {
+				if n, ok, err := req.StreamLength(); ok && err == nil {
+					size = n
+				}
+			}
+		}
+
+		out, metadata, err := next.HandleBuild(ctx, in)
+		if err == nil && size != 0 {
+			d.Bar.Add64(size)
+			d.stats.addWritten(size)
+		}
+		return out, metadata, err
+	}), middleware.After)
+}
+
+// Sets the object's metadata from the file's user.s3.* xattrs
+func applyXattrMetadata(path string, input *s3.PutObjectInput) error {
+	m, err := readMetadataXattrs(path)
+	if err != nil {
+		return err
+	}
+
+	optional := func(s string) *string {
+		if len(s) == 0 {
+			return nil
+		}
+		return aws.String(s)
+	}
+	input.ContentType = optional(m.ContentType)
+	input.ContentEncoding = optional(m.ContentEncoding)
+	input.ContentDisposition = optional(m.ContentDisposition)
+	input.ContentLanguage = optional(m.ContentLanguage)
+	input.CacheControl = optional(m.CacheControl)
+	if len(m.UserMetadata) != 0 {
+		input.Metadata = m.UserMetadata
+	}
+	input.Tagging = m.tagging()
+	return nil
+}
+
+func (d S3Upload) Stats() *Stats {
+	return d.stats
+}
@@ -0,0 +1,124 @@
+package downloaders
+
+import (
+	"bytes"
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/op/go-logging"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestS3UploadStream(t *testing.T) {
+	clientConfig := testS3ClientConfig(t)
+	client, err := NewS3Client(context.Background(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	createTestObjects(t, client, "s3pd-test", nil)
+
+	streams := map[string][]byte{
+		// smaller than a part, so put in one request
+		"stream/small.bin": []byte("small"),
+		"stream/large.bin": bytes.Repeat([]byte("l"), 11*1024*1024),
+	}
+	for key, body := range streams {
+		d := S3Upload{
+			Bucket:   "s3pd-test",
+			Prefix:   key,
+			Threads:  2,
+			Partsize: 5 * 1024 * 1024,
+			Client:   clientConfig,
+			// hide that it's a bytes.Reader, as stdin can't be seeked
+			Stream: io.MultiReader(bytes.NewReader(body)),
+			Bar:    newTestBar(),
+			Log:    logging.MustGetLogger("s3pd-test"),
+		}
+		if err := d.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		out, err := client.GetObject(context.Background(), &s3.GetObjectInput{
+			Bucket: aws.String("s3pd-test"),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(out.Body)
+		out.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, body) {
+			t.Errorf("Uploaded %s doesn't match the stream", key)
+		}
+		if d.Bar.Total() != int64(len(body)) {
+			t.Errorf("Expected the progress bar's total to be %d, got %d", len(body), d.Bar.Total())
+		}
+		if d.Bar.Current() != int64(len(body)) || d.Stats().BytesWritten() != int64(len(body)) {
+			t.Errorf("Expected %d bytes uploaded, got %d on the bar & %d written", len(body), d.Bar.Current(), d.Stats().BytesWritten())
+		}
+	}
+}
+
+func TestS3UploadCountsUploadedBytes(t *testing.T) {
+	clientConfig := testS3ClientConfig(t)
+	client, err := NewS3Client(context.Background(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	createTestObjects(t, client, "s3pd-test", nil)
+
+	// the files are read more than once to sign their parts over plain http, but only count once uploaded
+	dir := t.TempDir()
+	sizes := map[string]int{"small.bin": 1024, "large.bin": 11 * 1024 * 1024}
+	var total int64
+	for name, size := range sizes {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), bytes.Repeat([]byte("u"), size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		total += int64(size)
+	}
+
+	d := S3Upload{
+		Readpath: dir,
+		Bucket:   "s3pd-test",
+		Prefix:   "upload-counts/",
+		Workers:  2,
+		Threads:  2,
+		Partsize: 5 * 1024 * 1024,
+		MaxList:  10,
+		Client:   clientConfig,
+		Bar:      newTestBar(),
+		Log:      logging.MustGetLogger("s3pd-test"),
+		Summary:  NewRunSummary(),
+	}
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if totals := d.Summary.Totals(); totals.Objects != 2 || totals.Bytes != total || totals.Requests["PutObject"] != 1 {
+		t.Errorf("Expected 2 files uploaded with a PutObject for the small one, got %+v", totals)
+	}
+	if d.Bar.Current() != total || d.Stats().BytesWritten() != total {
+		t.Errorf("Expected %d bytes uploaded, got %d on the bar & %d written", total, d.Bar.Current(), d.Stats().BytesWritten())
+	}
+}
+
+func TestS3UploadStreamNeedsKey(t *testing.T) {
+	d := S3Upload{
+		Bucket:   "bucket",
+		Prefix:   "folder/",
+		Partsize: 5 * 1024 * 1024,
+		Client:   S3ClientConfig{Region: "us-east-1"},
+		Stream:   bytes.NewReader(nil),
+		Bar:      newTestBar(),
+		Log:      logging.MustGetLogger("s3pd-test"),
+	}
+	if err := d.Start(context.Background()); err == nil {
+		t.Error("Expected a prefix ending in / to be rejected")
+	}
+}
@@ -0,0 +1,170 @@
+package downloaders
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"sort"
+	"time"
+)
+
+// A version or delete marker returned by ListObjectVersions
+type versionEntry struct {
+	Key            string
+	VersionId      string
+	LastModified   time.Time
+	IsDeleteMarker bool
+	IsLatest       bool
+	Size           int64
+	ETag           string
+	StorageClass   string
+}
+
+// Picks the newest version of each key as of a point in time.
+// Entries must be added in the order ListObjectVersions returns them: by key, then newest to oldest.
+// A key's versions can be split across multiple pages.
+type versionSelector struct {
+	AsOf time.Time
+
+	// key we're currently selecting a version of, and whether its version has already been picked
+	key     string
+	decided bool
+}
+
+// Whether e sorts before other: by key, then newest first.
+// LastModified only has a resolution of a second, so a version & delete marker can share it. S3 marks the key's current
+// entry as the latest, otherwise the delete marker is taken as the newer, as it must have been created after a version it hides
+func (e versionEntry) newerThan(other versionEntry) bool {
+	if e.Key != other.Key {
+		return e.Key < other.Key
+	}
+	if !e.LastModified.Equal(other.LastModified) {
+		return e.LastModified.After(other.LastModified)
+	}
+	if e.IsLatest != other.IsLatest {
+		return e.IsLatest
+	}
+	return e.IsDeleteMarker && !other.IsDeleteMarker
+}
+
+// Returns the versions to download from a page of entries
+func (s *versionSelector) add(entries []versionEntry) (jobs []S3ObjectJob) {
+	// Versions & delete markers come back as separate lists, merge them back into one ordering
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].newerThan(entries[j])
+	})
+
+	for _, e := range entries {
+		if e.Key != s.key {
+			s.key = e.Key
+			s.decided = false
+		}
+
+		// Only the newest version at the point in time is used, versions created later are ignored
+		if s.decided || e.LastModified.After(s.AsOf) {
+			continue
+		}
+		s.decided = true
+
+		// Key was deleted at the point in time
+		if e.IsDeleteMarker {
+			continue
+		}
+
+		jobs = append(jobs, S3ObjectJob{
+			Key:          e.Key,
+			VersionId:    e.VersionId,
+			Size:         e.Size,
+			ETag:         e.ETag,
+			LastModified: e.LastModified,
+			StorageClass: e.StorageClass,
+		})
+	}
+	return jobs
+}
+
+// Queues the newest version of each object as of d.AsOf
+func (d S3Download) listVersions(client *s3.Client, jobs chan<- S3ObjectJob) error {
+	d.Log.Debugf("Listing object versions with the prefix of s3://%s/%s as of %s\n", d.Bucket, d.Prefix, d.AsOf)
+	input := &s3.ListObjectVersionsInput{
+		Bucket:  &d.Bucket,
+		Prefix:  &d.Prefix,
+		MaxKeys: aws.Int32(int32(d.MaxList)),
+	}
+	d.Request.applyListVersions(input)
+	paginator := s3.NewListObjectVersionsPaginator(client, input)
+
+	selector := versionSelector{AsOf: d.AsOf}
+	var numBytes int64 = 0
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.Background())
+		if err != nil {
+			return err
+		}
+
+		entries := make([]versionEntry, 0, len(page.Versions)+len(page.DeleteMarkers))
+		for _, v := range page.Versions {
+			entries = append(entries, versionEntry{
+				Key:          aws.ToString(v.Key),
+				VersionId:    aws.ToString(v.VersionId),
+				LastModified: aws.ToTime(v.LastModified),
+				IsLatest:     aws.ToBool(v.IsLatest),
+				Size:         aws.ToInt64(v.Size),
+				ETag:         trimETag(aws.ToString(v.ETag)),
+				StorageClass: string(v.StorageClass),
+			})
+		}
+		for _, m := range page.DeleteMarkers {
+			entries = append(entries, versionEntry{
+				Key:            aws.ToString(m.Key),
+				VersionId:      aws.ToString(m.VersionId),
+				LastModified:   aws.ToTime(m.LastModified),
+				IsDeleteMarker: true,
+				IsLatest:       aws.ToBool(m.IsLatest),
+			})
+		}
+
+		selected := selector.add(entries)
+		d.Log.Debugf("Scheduling %d objects to be downloaded\n", len(selected))
+		for _, j := range selected {
+			jobs <- j
+			numBytes += j.Size
+		}
+		d.Bar.SetTotal(numBytes)
+	}
+	return nil
+}
+
+// Queues the single object at d.Prefix, or the version of it given by d.VersionId
+func (d S3Download) headObject(client *s3.Client, jobs chan<- S3ObjectJob) error {
+	d.Log.Debugf("Getting s3://%s/%s %s\n", d.Bucket, d.Prefix, d.VersionId)
+	input := &s3.HeadObjectInput{
+		Bucket: &d.Bucket,
+		Key:    &d.Prefix,
+	}
+	if len(d.VersionId) != 0 {
+		input.VersionId = &d.VersionId
+	}
+	d.Request.applyHead(input)
+	head, err := client.HeadObject(context.Background(), input)
+	if err != nil {
+		return err
+	}
+
+	total := aws.ToInt64(head.ContentLength)
+	if d.Range != nil {
+		if _, total, err = d.Range.within(total); err != nil {
+			return err
+		}
+	}
+	jobs <- S3ObjectJob{
+		Key:          d.Prefix,
+		VersionId:    d.VersionId,
+		Size:         aws.ToInt64(head.ContentLength),
+		ETag:         trimETag(aws.ToString(head.ETag)),
+		LastModified: aws.ToTime(head.LastModified),
+		StorageClass: string(head.StorageClass),
+	}
+	d.Bar.SetTotal(total)
+	return nil
+}
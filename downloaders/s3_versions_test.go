@@ -0,0 +1,78 @@
+package downloaders
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVersionSelector(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC) }
+	s := versionSelector{AsOf: day(10)}
+
+	// Page 1, versions & delete markers are returned in separate lists
+	page1 := []versionEntry{
+		{Key: "a", VersionId: "a3", LastModified: day(12)},
+		{Key: "a", VersionId: "a2", LastModified: day(8)},
+		{Key: "a", VersionId: "a1", LastModified: day(1)},
+		{Key: "b", VersionId: "b1", LastModified: day(2)},
+		{Key: "c", VersionId: "c2", LastModified: day(11)},
+		{Key: "b", VersionId: "b2", LastModified: day(5), IsDeleteMarker: true},
+		{Key: "c", VersionId: "c1", LastModified: day(9), IsDeleteMarker: true},
+	}
+	// Page 2 continues key "c"'s older versions
+	page2 := []versionEntry{
+		{Key: "c", VersionId: "c0", LastModified: day(3)},
+		{Key: "d", VersionId: "d1", LastModified: day(11)},
+		{Key: "e", VersionId: "e1", LastModified: day(10)},
+	}
+
+	var selected []string
+	for _, j := range s.add(page1) {
+		selected = append(selected, j.VersionId)
+	}
+	for _, j := range s.add(page2) {
+		selected = append(selected, j.VersionId)
+	}
+
+	// a: a2 is the newest as of day 10
+	// b: deleted on day 5
+	// c: deleted on day 9, c0 is older than the delete marker
+	// d: created after day 10
+	// e: created exactly on day 10
+	expected := []string{"a2", "e1"}
+	if len(selected) != len(expected) {
+		t.Fatalf("Expected versions %v, got %v", expected, selected)
+	}
+	for i := range expected {
+		if selected[i] != expected[i] {
+			t.Errorf("Expected versions %v, got %v", expected, selected)
+		}
+	}
+}
+
+func TestVersionSelectorTies(t *testing.T) {
+	second := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	s := versionSelector{AsOf: second}
+
+	// Versions & delete markers created within the same second share a LastModified
+	entries := []versionEntry{
+		{Key: "a", VersionId: "a1", LastModified: second, IsLatest: true},
+		{Key: "a", VersionId: "a0", LastModified: second, IsDeleteMarker: true},
+		{Key: "b", VersionId: "b1", LastModified: second},
+		{Key: "b", VersionId: "b0", LastModified: second, IsDeleteMarker: true, IsLatest: true},
+		{Key: "c", VersionId: "c2", LastModified: second.Add(time.Hour), IsLatest: true},
+		{Key: "c", VersionId: "c1", LastModified: second},
+		{Key: "c", VersionId: "c0", LastModified: second, IsDeleteMarker: true},
+	}
+
+	// a: re-created after being deleted
+	// b: deleted after being created
+	// c: neither is the latest, the delete marker hides the version it shares a second with
+	var selected []string
+	for _, j := range s.add(entries) {
+		selected = append(selected, j.VersionId)
+	}
+	if len(selected) != 1 || selected[0] != "a1" {
+		t.Errorf("Expected versions [a1], got %v", selected)
+	}
+}
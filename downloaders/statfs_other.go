@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package downloaders
+
+import (
+	"errors"
+)
+
+func diskFree(path string) (int64, error) {
+	return 0, errors.New("checking free space is not supported on this OS")
+}
@@ -0,0 +1,239 @@
+package downloaders
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often the stats are sampled, at first
+const statsSampleInterval = time.Second
+
+// Samples kept before every other sample is dropped, and the interval doubled, so that long runs don't grow the time series forever
+const statsMaxSamples = 3600
+
+// Bytes written to the destination, bytes received from S3 & requests in flight during a run, sampled over time.
+// Bytes discarded when benchmarking count as written. Safe for concurrent use, and methods are safe to call on a nil Stats
+type Stats struct {
+	started time.Time
+
+	written  int64
+	received int64
+	active   int64
+
+	mu       sync.Mutex
+	finished time.Time
+	samples  []StatsSample
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// Stats at a point during the run
+type StatsSample struct {
+	Time           time.Time `json:"time"`
+	BytesWritten   int64     `json:"bytes_written"`
+	BytesReceived  int64     `json:"bytes_received"`
+	ActiveRequests int64     `json:"active_requests"`
+}
+
+// Returns stats for a run starting now, which are sampled until finish is called
+func newStats() *Stats {
+	s := &Stats{
+		started:  time.Now(),
+		interval: statsSampleInterval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go s.sample()
+	return s
+}
+
+func (s *Stats) sample() {
+	defer close(s.done)
+	timer := time.NewTimer(s.interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			s.record()
+			s.mu.Lock()
+			interval := s.interval
+			s.mu.Unlock()
+			timer.Reset(interval)
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *Stats) record() {
+	sample := s.current()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.samples = append(s.samples, sample)
+	if len(s.samples) >= statsMaxSamples {
+		kept := s.samples[:0]
+		for i := 1; i < len(s.samples); i += 2 {
+			kept = append(kept, s.samples[i])
+		}
+		s.samples = kept
+		s.interval *= 2
+	}
+}
+
+func (s *Stats) current() StatsSample {
+	return StatsSample{
+		Time:           time.Now(),
+		BytesWritten:   atomic.LoadInt64(&s.written),
+		BytesReceived:  atomic.LoadInt64(&s.received),
+		ActiveRequests: atomic.LoadInt64(&s.active),
+	}
+}
+
+// Stops sampling, recording a last sample. Safe to call more than once
+func (s *Stats) finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.finished.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.finished = time.Now()
+	s.mu.Unlock()
+
+	close(s.stop)
+	<-s.done
+	s.record()
+}
+
+func (s *Stats) addWritten(n int64) {
+	if s != nil {
+		atomic.AddInt64(&s.written, n)
+	}
+}
+
+func (s *Stats) addReceived(n int64) {
+	if s != nil {
+		atomic.AddInt64(&s.received, n)
+	}
+}
+
+func (s *Stats) BytesWritten() int64 {
+	if s == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&s.written)
+}
+
+func (s *Stats) BytesReceived() int64 {
+	if s == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&s.received)
+}
+
+// Requests sent whose responses haven't been read to the end or closed yet
+func (s *Stats) ActiveRequests() int64 {
+	if s == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&s.active)
+}
+
+// Returns the samples taken so far, oldest first
+func (s *Stats) Samples() []StatsSample {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]StatsSample(nil), s.samples...)
+}
+
+// Time from the start of the run until it finished, or until now while it's running
+func (s *Stats) Elapsed() time.Duration {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.finished.IsZero() {
+		return time.Since(s.started)
+	}
+	return s.finished.Sub(s.started)
+}
+
+// Average rate bytes were written at, in Gibps
+func (s *Stats) Throughput() float64 {
+	elapsed := s.Elapsed().Seconds()
+	if elapsed == 0 {
+		return 0
+	}
+	return float64(s.BytesWritten()) * 8 / 1024 / 1024 / 1024 / elapsed
+}
+
+// HTTP client counting the requests in flight & the bytes of their responses towards the stats
+type statsHTTPClient struct {
+	client HTTPClient
+	stats  *Stats
+}
+
+func (c statsHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&c.stats.active, 1)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		atomic.AddInt64(&c.stats.active, -1)
+		return resp, err
+	}
+	resp.Body = &statsBody{ReadCloser: resp.Body, stats: c.stats}
+	return resp, nil
+}
+
+// Response body counting the bytes read from it, which stops being an active request once closed
+type statsBody struct {
+	io.ReadCloser
+	stats *Stats
+	once  sync.Once
+}
+
+func (b *statsBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.stats.addReceived(int64(n))
+	return n, err
+}
+
+func (b *statsBody) Close() error {
+	b.once.Do(func() {
+		atomic.AddInt64(&b.stats.active, -1)
+	})
+	return b.ReadCloser.Close()
+}
+
+// Writer counting the bytes written to w towards the stats
+type statsWriter struct {
+	w     io.Writer
+	stats *Stats
+}
+
+func (s statsWriter) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	s.stats.addWritten(int64(n))
+	return n, err
+}
+
+// WriterAt counting the bytes written to w towards the stats
+type statsWriterAt struct {
+	w     io.WriterAt
+	stats *Stats
+}
+
+func (s statsWriterAt) WriteAt(p []byte, offset int64) (int, error) {
+	n, err := s.w.WriteAt(p, offset)
+	s.stats.addWritten(int64(n))
+	return n, err
+}
@@ -0,0 +1,102 @@
+package downloaders
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStatsWriters(t *testing.T) {
+	stats := newStats()
+
+	var buf bytes.Buffer
+	if _, err := (statsWriter{w: &buf, stats: stats}).Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "out.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := (statsWriterAt{w: f, stats: stats}).WriteAt([]byte("world!"), 10); err != nil {
+		t.Fatal(err)
+	}
+	stats.finish()
+
+	if stats.BytesWritten() != 11 {
+		t.Errorf("Expected 11 bytes written, got %d", stats.BytesWritten())
+	}
+	samples := stats.Samples()
+	if len(samples) == 0 || samples[len(samples)-1].BytesWritten != 11 {
+		t.Errorf("Expected a last sample once finished, got %+v", samples)
+	}
+
+	// finishing again, or writing without stats, is a no-op
+	stats.finish()
+	if _, err := (statsWriter{w: &buf}).Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Samples()) != len(samples) {
+		t.Errorf("Expected no more samples after finishing, got %d", len(stats.Samples()))
+	}
+}
+
+func TestStatsHTTPClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0123456789"))
+	}))
+	defer server.Close()
+
+	stats := newStats()
+	defer stats.finish()
+	client := statsHTTPClient{client: http.DefaultClient, stats: stats}
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	req, err := http.NewRequest(http.MethodGet, closed.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Do(req); err == nil {
+		t.Fatal("Expected requests to a closed server to fail")
+	}
+	if stats.ActiveRequests() != 0 {
+		t.Errorf("Expected failed requests not to stay active, got %d", stats.ActiveRequests())
+	}
+
+	req, err = http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.ActiveRequests() != 1 {
+		t.Errorf("Expected 1 active request until the body is closed, got %d", stats.ActiveRequests())
+	}
+	if _, err := ioutil.ReadAll(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	resp.Body.Close()
+
+	if stats.BytesReceived() != 10 {
+		t.Errorf("Expected 10 bytes received, got %d", stats.BytesReceived())
+	}
+	if stats.ActiveRequests() != 0 {
+		t.Errorf("Expected no active requests once closed, got %d", stats.ActiveRequests())
+	}
+	if stats.BytesWritten() != 0 || stats.Throughput() != 0 {
+		t.Errorf("Expected bytes received not to count as written, got %d", stats.BytesWritten())
+	}
+	if stats.Elapsed() <= 0 || stats.Elapsed() > time.Minute {
+		t.Errorf("Unexpected elapsed time %v", stats.Elapsed())
+	}
+}
@@ -0,0 +1,221 @@
+package downloaders
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/cheggaaa/pb/v3"
+	"golang.org/x/sync/errgroup"
+	"io"
+	"sync"
+)
+
+// Fetches the part of an object or file starting at offset into buf, which is sized to the part
+type fetchFunc func(ctx context.Context, offset int64, buf []byte) error
+
+// Takes parts fetched out of order by concurrent requests, and writes them to w strictly in order.
+// At most window parts are fetched or waiting to be written at once, bounding memory to window * partsize
+type reorderBuffer struct {
+	w io.Writer
+
+	// Released once a part has been written, acquired before a part is fetched
+	slots chan struct{}
+
+	mu      sync.Mutex
+	next    int
+	pending map[int][]byte
+	buffers sync.Pool
+}
+
+func newReorderBuffer(w io.Writer, window int, partsize int64) *reorderBuffer {
+	if window < 1 {
+		window = 1
+	}
+	return &reorderBuffer{
+		w:       w,
+		slots:   make(chan struct{}, window),
+		pending: map[int][]byte{},
+		buffers: sync.Pool{New: func() interface{} { return make([]byte, partsize) }},
+	}
+}
+
+// Blocks until there's room in the window for another part. Parts must be reserved in order
+func (b *reorderBuffer) reserve(ctx context.Context) error {
+	select {
+	case b.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Adds part i, writing it along with any parts after it that are waiting to be written once every part before it has been written
+func (b *reorderBuffer) put(i int, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.pending[i] = data
+	for {
+		data, ok := b.pending[b.next]
+		if !ok {
+			return nil
+		}
+		delete(b.pending, b.next)
+		b.next++
+
+		_, err := b.w.Write(data)
+		b.buffers.Put(data[:cap(data)])
+		<-b.slots
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Fetches size bytes in parts of partsize using threads concurrent requests, writing them to w in order
+func streamParts(ctx context.Context, w io.Writer, size, partsize int64, threads, window int, fetch fetchFunc) error {
+	b := newReorderBuffer(w, window, partsize)
+	eg, ctx := errgroup.WithContext(ctx)
+
+	// Parts are handed out in order, only once there's room for them in the window. The lowest part
+	// that hasn't been written is always being fetched, so the window can't fill up with parts that are waiting on it
+	parts := make(chan int)
+	eg.Go(func() error {
+		defer close(parts)
+		for i := 0; int64(i)*partsize < size; i++ {
+			if err := b.reserve(ctx); err != nil {
+				return err
+			}
+			select {
+			case parts <- i:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+
+	for t := 1; t <= threads; t++ {
+		eg.Go(func() error {
+			for i := range parts {
+				offset := int64(i) * partsize
+				n := partsize
+				if size-offset < n {
+					n = size - offset
+				}
+
+				buf := b.buffers.Get().([]byte)[:n]
+				if err := fetch(ctx, offset, buf); err != nil {
+					return err
+				}
+				if err := b.put(i, buf); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	return eg.Wait()
+}
+
+// Returns a fetchFunc which reads ranges of the object using ranged GETs
+func (d S3Download) rangeFetcher(client *s3.Client, j S3ObjectJob) fetchFunc {
+	return newRangeFetcher(client, d.Bucket, d.Request, d.Bar, j)
+}
+
+// Returns a fetchFunc which reads ranges of the object in bucket using ranged GETs, adding the bytes read to bar unless it's nil
+func newRangeFetcher(client *s3.Client, bucket string, request S3RequestOptions, bar *pb.ProgressBar, j S3ObjectJob) fetchFunc {
+	return newObjectFetcher(client, bucket, request, bar, j, nil)
+}
+
+// Returns a fetchFunc like newRangeFetcher's, which also passes each response to seen unless it's nil
+func newObjectFetcher(client *s3.Client, bucket string, request S3RequestOptions, bar *pb.ProgressBar, j S3ObjectJob, seen func(*s3.GetObjectOutput)) fetchFunc {
+	return func(ctx context.Context, offset int64, buf []byte) error {
+		input := &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(j.Key),
+			Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+int64(len(buf))-1)),
+		}
+		if len(j.VersionId) != 0 {
+			input.VersionId = aws.String(j.VersionId)
+		}
+		// the object can't change part way through being streamed
+		if len(j.ETag) != 0 {
+			input.IfMatch = aws.String("\"" + j.ETag + "\"")
+		}
+		request.applyGet(input)
+
+		out, err := client.GetObject(ctx, input)
+		if err != nil {
+			return err
+		}
+		defer out.Body.Close()
+		if seen != nil {
+			seen(out)
+		}
+
+		n, err := io.ReadFull(out.Body, buf)
+		if bar != nil {
+			bar.Add(n)
+		}
+		return err
+	}
+}
+
+// Reads size bytes in order with consume, fetching them in parts of partsize using threads concurrent requests.
+// Fetching stops if consume returns before reading every byte
+func consumeParts(ctx context.Context, size, partsize int64, threads, window int, fetch fetchFunc, consume func(io.Reader) error) error {
+	pr, pw := io.Pipe()
+	eg, ctx := errgroup.WithContext(ctx)
+
+	eg.Go(func() error {
+		err := streamParts(ctx, pw, size, partsize, threads, window, fetch)
+		pw.CloseWithError(err)
+		return err
+	})
+
+	eg.Go(func() error {
+		err := consume(pr)
+		pr.CloseWithError(err)
+		return err
+	})
+	return eg.Wait()
+}
+
+// Moves objects from the listed channel to the jobs channel in key order, so that they're streamed in key order.
+// Closes jobs once every listed object has been moved over
+func (d S3Download) streamOrder(ctx context.Context, listed <-chan S3ObjectJob, jobs chan<- S3ObjectJob) error {
+	defer close(jobs)
+	defer func() {
+		// keep draining after a failure, so that listing isn't blocked on a full channel
+		for range listed {
+		}
+	}()
+
+	return inKeyOrder(d.Bucket, listed, func(j S3ObjectJob) error {
+		select {
+		case jobs <- j:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
+// Number of parts of each object that can be fetched ahead of what's been written
+func (d S3Download) streamWindow() int {
+	if d.StreamWindow == 0 {
+		return 2 * int(d.Threads)
+	}
+	return int(d.StreamWindow / d.Partsize)
+}
+
+// Writes the object, or its range, to w in order, fetching its parts concurrently
+func (d S3Download) streamObject(ctx context.Context, client *s3.Client, j S3ObjectJob, w io.Writer) error {
+	size, fetch, err := d.objectRange(client, j)
+	if err != nil {
+		return err
+	}
+	return streamParts(ctx, statsWriter{w: w, stats: d.stats}, size, d.Partsize, int(d.Threads), d.streamWindow(), fetch)
+}
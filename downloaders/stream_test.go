@@ -0,0 +1,113 @@
+package downloaders
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStreamParts(t *testing.T) {
+	data := make([]byte, 100*1024+7)
+	rand.Read(data)
+
+	// Parts finish out of order, and the window bounds how many are outstanding
+	const window = 4
+	var mu sync.Mutex
+	outstanding, maxOutstanding := 0, 0
+	var out bytes.Buffer
+	written := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return out.Len()
+	}
+	fetch := func(ctx context.Context, offset int64, buf []byte) error {
+		mu.Lock()
+		outstanding = int(offset/1024) + 1 - out.Len()/1024
+		if outstanding > maxOutstanding {
+			maxOutstanding = outstanding
+		}
+		mu.Unlock()
+
+		time.Sleep(time.Duration(rand.Intn(200)) * time.Microsecond)
+		copy(buf, data[offset:])
+		return nil
+	}
+
+	w := writerFunc(func(p []byte) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return out.Write(p)
+	})
+	if err := streamParts(context.Background(), w, int64(len(data)), 1024, 8, window, fetch); err != nil {
+		t.Fatal(err)
+	}
+
+	if written() != len(data) || !bytes.Equal(out.Bytes(), data) {
+		t.Error("Expected the parts to be written in order")
+	}
+	if maxOutstanding > window {
+		t.Errorf("Expected at most %d parts to be outstanding, got %d", window, maxOutstanding)
+	}
+}
+
+func TestStreamPartsError(t *testing.T) {
+	failure := errors.New("fetch failed")
+	fetch := func(ctx context.Context, offset int64, buf []byte) error {
+		if offset == 5*1024 {
+			return failure
+		}
+		return nil
+	}
+
+	var out bytes.Buffer
+	err := streamParts(context.Background(), &out, 100*1024, 1024, 4, 2, fetch)
+	if err != failure {
+		t.Errorf("Expected the fetch error, got %v", err)
+	}
+	if out.Len() > 5*1024 {
+		t.Errorf("Expected nothing after the failed part to be written, got %d bytes", out.Len())
+	}
+}
+
+func TestStreamPartsEmpty(t *testing.T) {
+	var out bytes.Buffer
+	fetch := func(ctx context.Context, offset int64, buf []byte) error {
+		t.Error("Expected nothing to be fetched")
+		return nil
+	}
+	if err := streamParts(context.Background(), &out, 0, 1024, 4, 2, fetch); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestStreamOrderDirectoryBucket(t *testing.T) {
+	// directory buckets list keys out of order
+	listed := make(chan S3ObjectJob, 3)
+	jobs := make(chan S3ObjectJob, 3)
+	listed <- S3ObjectJob{Key: "part-2"}
+	listed <- S3ObjectJob{Key: "part-0"}
+	listed <- S3ObjectJob{Key: "part-1"}
+	close(listed)
+
+	d := S3Download{Bucket: "mybucket--usw2-az1--x-s3"}
+	if err := d.streamOrder(context.Background(), listed, jobs); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for j := range jobs {
+		keys = append(keys, j.Key)
+	}
+	if len(keys) != 3 || keys[0] != "part-0" || keys[1] != "part-1" || keys[2] != "part-2" {
+		t.Errorf("Expected the objects to be streamed in key order, got %v", keys)
+	}
+}
@@ -0,0 +1,113 @@
+package downloaders
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sync"
+)
+
+// How objects are assigned to destination roots when striping across several of them
+type StripePolicy string
+
+const (
+	// Each object goes to the next root in turn
+	StripeRoundRobin StripePolicy = "round-robin"
+
+	// Each object goes to the root with the most free space, less the size of the objects already assigned to it
+	StripeFreeSpace StripePolicy = "free-space"
+
+	// Each object goes to the root picked by a hash of its key, so the same key always goes to the same root
+	StripeHash StripePolicy = "hash"
+)
+
+// Spreads objects across several destination roots, e.g. NVMe drives that aren't in a RAID,
+// so that writes aren't limited to a single drive's throughput
+type StripeOptions struct {
+	// Destination roots, every object is written to Writepath when empty
+	Roots  []string
+	Policy StripePolicy
+
+	// File the key, root & path of every object is written to as tab separated values, when set
+	Manifest string
+}
+
+// Assigns objects to roots. Safe to use from multiple workers
+type striper struct {
+	roots    []string
+	policy   StripePolicy
+	manifest *tsvReport
+
+	mu   sync.Mutex
+	next int
+
+	// free space left on each root once the objects assigned to it are written
+	free []int64
+}
+
+func newStriper(writepath string, o StripeOptions) (*striper, error) {
+	s := &striper{roots: o.Roots, policy: o.Policy}
+	if len(s.roots) == 0 {
+		s.roots = []string{writepath}
+	}
+
+	if len(s.roots) > 1 && s.policy == StripeFreeSpace {
+		for _, root := range s.roots {
+			// roots which don't exist yet can't be checked for free space
+			if err := os.MkdirAll(root, os.ModePerm); err != nil {
+				return nil, err
+			}
+			free, err := diskFree(root)
+			if err != nil {
+				return nil, fmt.Errorf("checking free space of %s: %w", root, err)
+			}
+			s.free = append(s.free, free)
+		}
+	}
+
+	var err error
+	s.manifest, err = newTSVReport(o.Manifest, "key", "root", "path")
+	return s, err
+}
+
+// Returns the root the object is written under
+func (s *striper) assign(key string, size int64) string {
+	if len(s.roots) == 1 {
+		return s.roots[0]
+	}
+
+	switch s.policy {
+	case StripeHash:
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		return s.roots[h.Sum32()%uint32(len(s.roots))]
+
+	case StripeFreeSpace:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		most := 0
+		for i := range s.free {
+			if s.free[i] > s.free[most] {
+				most = i
+			}
+		}
+		s.free[most] -= size
+		return s.roots[most]
+
+	default:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		root := s.roots[s.next]
+		s.next = (s.next + 1) % len(s.roots)
+		return root
+	}
+}
+
+// Records where the object was written to in the manifest
+func (s *striper) record(key, root, path string) error {
+	return s.manifest.Write(key, root, path)
+}
+
+func (s *striper) Close() error {
+	return s.manifest.Close()
+}
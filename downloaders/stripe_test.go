@@ -0,0 +1,124 @@
+package downloaders
+
+import (
+	"context"
+	"github.com/op/go-logging"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStriperRoundRobin(t *testing.T) {
+	s, err := newStriper("/unused", StripeOptions{Roots: []string{"/a", "/b", "/c"}, Policy: StripeRoundRobin})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var roots []string
+	for i := 0; i < 4; i++ {
+		roots = append(roots, s.assign("key", 1))
+	}
+	if strings.Join(roots, ",") != "/a,/b,/c,/a" {
+		t.Errorf("Expected roots to be used in turn, got %v", roots)
+	}
+}
+
+func TestStriperHash(t *testing.T) {
+	s, err := newStriper("/unused", StripeOptions{Roots: []string{"/a", "/b", "/c"}, Policy: StripeHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	used := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		key := strings.Repeat("k", i)
+		root := s.assign(key, 1)
+		if s.assign(key, 1) != root {
+			t.Errorf("Expected %q to always be assigned to the same root", key)
+		}
+		used[root] = true
+	}
+	if len(used) != 3 {
+		t.Errorf("Expected keys to be spread across every root, got %v", used)
+	}
+}
+
+func TestStriperFreeSpace(t *testing.T) {
+	dir := t.TempDir()
+	roots := []string{filepath.Join(dir, "a"), filepath.Join(dir, "b")}
+	s, err := newStriper("/unused", StripeOptions{Roots: roots, Policy: StripeFreeSpace})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(roots[1]); err != nil {
+		t.Errorf("Expected roots to be created: %v", err)
+	}
+
+	s.free = []int64{100, 250}
+	var assigned []string
+	for i := 0; i < 4; i++ {
+		assigned = append(assigned, filepath.Base(s.assign("key", 100)))
+	}
+
+	// b: 250 -> 150 -> 50, a: 100 -> 0
+	if strings.Join(assigned, ",") != "b,b,a,b" {
+		t.Errorf("Expected the root with the most free space to be used, got %v", assigned)
+	}
+}
+
+func TestStriperSingleRoot(t *testing.T) {
+	s, err := newStriper("/dest", StripeOptions{Policy: StripeFreeSpace})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root := s.assign("key", 1); root != "/dest" {
+		t.Errorf("Expected the writepath to be used, got %s", root)
+	}
+}
+
+func TestFilesystemDownloadStripe(t *testing.T) {
+	src := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt", "c.txt", "d.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(src, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dest := t.TempDir()
+	roots := []string{filepath.Join(dest, "nvme0"), filepath.Join(dest, "nvme1")}
+	manifest := filepath.Join(dest, "manifest.tsv")
+	d := FilesystemDownload{
+		Readpath:  src,
+		Writepath: roots[0],
+		Workers:   1,
+		Threads:   1,
+		Partsize:  1024,
+		MaxList:   10,
+		Stripe:    StripeOptions{Roots: roots, Policy: StripeRoundRobin, Manifest: manifest},
+		Bar:       newTestBar(),
+		Log:       logging.MustGetLogger("s3pd-test"),
+	}
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, root := range roots {
+		files, err := ioutil.ReadDir(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 2 {
+			t.Errorf("Expected 2 files in %s, got %d", root, len(files))
+		}
+	}
+
+	data, err := ioutil.ReadFile(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 5 {
+		t.Errorf("Expected a header & a line per file, got %q", data)
+	}
+}
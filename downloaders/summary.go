@@ -0,0 +1,131 @@
+package downloaders
+
+import (
+	"context"
+	"github.com/aws/smithy-go/middleware"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Objects transferred, skipped & failed during a run, each object's latency, and the S3 requests made by API.
+// Methods are safe to call on a nil RunSummary, which records nothing
+type RunSummary struct {
+	mu        sync.Mutex
+	objects   int64
+	bytes     int64
+	skipped   int64
+	failed    int64
+	latencies []time.Duration
+	requests  map[string]int64
+}
+
+// Totals of a run, as reported in the JSON summary
+type SummaryTotals struct {
+	Objects  int64              `json:"objects"`
+	Bytes    int64              `json:"bytes"`
+	Skipped  int64              `json:"skipped"`
+	Failed   int64              `json:"failed"`
+	Latency  LatencyPercentiles `json:"latency_seconds"`
+	Requests map[string]int64   `json:"requests"`
+}
+
+// Percentiles of the time taken to transfer each object, in seconds
+type LatencyPercentiles struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+func NewRunSummary() *RunSummary {
+	return &RunSummary{requests: map[string]int64{}}
+}
+
+func (s *RunSummary) objectDone(size int64, latency time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects++
+	s.bytes += size
+	s.latencies = append(s.latencies, latency)
+}
+
+func (s *RunSummary) objectSkipped() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.skipped++
+}
+
+func (s *RunSummary) objectFailed() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failed++
+}
+
+func (s *RunSummary) request(operation string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[operation]++
+}
+
+// Returns the totals so far
+func (s *RunSummary) Totals() SummaryTotals {
+	if s == nil {
+		return SummaryTotals{Requests: map[string]int64{}}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := SummaryTotals{
+		Objects:  s.objects,
+		Bytes:    s.bytes,
+		Skipped:  s.skipped,
+		Failed:   s.failed,
+		Requests: map[string]int64{},
+	}
+	for op, n := range s.requests {
+		t.Requests[op] = n
+	}
+
+	latencies := append([]time.Duration(nil), s.latencies...)
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	t.Latency = LatencyPercentiles{
+		P50: percentile(latencies, 50),
+		P90: percentile(latencies, 90),
+		P99: percentile(latencies, 99),
+		Max: percentile(latencies, 100),
+	}
+	return t
+}
+
+// Returns the nearest rank percentile of the sorted latencies in seconds, 0 when there are none
+func percentile(sorted []time.Duration, p int) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1].Seconds()
+}
+
+// Returns middleware counting each operation, E.g. GetObject, towards the summary. Each attempt the retryer makes isn't counted
+func (s *RunSummary) countRequests(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("S3pdCountRequests", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+		s.request(middleware.GetOperationName(ctx))
+		return next.HandleInitialize(ctx, in)
+	}), middleware.Before)
+}
@@ -0,0 +1,38 @@
+package downloaders
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRunSummaryTotals(t *testing.T) {
+	s := NewRunSummary()
+	for i := 1; i <= 100; i++ {
+		s.objectDone(10, time.Duration(i)*time.Second)
+	}
+	s.objectSkipped()
+	s.objectFailed()
+	s.request("GetObject")
+	s.request("GetObject")
+
+	totals := s.Totals()
+	if totals.Objects != 100 || totals.Bytes != 1000 || totals.Skipped != 1 || totals.Failed != 1 {
+		t.Errorf("Unexpected totals %+v", totals)
+	}
+	expected := LatencyPercentiles{P50: 50, P90: 90, P99: 99, Max: 100}
+	if totals.Latency != expected {
+		t.Errorf("Expected latencies %+v, got %+v", expected, totals.Latency)
+	}
+	if totals.Requests["GetObject"] != 2 {
+		t.Errorf("Expected 2 GetObject requests, got %v", totals.Requests)
+	}
+}
+
+func TestNilRunSummary(t *testing.T) {
+	var s *RunSummary
+	s.objectDone(10, time.Second)
+	s.objectFailed()
+	if totals := s.Totals(); totals.Objects != 0 || totals.Latency.Max != 0 {
+		t.Errorf("Expected a nil summary to record nothing, got %+v", totals)
+	}
+}
@@ -0,0 +1,441 @@
+package downloaders
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/cheggaaa/pb/v3"
+	"github.com/op/go-logging"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// First field of a tar index's first line, which is followed by the tar object's ETag & size
+const tarIndexMagic = "s3pd-tar-index"
+
+// Bytes fetched by each ranged GET when reading a tar object's headers
+const tarIndexReadAhead = 64 * 1024
+
+// Where a tar object's index is kept, an S3 object when Bucket is set, otherwise a local file
+type TarIndexLocation struct {
+	Path   string
+	Bucket string
+	Key    string
+}
+
+func (l TarIndexLocation) String() string {
+	if len(l.Bucket) != 0 {
+		return fmt.Sprintf("s3://%s/%s", l.Bucket, l.Key)
+	}
+	return l.Path
+}
+
+// File in a tar object, and where its data is in the object
+type tarIndexEntry struct {
+	Name    string
+	Offset  int64
+	Size    int64
+	Mode    int64
+	ModTime time.Time
+}
+
+// Index of the files in a tar object, which is only valid for the version of the object with the ETag
+type tarIndex struct {
+	ETag    string
+	Size    int64
+	Entries []tarIndexEntry
+}
+
+// Writes the index as tab separated values
+func (x tarIndex) write(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Comma = '\t'
+	cw.Write([]string{tarIndexMagic, x.ETag, strconv.FormatInt(x.Size, 10)})
+	cw.Write([]string{"name", "offset", "size", "mode", "mtime"})
+	for _, e := range x.Entries {
+		cw.Write([]string{
+			e.Name,
+			strconv.FormatInt(e.Offset, 10),
+			strconv.FormatInt(e.Size, 10),
+			strconv.FormatInt(e.Mode, 8),
+			strconv.FormatInt(e.ModTime.Unix(), 10),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func readTarIndex(r io.Reader) (tarIndex, error) {
+	cr := csv.NewReader(r)
+	cr.Comma = '\t'
+	cr.FieldsPerRecord = -1
+	rows, err := cr.ReadAll()
+	if err != nil {
+		return tarIndex{}, err
+	}
+	if len(rows) < 2 || len(rows[0]) != 3 || rows[0][0] != tarIndexMagic {
+		return tarIndex{}, errors.New("not a tar index made by s3pd --index-tar")
+	}
+
+	x := tarIndex{ETag: rows[0][1]}
+	if x.Size, err = strconv.ParseInt(rows[0][2], 10, 64); err != nil {
+		return tarIndex{}, err
+	}
+	for _, row := range rows[2:] {
+		if len(row) != 5 {
+			return tarIndex{}, fmt.Errorf("tar index row %q should have 5 fields", row)
+		}
+		e := tarIndexEntry{Name: row[0]}
+		var mtime int64
+		if e.Offset, err = strconv.ParseInt(row[1], 10, 64); err == nil {
+			if e.Size, err = strconv.ParseInt(row[2], 10, 64); err == nil {
+				if e.Mode, err = strconv.ParseInt(row[3], 8, 64); err == nil {
+					mtime, err = strconv.ParseInt(row[4], 10, 64)
+				}
+			}
+		}
+		if err != nil {
+			return tarIndex{}, fmt.Errorf("tar index row %q: %w", row, err)
+		}
+		e.ModTime = time.Unix(mtime, 0)
+		x.Entries = append(x.Entries, e)
+	}
+	return x, nil
+}
+
+// Reads the index from a local file or S3 object
+func (l TarIndexLocation) load(ctx context.Context, client *s3.Client, request S3RequestOptions) (tarIndex, error) {
+	var r io.ReadCloser
+	if len(l.Bucket) != 0 {
+		input := &s3.GetObjectInput{
+			Bucket: aws.String(l.Bucket),
+			Key:    aws.String(l.Key),
+		}
+		request.applyGet(input)
+		out, err := client.GetObject(ctx, input)
+		if err != nil {
+			return tarIndex{}, err
+		}
+		r = out.Body
+	} else {
+		f, err := os.Open(l.Path)
+		if err != nil {
+			return tarIndex{}, err
+		}
+		r = f
+	}
+	defer r.Close()
+
+	x, err := readTarIndex(r)
+	if err != nil {
+		return tarIndex{}, fmt.Errorf("%s: %w", l, err)
+	}
+	return x, nil
+}
+
+// Writes the index to a local file or S3 object
+func (l TarIndexLocation) store(ctx context.Context, client *s3.Client, request S3RequestOptions, x tarIndex, stats *Stats) error {
+	if len(l.Bucket) == 0 {
+		if err := os.MkdirAll(filepath.Dir(l.Path), os.ModePerm); err != nil {
+			return err
+		}
+		f, err := os.Create(l.Path)
+		if err != nil {
+			return err
+		}
+		err = x.write(statsWriter{w: f, stats: stats})
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := x.write(&buf); err != nil {
+		return err
+	}
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(l.Bucket),
+		Key:         aws.String(l.Key),
+		Body:        bytes.NewReader(buf.Bytes()),
+		ContentType: aws.String("text/tab-separated-values"),
+	}
+	request.applyPut(input)
+	if _, err := client.PutObject(ctx, input); err != nil {
+		return err
+	}
+	stats.addWritten(int64(buf.Len()))
+	return nil
+}
+
+// Reads an object in order with ranged GETs of tarIndexReadAhead bytes. Seeking skips over bytes without fetching them
+type rangeReadSeeker struct {
+	ctx   context.Context
+	fetch fetchFunc
+	size  int64
+	pos   int64
+
+	// bytes of the object starting at bufOffset
+	buf       []byte
+	bufOffset int64
+}
+
+func (r *rangeReadSeeker) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if r.pos < r.bufOffset || r.pos >= r.bufOffset+int64(len(r.buf)) {
+		n := int64(tarIndexReadAhead)
+		if r.size-r.pos < n {
+			n = r.size - r.pos
+		}
+		if int64(cap(r.buf)) < n {
+			r.buf = make([]byte, n)
+		}
+		if err := r.fetch(r.ctx, r.pos, r.buf[:n]); err != nil {
+			return 0, err
+		}
+		r.buf = r.buf[:n]
+		r.bufOffset = r.pos
+	}
+
+	n := copy(p, r.buf[r.pos-r.bufOffset:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *rangeReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start of the object")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// Scans the headers of a tar object with ranged GETs, skipping over the data of its files,
+// and stores an index of where each file's data is
+type TarIndexer struct {
+	Bucket    string
+	Key       string
+	VersionId string
+	Index     TarIndexLocation
+	Client    S3ClientConfig
+	Request   S3RequestOptions
+
+	Bar   *pb.ProgressBar
+	Log   *logging.Logger
+	stats *Stats
+
+	// Counts the indexed archive, and the requests made, when set
+	Summary *RunSummary
+}
+
+func (d *TarIndexer) Start(ctx context.Context) error {
+	d.stats = newStats()
+	defer d.stats.finish()
+
+	clientConfig := d.Client
+	clientConfig.Stats = d.stats
+	clientConfig.Summary = d.Summary
+	client, err := NewS3Client(ctx, clientConfig)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	j, err := headArchive(ctx, client, d.Bucket, d.Key, d.VersionId, d.Request)
+	if err != nil {
+		return err
+	}
+
+	// the progress bar shows how far through the object the scan is, rather than the bytes fetched
+	d.Bar.SetTotal(j.Size)
+	d.Bar.Start()
+
+	r := &rangeReadSeeker{ctx: ctx, fetch: newRangeFetcher(client, d.Bucket, d.Request, nil, j), size: j.Size}
+	tr := tar.NewReader(r)
+	x := tarIndex{ETag: j.ETag, Size: j.Size}
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("s3://%s/%s: %w", d.Bucket, d.Key, err)
+		}
+		d.Bar.SetCurrent(r.pos)
+
+		// only files have data to extract, folders are created for the files in them
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		x.Entries = append(x.Entries, tarIndexEntry{
+			Name:    h.Name,
+			Offset:  r.pos,
+			Size:    h.Size,
+			Mode:    h.Mode,
+			ModTime: h.ModTime,
+		})
+	}
+	d.Bar.SetCurrent(j.Size)
+
+	if err := d.Index.store(ctx, client, d.Request, x, d.stats); err != nil {
+		return err
+	}
+	d.Summary.objectDone(j.Size, time.Since(start))
+	d.Bar.Finish()
+	d.Log.Noticef("Indexed the %d files in s3://%s/%s to %s\n", len(x.Entries), d.Bucket, d.Key, d.Index)
+	return nil
+}
+
+func (d TarIndexer) Stats() *Stats {
+	return d.stats
+}
+
+// Extracts the files of a tar object matching the include patterns using the object's index,
+// fetching only the ranges of the files being extracted with concurrent ranged GETs
+type TarExtract struct {
+	Bucket    string
+	Key       string
+	VersionId string
+	Index     TarIndexLocation
+	Writepath string
+
+	// path.Match patterns matched against each file's name & the folders it's in
+	Include []string
+
+	Workers  uint
+	Threads  uint
+	Partsize int64
+	Client   S3ClientConfig
+	Request  S3RequestOptions
+
+	Bar   *pb.ProgressBar
+	Log   *logging.Logger
+	stats *Stats
+
+	// Counts the files extracted & failed, and the requests made, when set
+	Summary *RunSummary
+}
+
+func (d *TarExtract) Start(ctx context.Context) error {
+	d.stats = newStats()
+	defer d.stats.finish()
+
+	clientConfig := d.Client
+	if clientConfig.HTTP.MaxIdleConnsPerHost == 0 {
+		clientConfig.HTTP.MaxIdleConnsPerHost = int(d.Workers * d.Threads)
+	}
+	clientConfig.Stats = d.stats
+	clientConfig.Summary = d.Summary
+	client, err := NewS3Client(ctx, clientConfig)
+	if err != nil {
+		return err
+	}
+
+	x, err := d.Index.load(ctx, client, d.Request)
+	if err != nil {
+		return err
+	}
+	j, err := headArchive(ctx, client, d.Bucket, d.Key, d.VersionId, d.Request)
+	if err != nil {
+		return err
+	}
+	if j.ETag != x.ETag || j.Size != x.Size {
+		return fmt.Errorf("s3://%s/%s has changed since it was indexed, re-run s3pd --index-tar", d.Bucket, d.Key)
+	}
+
+	files := latestEntries(x.Entries, d.Include)
+	var total int64
+	for _, e := range files {
+		total += e.Size
+	}
+	d.Log.Noticef("Extracting %d of the %d files in s3://%s/%s\n", len(files), len(x.Entries), d.Bucket, d.Key)
+	d.Bar.SetTotal(total)
+	d.Bar.Start()
+
+	err = extractEach(ctx, int(d.Workers), files, func(ctx context.Context, e tarIndexEntry) error {
+		start := time.Now()
+		if err := d.extractFile(ctx, client, j, e); err != nil {
+			d.Summary.objectFailed()
+			return err
+		}
+		d.Summary.objectDone(e.Size, time.Since(start))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	d.Bar.Finish()
+	return nil
+}
+
+// Returns the entries matching the include patterns. An archive can have the same file more than once, E.g. from tar --append,
+// so only the last entry for each path is kept, as extracting the archive with tar would leave. Otherwise they'd be written concurrently
+func latestEntries(entries []tarIndexEntry, include []string) []tarIndexEntry {
+	var files []tarIndexEntry
+	seen := map[string]int{}
+	for _, e := range entries {
+		if !matchesInclude(include, e.Name) {
+			continue
+		}
+		rel, _, err := safeRelativePath(archiveMemberName(e.Name))
+		if err == nil {
+			if i, ok := seen[rel]; ok {
+				files[i] = e
+				continue
+			}
+			seen[rel] = len(files)
+		}
+		files = append(files, e)
+	}
+	return files
+}
+
+// Writes the file to its path under the download path, fetching its data with concurrent ranged GETs
+func (d TarExtract) extractFile(ctx context.Context, client *s3.Client, j S3ObjectJob, e tarIndexEntry) error {
+	rel, _, err := safeRelativePath(archiveMemberName(e.Name))
+	if err != nil {
+		d.Log.Warningf("Skipping the file %q: %v\n", e.Name, err)
+		return nil
+	}
+	objWritePath := filepath.Join(d.Writepath, rel)
+	d.Log.Debugf("Writing %s from s3://%s/%s to %s [%.2fMiB]\n", e.Name, d.Bucket, d.Key, objWritePath, float64(e.Size)/1024/1024)
+
+	if err := os.MkdirAll(filepath.Dir(objWritePath), os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(objWritePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(e.Mode).Perm()|0600)
+	if err != nil {
+		return err
+	}
+
+	fetch := newRangeFetcher(client, d.Bucket, d.Request, d.Bar, j)
+	err = fetchPartsAt(ctx, statsWriterAt{w: f, stats: d.stats}, 0, e.Size, d.Partsize, int(d.Threads), func(ctx context.Context, offset int64, buf []byte) error {
+		return fetch(ctx, e.Offset+offset, buf)
+	})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(objWritePath, e.ModTime, e.ModTime)
+}
+
+func (d TarExtract) Stats() *Stats {
+	return d.stats
+}
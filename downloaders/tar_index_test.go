@@ -0,0 +1,176 @@
+package downloaders
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"github.com/op/go-logging"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTarIndexRoundTrip(t *testing.T) {
+	x := tarIndex{ETag: "abc123", Size: 10240, Entries: []tarIndexEntry{
+		{Name: "data/a b.txt", Offset: 512, Size: 5, Mode: 0644, ModTime: time.Unix(1700000000, 0)},
+		{Name: "data/\"quoted\".bin", Offset: 1536, Size: 0, Mode: 0755, ModTime: time.Unix(1700000001, 0)},
+	}}
+
+	var buf bytes.Buffer
+	if err := x.write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	read, err := readTarIndex(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(x, read) {
+		t.Errorf("Expected %+v, got %+v", x, read)
+	}
+
+	if _, err := readTarIndex(bytes.NewBufferString("key\tshard\toffset\tsize\n")); err == nil {
+		t.Error("Expected files that aren't tar indexes to be rejected")
+	}
+}
+
+func TestLatestEntries(t *testing.T) {
+	entries := []tarIndexEntry{
+		{Name: "data/a.txt", Offset: 512, Size: 5},
+		{Name: "data/b.txt", Offset: 1536, Size: 3},
+		{Name: "labels/c.txt", Offset: 2560, Size: 1},
+		// appended again, under a name that's extracted to the same path
+		{Name: "./data/a.txt", Offset: 3584, Size: 7},
+	}
+	expected := []tarIndexEntry{
+		{Name: "./data/a.txt", Offset: 3584, Size: 7},
+		{Name: "data/b.txt", Offset: 1536, Size: 3},
+	}
+	if files := latestEntries(entries, []string{"data"}); !reflect.DeepEqual(files, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, files)
+	}
+}
+
+func TestRangeReadSeeker(t *testing.T) {
+	big := make([]byte, 3*tarIndexReadAhead)
+	rand.Read(big)
+	bodies := map[string][]byte{"big.bin": big, "small.txt": []byte("small")}
+	archive := tarBytes(t, []tar.Header{
+		{Name: "big.bin", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "small.txt", Typeflag: tar.TypeReg, Mode: 0644},
+	}, bodies)
+
+	var fetched int64
+	r := &rangeReadSeeker{
+		ctx:  context.Background(),
+		size: int64(len(archive)),
+		fetch: func(ctx context.Context, offset int64, buf []byte) error {
+			fetched += int64(len(buf))
+			copy(buf, archive[offset:])
+			return nil
+		},
+	}
+
+	tr := tar.NewReader(r)
+	offsets := map[string]int64{}
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets[h.Name] = r.pos
+	}
+
+	for name, body := range bodies {
+		offset := offsets[name]
+		if !bytes.Equal(archive[offset:offset+int64(len(body))], body) {
+			t.Errorf("Expected the offset of %s to be where its data is", name)
+		}
+	}
+	if fetched >= int64(len(archive)) {
+		t.Errorf("Expected the data of files to be skipped, fetched %d of %d bytes", fetched, len(archive))
+	}
+}
+
+func TestTarIndexS3(t *testing.T) {
+	clientConfig := testS3ClientConfig(t)
+	client, err := NewS3Client(context.Background(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	big := make([]byte, 3*1024*1024)
+	rand.Read(big)
+	mtime := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	bodies := map[string][]byte{
+		"./data/big.bin":   big,
+		"./data/text.txt":  []byte("text"),
+		"./other/skip.txt": []byte("skipped"),
+	}
+	archive := tarBytes(t, []tar.Header{
+		{Name: "./data/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "./data/big.bin", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime},
+		{Name: "./data/text.txt", Typeflag: tar.TypeReg, Mode: 0600, ModTime: mtime},
+		{Name: "./other/skip.txt", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime},
+	}, bodies)
+	createTestObjects(t, client, "s3pd-test", map[string][]byte{"tar/dataset.tar": archive})
+
+	index := TarIndexLocation{Bucket: "s3pd-test", Key: "tar/dataset.tar.index.tsv"}
+	indexer := TarIndexer{
+		Bucket: "s3pd-test",
+		Key:    "tar/dataset.tar",
+		Index:  index,
+		Client: clientConfig,
+		Bar:    newTestBar(),
+		Log:    logging.MustGetLogger("s3pd-test"),
+	}
+	if err := indexer.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	d := TarExtract{
+		Bucket:    "s3pd-test",
+		Key:       "tar/dataset.tar",
+		Index:     index,
+		Writepath: dir,
+		Include:   []string{"data"},
+		Workers:   2,
+		Threads:   3,
+		Partsize:  1024 * 1024,
+		Client:    clientConfig,
+		Bar:       newTestBar(),
+		Log:       logging.MustGetLogger("s3pd-test"),
+	}
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"./data/big.bin", "./data/text.txt"} {
+		path := filepath.Join(dir, name)
+		data, err := ioutil.ReadFile(path)
+		if err != nil || !bytes.Equal(data, bodies[name]) {
+			t.Errorf("Expected %s to be extracted, got %v", name, err)
+		}
+		if info, err := os.Stat(path); err != nil || !info.ModTime().Equal(mtime) {
+			t.Errorf("Expected %s to keep its modification time, got %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "other/skip.txt")); !os.IsNotExist(err) {
+		t.Error("Expected files that don't match to be skipped")
+	}
+
+	// the index is only valid for the version of the tar object it was made from
+	createTestObjects(t, client, "s3pd-test", map[string][]byte{"tar/dataset.tar": append(archive, make([]byte, tarBlockSize)...)})
+	if err := d.Start(context.Background()); err == nil {
+		t.Error("Expected a stale index to be rejected")
+	}
+}
@@ -30,3 +30,22 @@ func (l LogProgressWriteBuffer) WriteAt(p []byte, offset int64) (n int, err erro
 	l.bar.Add64(int64(len(p)))
 	return l.w.WriteAt(p, offset)
 }
+
+// Reader of a stream of unknown length, such-as stdin, which grows the progress bar's total as it's read.
+// The bar's progress is added as parts are uploaded. Only implements io.Reader, so that uploads buffer each part rather than seeking
+type ProgressStream struct {
+	bar  *pb.ProgressBar
+	r    io.Reader
+	read int64
+}
+
+func newProgressStream(bar *pb.ProgressBar, r io.Reader) *ProgressStream {
+	return &ProgressStream{bar: bar, r: r}
+}
+
+func (s *ProgressStream) Read(p []byte) (n int, err error) {
+	n, err = s.r.Read(p)
+	s.read += int64(n)
+	s.bar.SetTotal(s.read)
+	return n, err
+}
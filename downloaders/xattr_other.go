@@ -0,0 +1,17 @@
+//go:build !linux && !darwin
+
+package downloaders
+
+import (
+	"errors"
+)
+
+var errXattrUnsupported = errors.New("extended attributes are not supported on this OS")
+
+func setXattr(path string, attr string, value []byte) error {
+	return errXattrUnsupported
+}
+
+func getXattrs(path string, prefix string) (map[string][]byte, error) {
+	return nil, errXattrUnsupported
+}
@@ -0,0 +1,46 @@
+//go:build linux || darwin
+
+package downloaders
+
+import (
+	"bytes"
+	"golang.org/x/sys/unix"
+	"strings"
+)
+
+func setXattr(path string, attr string, value []byte) error {
+	return unix.Setxattr(path, attr, value, 0)
+}
+
+// Returns the file's extended attributes whose names start with the prefix
+func getXattrs(path string, prefix string) (map[string][]byte, error) {
+	size, err := unix.Listxattr(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]byte, size)
+	size, err = unix.Listxattr(path, names)
+	if err != nil {
+		return nil, err
+	}
+
+	// Names are returned NUL terminated
+	attrs := make(map[string][]byte)
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if len(name) == 0 || !strings.HasPrefix(string(name), prefix) {
+			continue
+		}
+
+		valueSize, err := unix.Getxattr(path, string(name), nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, valueSize)
+		valueSize, err = unix.Getxattr(path, string(name), value)
+		if err != nil {
+			return nil, err
+		}
+		attrs[string(name)] = value[:valueSize]
+	}
+	return attrs, nil
+}
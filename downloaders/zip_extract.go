@@ -0,0 +1,398 @@
+package downloaders
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/cheggaaa/pb/v3"
+	"github.com/op/go-logging"
+	"golang.org/x/sync/errgroup"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Signatures & lengths of the records at the end of a zip file, which locate its central directory
+const (
+	zipEndSignature       = 0x06054b50
+	zipEndLength          = 22
+	zipMaxCommentLength   = 65535
+	zip64LocatorSignature = 0x07064b50
+	zip64LocatorLength    = 20
+	zip64EndSignature     = 0x06064b50
+	zip64EndLength        = 56
+)
+
+// Downloads the members of a zip object that match the include patterns, without downloading the rest of the archive.
+// The central directory is read with ranged GETs, then each member's compressed bytes are fetched with concurrent
+// ranged GETs & inflated locally
+type ZipExtract struct {
+	Bucket    string
+	Key       string
+	VersionId string
+	Writepath string
+
+	// path.Match patterns matched against each member's name & the folders it's in. Every member matches when empty
+	Include []string
+
+	// Matching members are listed to List, rather than extracted, when set
+	List io.Writer
+
+	Workers  uint
+	Threads  uint
+	Partsize int64
+	Client   S3ClientConfig
+	Request  S3RequestOptions
+
+	Bar   *pb.ProgressBar
+	Log   *logging.Logger
+	stats *Stats
+
+	// Counts the members extracted & failed, and the requests made, when set
+	Summary *RunSummary
+}
+
+func (d *ZipExtract) Start(ctx context.Context) error {
+	d.stats = newStats()
+	defer d.stats.finish()
+
+	clientConfig := d.Client
+	if clientConfig.HTTP.MaxIdleConnsPerHost == 0 {
+		clientConfig.HTTP.MaxIdleConnsPerHost = int(d.Workers * d.Threads)
+	}
+	clientConfig.Stats = d.stats
+	clientConfig.Summary = d.Summary
+	client, err := NewS3Client(ctx, clientConfig)
+	if err != nil {
+		return err
+	}
+
+	j, err := headArchive(ctx, client, d.Bucket, d.Key, d.VersionId, d.Request)
+	if err != nil {
+		return err
+	}
+	archive, err := d.openArchive(ctx, client, j)
+	if err != nil {
+		return err
+	}
+
+	var members []*zip.File
+	var total int64
+	for _, f := range archive.File {
+		if matchesInclude(d.Include, f.Name) {
+			members = append(members, f)
+			total += int64(f.CompressedSize64)
+		}
+	}
+
+	if d.List != nil {
+		for _, f := range members {
+			fmt.Fprintf(d.List, "%d\t%d\t%s\n", f.UncompressedSize64, f.CompressedSize64, f.Name)
+		}
+		return nil
+	}
+
+	d.Log.Noticef("Extracting %d of the %d members of s3://%s/%s\n", len(members), len(archive.File), d.Bucket, d.Key)
+	d.Bar.SetTotal(total)
+	d.Bar.Start()
+
+	err = extractEach(ctx, int(d.Workers), members, func(ctx context.Context, f *zip.File) error {
+		start := time.Now()
+		if err := d.extractMember(ctx, client, j, f); err != nil {
+			d.Summary.objectFailed()
+			return err
+		}
+		d.Summary.objectDone(int64(f.UncompressedSize64), time.Since(start))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	d.Bar.Finish()
+	return nil
+}
+
+// Returns the size & ETag of an archive object, so that every ranged GET reads the same object
+func headArchive(ctx context.Context, client *s3.Client, bucket string, key string, versionId string, request S3RequestOptions) (S3ObjectJob, error) {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if len(versionId) != 0 {
+		input.VersionId = aws.String(versionId)
+	}
+	request.applyHead(input)
+
+	head, err := client.HeadObject(ctx, input)
+	if err != nil {
+		return S3ObjectJob{}, err
+	}
+	return S3ObjectJob{
+		Key:       key,
+		VersionId: versionId,
+		Size:      aws.ToInt64(head.ContentLength),
+		ETag:      trimETag(aws.ToString(head.ETag)),
+	}, nil
+}
+
+// Extracts each of the files from an archive with workers concurrent workers, stopping at the first that fails
+func extractEach[T any](ctx context.Context, workers int, files []T, extract func(context.Context, T) error) error {
+	jobs := make(chan T)
+	eg, ctx := errgroup.WithContext(ctx)
+	for w := 1; w <= workers; w++ {
+		eg.Go(func() error {
+			for f := range jobs {
+				if err := extract(ctx, f); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	eg.Go(func() error {
+		defer close(jobs)
+		for _, f := range files {
+			select {
+			case jobs <- f:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+	return eg.Wait()
+}
+
+// Whether the member's name, or one of the folders it's in, matches one of the patterns. Everything matches when there are no patterns
+func matchesInclude(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for n := strings.TrimSuffix(name, "/"); len(n) != 0 && n != "." && n != "/"; n = path.Dir(n) {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, n); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Opens the zip object. The end of the object & its central directory are fetched up front,
+// so that reading the list of members doesn't take a request per member
+func (d ZipExtract) openArchive(ctx context.Context, client *s3.Client, j S3ObjectJob) (*zip.Reader, error) {
+	r := &zipReaderAt{
+		ctx:      ctx,
+		fetch:    newRangeFetcher(client, d.Bucket, d.Request, nil, j),
+		partsize: d.Partsize,
+		threads:  int(d.Threads),
+	}
+
+	tailSize := int64(zipEndLength + zipMaxCommentLength + zip64LocatorLength)
+	if j.Size < tailSize {
+		tailSize = j.Size
+	}
+	tail, err := r.cache(j.Size-tailSize, tailSize)
+	if err != nil {
+		return nil, err
+	}
+
+	dirOffset, dirSize, err := findCentralDirectory(tail, r)
+	if err != nil {
+		return nil, fmt.Errorf("s3://%s/%s: %w", d.Bucket, d.Key, err)
+	}
+	// the directory might not be where the end record says when the archive has data before it, e.g. a self-extracting
+	// archive, in which case the directory is read with ranged GETs instead
+	if dirOffset+dirSize <= j.Size {
+		if _, err := r.cache(dirOffset, dirSize); err != nil {
+			return nil, err
+		}
+	}
+
+	archive, err := zip.NewReader(r, j.Size)
+	// member names are made safe when they're extracted
+	if err == zip.ErrInsecurePath {
+		err = nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("s3://%s/%s: %w", d.Bucket, d.Key, err)
+	}
+	return archive, nil
+}
+
+// Returns the offset & size of the central directory, from the end record in the tail of the zip file
+func findCentralDirectory(tail []byte, r io.ReaderAt) (offset, size int64, err error) {
+	// the end record is followed by a comment, so search backwards for the record whose comment reaches the end of the file
+	end := -1
+	for i := len(tail) - zipEndLength; i >= 0; i-- {
+		if binary.LittleEndian.Uint32(tail[i:]) == zipEndSignature &&
+			i+zipEndLength+int(binary.LittleEndian.Uint16(tail[i+20:])) <= len(tail) {
+			end = i
+			break
+		}
+	}
+	if end < 0 {
+		return 0, 0, errors.New("not a zip file, the end of central directory record is missing")
+	}
+
+	record := tail[end:]
+	entries := binary.LittleEndian.Uint16(record[10:])
+	size = int64(binary.LittleEndian.Uint32(record[12:]))
+	offset = int64(binary.LittleEndian.Uint32(record[16:]))
+	if entries != 0xffff && size != 0xffffffff && offset != 0xffffffff {
+		return offset, size, nil
+	}
+
+	// Zip64 archives have a locator of the zip64 end record just before the end record
+	if end < zip64LocatorLength || binary.LittleEndian.Uint32(tail[end-zip64LocatorLength:]) != zip64LocatorSignature {
+		return offset, size, nil
+	}
+	record64 := make([]byte, zip64EndLength)
+	if _, err := r.ReadAt(record64, int64(binary.LittleEndian.Uint64(tail[end-zip64LocatorLength+8:]))); err != nil {
+		return 0, 0, err
+	}
+	if binary.LittleEndian.Uint32(record64) != zip64EndSignature {
+		return 0, 0, errors.New("invalid zip64 end of central directory record")
+	}
+	return int64(binary.LittleEndian.Uint64(record64[48:])), int64(binary.LittleEndian.Uint64(record64[40:])), nil
+}
+
+// Writes the member to its path under the download path, fetching its compressed bytes with concurrent ranged GETs
+func (d ZipExtract) extractMember(ctx context.Context, client *s3.Client, j S3ObjectJob, f *zip.File) error {
+	rel, _, err := safeRelativePath(archiveMemberName(f.Name))
+	if err != nil {
+		d.Log.Warningf("Skipping the member %q: %v\n", f.Name, err)
+		return nil
+	}
+	objWritePath := filepath.Join(d.Writepath, rel)
+	if strings.HasSuffix(f.Name, "/") {
+		return os.MkdirAll(objWritePath, os.ModePerm)
+	}
+
+	if f.Flags&0x1 != 0 {
+		return fmt.Errorf("the member %q is encrypted", f.Name)
+	}
+	var inflate func(io.Reader) io.ReadCloser
+	switch f.Method {
+	case zip.Store:
+		inflate = ioutil.NopCloser
+	case zip.Deflate:
+		inflate = flate.NewReader
+	default:
+		return fmt.Errorf("the member %q uses the unsupported compression method %d", f.Name, f.Method)
+	}
+
+	// the member's data is after its local header, which has to be read to find its length
+	dataOffset, err := f.DataOffset()
+	if err != nil {
+		return err
+	}
+	d.Log.Debugf("Writing %s from s3://%s/%s to %s [%.2fMiB]\n",
+		f.Name, d.Bucket, d.Key, objWritePath, float64(f.CompressedSize64)/1024/1024)
+
+	if err := os.MkdirAll(filepath.Dir(objWritePath), os.ModePerm); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(objWritePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode().Perm()|0600)
+	if err != nil {
+		return err
+	}
+
+	fetch := newRangeFetcher(client, d.Bucket, d.Request, d.Bar, j)
+	err = consumeParts(ctx, int64(f.CompressedSize64), d.Partsize, int(d.Threads), 2*int(d.Threads),
+		func(ctx context.Context, offset int64, buf []byte) error {
+			return fetch(ctx, dataOffset+offset, buf)
+		},
+		func(r io.Reader) error {
+			rc := inflate(r)
+			defer rc.Close()
+
+			crc := crc32.NewIEEE()
+			n, err := io.Copy(io.MultiWriter(statsWriter{w: out, stats: d.stats}, crc), rc)
+			if err != nil {
+				return err
+			}
+			if uint64(n) != f.UncompressedSize64 || crc.Sum32() != f.CRC32 {
+				return fmt.Errorf("the member %q doesn't match its checksum", f.Name)
+			}
+			return nil
+		})
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if f.Modified.IsZero() {
+		return nil
+	}
+	return os.Chtimes(objWritePath, f.Modified, f.Modified)
+}
+
+func (d ZipExtract) Stats() *Stats {
+	return d.stats
+}
+
+// Reads a zip object using ranged GETs, except for the ranges of it that have been cached in memory
+type zipReaderAt struct {
+	ctx      context.Context
+	fetch    fetchFunc
+	partsize int64
+	threads  int
+	cached   []cachedRange
+}
+
+type cachedRange struct {
+	offset int64
+	data   []byte
+}
+
+// Fetches size bytes at offset, using concurrent ranged GETs, and keeps them in memory
+func (r *zipReaderAt) cache(offset, size int64) ([]byte, error) {
+	data := make([]byte, size)
+	fetch := func(ctx context.Context, o int64, buf []byte) error {
+		return r.fetch(ctx, offset+o, buf)
+	}
+	if err := fetchPartsAt(r.ctx, memoryWriterAt(data), 0, size, r.partsize, r.threads, fetch); err != nil {
+		return nil, err
+	}
+	r.cached = append(r.cached, cachedRange{offset: offset, data: data})
+	return data, nil
+}
+
+func (r *zipReaderAt) ReadAt(p []byte, offset int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for _, c := range r.cached {
+		if offset >= c.offset && offset+int64(len(p)) <= c.offset+int64(len(c.data)) {
+			return copy(p, c.data[offset-c.offset:]), nil
+		}
+	}
+	if err := r.fetch(r.ctx, offset, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Writes to a byte slice that's already the full size
+type memoryWriterAt []byte
+
+func (m memoryWriterAt) WriteAt(p []byte, offset int64) (int, error) {
+	if offset+int64(len(p)) > int64(len(m)) {
+		return 0, io.ErrShortWrite
+	}
+	return copy(m[offset:], p), nil
+}
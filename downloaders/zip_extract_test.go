@@ -0,0 +1,144 @@
+package downloaders
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"github.com/op/go-logging"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Returns a zip archive of the given members, stored uncompressed when their name ends in .bin
+func zipBytes(t *testing.T, members map[string][]byte, comment string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, body := range members {
+		method := zip.Deflate
+		if strings.HasSuffix(name, ".bin") {
+			method = zip.Store
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.SetComment(comment); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestFindCentralDirectory(t *testing.T) {
+	// the comment holds what looks like another end record
+	archive := zipBytes(t, map[string][]byte{"a.txt": []byte("a"), "b/c.txt": []byte("c")}, "PK\x05\x06 comment")
+	fetch := func(ctx context.Context, offset int64, buf []byte) error {
+		copy(buf, archive[offset:])
+		return nil
+	}
+	r := &zipReaderAt{ctx: context.Background(), fetch: fetch, partsize: 16, threads: 2}
+	tail, err := r.cache(0, int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offset, size, err := findCentralDirectory(tail, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(archive[offset:], []byte("PK\x01\x02")) || !bytes.HasPrefix(archive[offset+size:], []byte("PK\x05\x06")) {
+		t.Errorf("Expected the central directory to be found, got %d bytes at %d", size, offset)
+	}
+
+	if _, _, err := findCentralDirectory([]byte("not a zip file at all"), r); err == nil {
+		t.Error("Expected a file without an end record to be rejected")
+	}
+}
+
+func TestMatchesInclude(t *testing.T) {
+	patterns := []string{"images/*.jpg", "docs"}
+	matches := map[string]bool{
+		"images/a.jpg":     true,
+		"images/a.png":     false,
+		"images/sub/a.jpg": false,
+		"docs/":            true,
+		"docs/guide/a.md":  true,
+		"other/docs.md":    false,
+	}
+	for name, expected := range matches {
+		if matchesInclude(patterns, name) != expected {
+			t.Errorf("Expected %s matching to be %v", name, expected)
+		}
+	}
+	if !matchesInclude(nil, "anything") {
+		t.Error("Expected every member to match without include patterns")
+	}
+}
+
+func TestZipExtractS3(t *testing.T) {
+	clientConfig := testS3ClientConfig(t)
+	client, err := NewS3Client(context.Background(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	big := make([]byte, 3*1024*1024)
+	rand.Read(big)
+	members := map[string][]byte{
+		"data/big.bin":      big,
+		"data/text.txt":     bytes.Repeat([]byte("deflated "), 500*1024),
+		"data/skipped.txt":  []byte("skipped"),
+		"../escape/big.bin": []byte("escape"),
+	}
+	createTestObjects(t, client, "s3pd-test", map[string][]byte{"zip/archive.zip": zipBytes(t, members, "")})
+
+	dir := t.TempDir()
+	d := ZipExtract{
+		Bucket:    "s3pd-test",
+		Key:       "zip/archive.zip",
+		Writepath: dir,
+		Include:   []string{"data/*.bin", "data/text.txt", "../escape"},
+		Workers:   2,
+		Threads:   3,
+		Partsize:  1024 * 1024,
+		Client:    clientConfig,
+		Bar:       newTestBar(),
+		Log:       logging.MustGetLogger("s3pd-test"),
+	}
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"data/big.bin", "data/text.txt"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil || !bytes.Equal(data, members[name]) {
+			t.Errorf("Expected %s to be extracted, got %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "data/skipped.txt")); !os.IsNotExist(err) {
+		t.Error("Expected members that don't match to be skipped")
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "%2E%2E/escape/big.bin")); err != nil || string(data) != "escape" {
+		t.Errorf("Expected member names to be made safe, got %v", err)
+	}
+
+	var list bytes.Buffer
+	d.Include = []string{"data/*.txt"}
+	d.List = &list
+	if err := d.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(list.String()), "\n"); len(lines) != 2 {
+		t.Errorf("Expected the 2 matching members to be listed, got %q", list.String())
+	}
+}
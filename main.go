@@ -9,15 +9,26 @@ import (
 	"github.com/op/go-logging"
 	"net/url"
 	"os"
+	"os/signal"
 	"runtime/pprof"
 	"strings"
+	"syscall"
+	"time"
 )
 
+// How long an interrupted run waits for the transfer to stop before writing its summary & exiting
+const shutdownGrace = 10 * time.Second
+
 func main() {
+	os.Exit(run())
+}
+
+// Runs s3pd, returning the exit code
+func run() int {
 	c, err := NewConfig(os.Args)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "\033[1;31m"+err.Error()+"\033[0m")
-		os.Exit(1)
+		return exitConfig
 	}
 
 	// Let user know if benchmark mode is enabled
@@ -34,7 +45,7 @@ func main() {
 		f, err := os.Create(c.cpuprofile)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, "\033[1;31m"+err.Error()+"\033[0m")
-			os.Exit(1)
+			return exitConfig
 		}
 		pprof.StartCPUProfile(f)
 		defer pprof.StopCPUProfile()
@@ -54,30 +65,128 @@ func main() {
 	lm.SetLevel(logLevels[strings.ToUpper(c.loglevel)], "")
 	logging.SetBackend(lm)
 
+	// When streaming objects or listing zip members to stdout, everything else is written to stderr
+	out := os.Stdout
+	if c.StreamsToStdout() || c.zipList {
+		out = os.Stderr
+	}
+
 	bar := pb.New(1) // putting bar size of 1 as a placeholder
-	bar.SetWriter(os.Stdout)
+	bar.SetWriter(out)
 	bar.Set(pb.SIBytesPrefix, false)
 	bar.Set(pb.Bytes, true)
 
 	d, err := getDownloader(c, log, bar)
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, "\033[1;31m"+err.Error()+"\033[0m")
+		return exitConfig
+	}
+
+	// Counts the objects transferred, for the exit code & --summary-json
+	summary := downloaders.NewRunSummary()
+	switch d := d.(type) {
+	case *downloaders.S3Download:
+		d.Summary = summary
+	case *downloaders.FilesystemDownload:
+		d.Summary = summary
+	case *downloaders.S3Upload:
+		d.Summary = summary
+	case *downloaders.FanOut:
+		d.Summary = summary
+	case *downloaders.ZipExtract:
+		d.Summary = summary
+	case *downloaders.TarIndexer:
+		d.Summary = summary
+	case *downloaders.TarExtract:
+		d.Summary = summary
+	}
+
+	// Blocks until download is completed, on first error received, or until interrupted.
+	// Files being written when interrupted are left partially written
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	started := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- d.Start(ctx)
+	}()
+	var interrupted os.Signal
+	select {
+	case err = <-done:
+	case interrupted = <-signals:
+		cancel()
+		// a second signal exits straight away
+		signal.Stop(signals)
+		// give the transfer a chance to stop, so that the manifest & reports are closed & the stats finished
+		select {
+		case <-done:
+		case <-time.After(shutdownGrace):
+			log.Warningf("Gave up waiting %s for the transfer to stop\n", shutdownGrace)
+		}
+		err = errors.New("interrupted")
+	}
+
+	logIPStats(log, c.IPSpreader())
+	stats := d.Stats()
+	code := exitCode(err, interrupted, summary.Totals().Objects > 0)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "\033[1;31m"+err.Error()+"\033[0m")
+	} else {
+		fmt.Fprintf(out, "\nAverage throughput was: %0.4fGibps\n", stats.Throughput())
+	}
+
+	if len(c.summaryJSON) != 0 {
+		s := runSummary{
+			ExitCode:        code,
+			SummaryTotals:   summary.Totals(),
+			Started:         started,
+			Finished:        time.Now(),
+			ThroughputGibps: stats.Throughput(),
+			BytesWritten:    stats.BytesWritten(),
+			BytesReceived:   stats.BytesReceived(),
+			Samples:         stats.Samples(),
+			Config:          c.summaryConfig(os.Args),
+		}
+		if err != nil {
+			s.Error = err.Error()
+		}
+		if err := writeSummary(c.summaryJSON, s); err != nil {
+			fmt.Fprintln(os.Stderr, "\033[1;31m"+err.Error()+"\033[0m")
+			if code == exitSuccess {
+				code = exitError
+			}
+		}
 	}
+	return code
+}
 
-	// Blocks until download is completed or on first error received
-	if err := d.Start(context.Background()); err != nil {
-		panic(err)
+// Reports how connections were spread across S3's IPs with --spread-ips
+func logIPStats(log *logging.Logger, spreader *downloaders.IPSpreader) {
+	if spreader == nil {
+		return
 	}
 
-	fmt.Printf("\nAverage throughput was: %0.4fGibps\n", d.Throughput())
+	for _, st := range spreader.Stats() {
+		log.Noticef("%s: %d connections, %d dial errors, %.2fMiB received\n",
+			st.IP, st.Connections, st.DialErrors, float64(st.BytesReceived)/1024/1024)
+	}
 }
 
 // Parses the S3 bucket and object prefix from a string in format of "s3://bucket/prefix"
+// The bucket can also be an access point alias, a directory bucket (E.g. "mybucket--usw2-az1--x-s3"),
+// or an access point ARN such-as "s3://arn:aws:s3:us-west-2:123456789012:accesspoint/my-ap/prefix"
 func parseS3Path(path string) (bucket string, prefix string) {
 	if !strings.HasPrefix(path, "s3://") {
 		return "", ""
 	}
 
+	if strings.HasPrefix(path, "s3://arn:") {
+		return parseS3ARNPath(path[len("s3://"):])
+	}
+
 	u, _ := url.Parse(path)
 	bucket = u.Host
 	prefix = u.Path
@@ -89,26 +198,99 @@ func parseS3Path(path string) (bucket string, prefix string) {
 	return bucket, prefix
 }
 
+// Splits an access point ARN followed by an object prefix into the ARN & prefix.
+// Access point ARNs are in the form of "arn:partition:s3:region:account:accesspoint/name"
+// Multi-Region Access Points leave the region empty "arn:partition:s3::account:accesspoint/name.mrap"
+// and S3 on Outposts access points are "arn:partition:s3-outposts:region:account:outpost/id/accesspoint/name"
+func parseS3ARNPath(path string) (bucket string, prefix string) {
+	fields := strings.SplitN(path, ":", 6)
+	if len(fields) != 6 {
+		return "", ""
+	}
+
+	resourceParts := 2
+	switch fields[2] {
+	case "s3":
+	case "s3-outposts":
+		resourceParts = 4
+	default:
+		return "", ""
+	}
+
+	resource := strings.SplitN(fields[5], "/", resourceParts+1)
+	if len(resource) < resourceParts {
+		return "", ""
+	}
+	for _, part := range resource[:resourceParts] {
+		if len(part) == 0 {
+			return "", ""
+		}
+	}
+	// only access points can be used in place of a bucket, E.g. not arn:aws:s3:::bucket or an object lambda's ARN
+	if resource[resourceParts-2] != "accesspoint" || (resourceParts == 4 && resource[0] != "outpost") {
+		return "", ""
+	}
+
+	bucket = strings.Join(fields[:5], ":") + ":" + strings.Join(resource[:resourceParts], "/")
+	if len(resource) > resourceParts {
+		prefix = resource[resourceParts]
+	}
+	return bucket, prefix
+}
+
 // Returns a downloader for the given source
 func getDownloader(c *Config, log *logging.Logger, bar *pb.ProgressBar) (downloaders.Downloader, error) {
+	if len(c.destinations) > 1 {
+		return getFanOut(c, log, bar)
+	}
+	if c.ExtractsZip() {
+		return getZipExtract(c, log, bar)
+	}
+	if c.indexTar || c.ExtractsTar() {
+		return getTarIndexDownloader(c, log, bar)
+	}
+
 	isSourceS3 := strings.HasPrefix(c.source, "s3://")
 	isDestinationS3 := strings.HasPrefix(c.destination, "s3://")
 
 	if isSourceS3 && !isDestinationS3 {
 		bucket, prefix := parseS3Path(c.source)
+		if len(bucket) == 0 {
+			return nil, fmt.Errorf("Invalid S3 path %s", c.source)
+		}
 		d := downloaders.S3Download{
 			Bucket:      bucket,
 			Prefix:      prefix,
 			Writepath:   c.destination,
-			Region:      c.region,
 			Workers:     c.workers,
 			Threads:     c.threads,
 			Partsize:    c.partsize,
 			MaxList:     c.maxList,
 			IsBenchmark: c.isBenchmark,
-			NICs:        c.NicsArr(),
-			Log:         log,
-			Bar:         bar,
+			Client:      c.SourceS3ClientConfig(),
+			Request:     c.S3RequestOptions(),
+			AsOf:        c.asOf,
+			VersionId:   c.versionId,
+			Restore:     c.S3RestoreOptions(),
+			Mapping:     c.PathMapping(),
+			Stripe:      c.StripeOptions(),
+
+			StreamWindow:  c.streamWindow,
+			Decompress:    c.decompress,
+			Extract:       c.extract,
+			Range:         c.ByteRange(),
+			Concat:        c.concat,
+			Pack:          c.PackOptions(),
+			Manifest:      c.manifestOut,
+			PreserveMtime: c.preserveMtime,
+			Xattrs:        c.xattrs,
+			XattrTags:     c.xattrTags,
+			Log:           log,
+			Bar:           bar,
+		}
+		if c.StreamsToStdout() {
+			d.Writepath = ""
+			d.Stream = os.Stdout
 		}
 		return &d, nil
 	}
@@ -118,7 +300,29 @@ func getDownloader(c *Config, log *logging.Logger, bar *pb.ProgressBar) (downloa
 	}
 
 	if !isSourceS3 && isDestinationS3 {
-		return nil, errors.New("Uploads to S3 buckets not implemented")
+		bucket, prefix := parseS3Path(c.destination)
+		if len(bucket) == 0 {
+			return nil, fmt.Errorf("Invalid S3 path %s", c.destination)
+		}
+		d := downloaders.S3Upload{
+			Readpath: c.source,
+			Bucket:   bucket,
+			Prefix:   prefix,
+			Workers:  c.workers,
+			Threads:  c.threads,
+			Partsize: c.partsize,
+			MaxList:  c.maxList,
+			Client:   c.DestinationS3ClientConfig(),
+			Request:  c.S3RequestOptions(),
+			Xattrs:   c.xattrs,
+			Log:      log,
+			Bar:      bar,
+		}
+		if c.StreamsFromStdin() {
+			d.Readpath = ""
+			d.Stream = os.Stdin
+		}
+		return &d, nil
 	}
 
 	if !isSourceS3 && !isDestinationS3 {
@@ -130,6 +334,9 @@ func getDownloader(c *Config, log *logging.Logger, bar *pb.ProgressBar) (downloa
 			Partsize:    c.partsize,
 			MaxList:     c.maxList,
 			IsBenchmark: c.isBenchmark,
+			Mapping:     c.PathMapping(),
+			Stripe:      c.StripeOptions(),
+			Manifest:    c.manifestOut,
 			Log:         log,
 			Bar:         bar,
 		}
@@ -138,3 +345,111 @@ func getDownloader(c *Config, log *logging.Logger, bar *pb.ProgressBar) (downloa
 
 	return nil, errors.New("Unsupported cp operation")
 }
+
+// Returns a downloader that extracts or lists the members of a zip object
+func getZipExtract(c *Config, log *logging.Logger, bar *pb.ProgressBar) (downloaders.Downloader, error) {
+	bucket, key := parseS3Path(c.source)
+	if len(bucket) == 0 {
+		return nil, fmt.Errorf("Invalid S3 path %s", c.source)
+	}
+	d := downloaders.ZipExtract{
+		Bucket:    bucket,
+		Key:       key,
+		VersionId: c.versionId,
+		Writepath: c.destination,
+		Include:   c.zipInclude,
+		Workers:   c.workers,
+		Threads:   c.threads,
+		Partsize:  c.partsize,
+		Client:    c.SourceS3ClientConfig(),
+		Request:   c.S3RequestOptions(),
+		Log:       log,
+		Bar:       bar,
+	}
+	if c.zipList {
+		d.List = os.Stdout
+	}
+	return &d, nil
+}
+
+// Returns a downloader that indexes the source tar object with --index-tar, or that extracts files from it using its index
+func getTarIndexDownloader(c *Config, log *logging.Logger, bar *pb.ProgressBar) (downloaders.Downloader, error) {
+	bucket, key := parseS3Path(c.source)
+	if len(bucket) == 0 {
+		return nil, fmt.Errorf("Invalid S3 path %s", c.source)
+	}
+	index := downloaders.TarIndexLocation{Path: c.TarIndexPath()}
+	if strings.HasPrefix(index.Path, "s3://") {
+		index.Bucket, index.Key = parseS3Path(index.Path)
+		if len(index.Bucket) == 0 || len(index.Key) == 0 {
+			return nil, fmt.Errorf("Invalid S3 path %s", index.Path)
+		}
+		index.Path = ""
+	}
+
+	if c.indexTar {
+		return &downloaders.TarIndexer{
+			Bucket:    bucket,
+			Key:       key,
+			VersionId: c.versionId,
+			Index:     index,
+			Client:    c.SourceS3ClientConfig(),
+			Request:   c.S3RequestOptions(),
+			Log:       log,
+			Bar:       bar,
+		}, nil
+	}
+	return &downloaders.TarExtract{
+		Bucket:    bucket,
+		Key:       key,
+		VersionId: c.versionId,
+		Index:     index,
+		Writepath: c.destination,
+		Include:   c.tarInclude,
+		Workers:   c.workers,
+		Threads:   c.threads,
+		Partsize:  c.partsize,
+		Client:    c.SourceS3ClientConfig(),
+		Request:   c.S3RequestOptions(),
+		Log:       log,
+		Bar:       bar,
+	}, nil
+}
+
+// Returns a downloader that copies the source to every destination
+func getFanOut(c *Config, log *logging.Logger, bar *pb.ProgressBar) (downloaders.Downloader, error) {
+	d := downloaders.FanOut{
+		Workers:           c.workers,
+		Threads:           c.threads,
+		Partsize:          c.partsize,
+		MaxList:           c.maxList,
+		SourceClient:      c.SourceS3ClientConfig(),
+		DestinationClient: c.DestinationS3ClientConfig(),
+		Request:           c.S3RequestOptions(),
+		Log:               log,
+		Bar:               bar,
+	}
+
+	if strings.HasPrefix(c.source, "s3://") {
+		d.Bucket, d.Prefix = parseS3Path(c.source)
+		if len(d.Bucket) == 0 {
+			return nil, fmt.Errorf("Invalid S3 path %s", c.source)
+		}
+	} else {
+		d.Readpath = c.source
+	}
+
+	for _, dest := range c.destinations {
+		if !strings.HasPrefix(dest, "s3://") {
+			d.Destinations = append(d.Destinations, downloaders.FanOutDestination{Path: dest})
+			continue
+		}
+
+		bucket, prefix := parseS3Path(dest)
+		if len(bucket) == 0 {
+			return nil, fmt.Errorf("Invalid S3 path %s", dest)
+		}
+		d.Destinations = append(d.Destinations, downloaders.FanOutDestination{Bucket: bucket, Prefix: prefix})
+	}
+	return &d, nil
+}
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"github.com/aws/smithy-go"
+	"github.com/cobookman/s3-parallel-downloader/downloaders"
 	"github.com/stretchr/testify/assert"
+	"os"
 	"reflect"
+	"syscall"
 	"testing"
 )
 
@@ -20,6 +26,22 @@ var s3PathTests = []s3PathTest{
 	s3PathTest{"my-bucket", "", ""},
 	s3PathTest{"s3:my-bucket", "", ""},
 	s3PathTest{"s3:/my-bucket", "", ""},
+	s3PathTest{"s3://my-ap-hrzrlukc5m36ft7okagglf3gmwluquse1b-s3alias/data", "my-ap-hrzrlukc5m36ft7okagglf3gmwluquse1b-s3alias", "data"},
+	s3PathTest{"s3://mybucket--usw2-az1--x-s3/data/", "mybucket--usw2-az1--x-s3", "data/"},
+	s3PathTest{"s3://arn:aws:s3:us-west-2:123456789012:accesspoint/my-ap/data/part-0",
+		"arn:aws:s3:us-west-2:123456789012:accesspoint/my-ap", "data/part-0"},
+	s3PathTest{"s3://arn:aws:s3:us-west-2:123456789012:accesspoint/my-ap",
+		"arn:aws:s3:us-west-2:123456789012:accesspoint/my-ap", ""},
+	s3PathTest{"s3://arn:aws:s3::123456789012:accesspoint/mfzwi23gnjvgw.mrap/data/",
+		"arn:aws:s3::123456789012:accesspoint/mfzwi23gnjvgw.mrap", "data/"},
+	s3PathTest{"s3://arn:aws:s3-outposts:us-west-2:123456789012:outpost/op-01ac5d28a6a232904/accesspoint/my-ap/data",
+		"arn:aws:s3-outposts:us-west-2:123456789012:outpost/op-01ac5d28a6a232904/accesspoint/my-ap", "data"},
+	s3PathTest{"s3://arn:aws:s3:us-west-2:123456789012:accesspoint", "", ""},
+	s3PathTest{"s3://arn:aws:s3:us-west-2:123456789012:accesspoint//data", "", ""},
+	s3PathTest{"s3://arn:aws:ec2:us-west-2:123456789012:instance/i-123", "", ""},
+	s3PathTest{"s3://arn:aws:s3:us-west-2:123456789012:bucket/my-bucket/data", "", ""},
+	s3PathTest{"s3://arn:aws:s3-object-lambda:us-west-2:123456789012:accesspoint/my-olap/data", "", ""},
+	s3PathTest{"s3://arn:aws:s3-outposts:us-west-2:123456789012:outpost/op-01ac5d28a6a232904/bucket/my-bucket/data", "", ""},
 }
 
 func TestParseS3Path(t *testing.T) {
@@ -53,4 +75,97 @@ func TestGetDownloader(t *testing.T) {
 	assert.Equal(t, "*downloaders.FilesystemDownload", reflect.TypeOf(fsDownloader).String(),
 		"downloader should be of right type")
 
+	// Test for filesystem to S3 upload
+	upc, err := NewConfig([]string{"s3pd", "/mnt/path1/", "s3://mybucket/prefix"})
+	assert.Equal(t, nil, err, "NewConfig should not return an error for valid syntax")
+
+	uploader, err := getDownloader(upc, nil, nil)
+	assert.Equal(t, nil, err, "Getting the downloader should not have an error")
+	assert.Equal(t, "*downloaders.S3Upload", reflect.TypeOf(uploader).String(),
+		"downloader should be of right type")
+
+	// Test for streaming to stdout
+	streamc, err := NewConfig([]string{"s3pd", "s3://mybucket/big.tar", "-"})
+	assert.Equal(t, nil, err, "NewConfig should not return an error for valid syntax")
+
+	streamer, err := getDownloader(streamc, nil, nil)
+	assert.Equal(t, nil, err, "Getting the downloader should not have an error")
+	assert.Equal(t, os.Stdout, streamer.(*downloaders.S3Download).Stream, "objects should be streamed to stdout")
+
+	// Test for concatenating objects into one file
+	concatc, err := NewConfig([]string{"s3pd", "--concat=/mnt/out.bin", "s3://mybucket/prefix/part-"})
+	assert.Equal(t, nil, err, "NewConfig should not return an error for valid syntax")
+
+	concatenator, err := getDownloader(concatc, nil, nil)
+	assert.Equal(t, nil, err, "Getting the downloader should not have an error")
+	assert.Equal(t, "/mnt/out.bin", concatenator.(*downloaders.S3Download).Concat, "objects should be concatenated")
+
+	// Test for extracting zip members
+	zipc, err := NewConfig([]string{"s3pd", "--zip-include=*.csv", "s3://mybucket/archive.zip", "/mnt/path1/"})
+	assert.Equal(t, nil, err, "NewConfig should not return an error for valid syntax")
+
+	zipExtract, err := getDownloader(zipc, nil, nil)
+	assert.Equal(t, nil, err, "Getting the downloader should not have an error")
+	assert.Equal(t, "*downloaders.ZipExtract", reflect.TypeOf(zipExtract).String(),
+		"downloader should be of right type")
+
+	// Test for indexing a tar object, and extracting files using its index
+	indexc, err := NewConfig([]string{"s3pd", "--index-tar", "s3://mybucket/dataset.tar"})
+	assert.Equal(t, nil, err, "NewConfig should not return an error for valid syntax")
+
+	indexer, err := getDownloader(indexc, nil, nil)
+	assert.Equal(t, nil, err, "Getting the downloader should not have an error")
+	assert.Equal(t, downloaders.TarIndexLocation{Bucket: "mybucket", Key: "dataset.tar.index.tsv"}, indexer.(*downloaders.TarIndexer).Index,
+		"the index should be stored next to the tar object")
+
+	tarc, err := NewConfig([]string{"s3pd", "--tar-include=*.jpg", "--tar-index=/mnt/dataset.tsv", "s3://mybucket/dataset.tar", "/mnt/path1/"})
+	assert.Equal(t, nil, err, "NewConfig should not return an error for valid syntax")
+
+	tarExtract, err := getDownloader(tarc, nil, nil)
+	assert.Equal(t, nil, err, "Getting the downloader should not have an error")
+	assert.Equal(t, downloaders.TarIndexLocation{Path: "/mnt/dataset.tsv"}, tarExtract.(*downloaders.TarExtract).Index,
+		"the index should be read from the local file")
+
+	// Test for uploading stdin
+	stdinc, err := NewConfig([]string{"s3pd", "-", "s3://mybucket/data.tar"})
+	assert.Equal(t, nil, err, "NewConfig should not return an error for valid syntax")
+
+	stdinUploader, err := getDownloader(stdinc, nil, nil)
+	assert.Equal(t, nil, err, "Getting the downloader should not have an error")
+	assert.Equal(t, os.Stdin, stdinUploader.(*downloaders.S3Upload).Stream, "stdin should be uploaded")
+
+	// Test for copying to several destinations
+	fanc, err := NewConfig([]string{"s3pd", "s3://mybucket/prefix/", "/mnt/path1/", "s3://mirror/prefix/"})
+	assert.Equal(t, nil, err, "NewConfig should not return an error for valid syntax")
+
+	fanOut, err := getDownloader(fanc, nil, nil)
+	assert.Equal(t, nil, err, "Getting the downloader should not have an error")
+	assert.Equal(t, "*downloaders.FanOut", reflect.TypeOf(fanOut).String(),
+		"downloader should be of right type")
+	assert.Equal(t, []downloaders.FanOutDestination{{Path: "/mnt/path1/"}, {Bucket: "mirror", Prefix: "prefix/"}},
+		fanOut.(*downloaders.FanOut).Destinations)
+}
+
+func TestExitCode(t *testing.T) {
+	assert.Equal(t, exitSuccess, exitCode(nil, nil, true))
+	assert.Equal(t, exitError, exitCode(errors.New("no such bucket"), nil, false))
+	assert.Equal(t, exitPartial, exitCode(errors.New("no such key"), nil, true))
+	assert.Equal(t, 130, exitCode(errors.New("interrupted"), os.Interrupt, true), "SIGINT should exit with 128 + 2")
+	assert.Equal(t, 143, exitCode(errors.New("interrupted"), syscall.SIGTERM, false), "SIGTERM should exit with 128 + 15")
+	assert.Equal(t, "interrupted", exitStatuses[143])
+
+	denied := fmt.Errorf("operation error S3: GetObject: %w", &smithy.GenericAPIError{Code: "AccessDenied"})
+	assert.Equal(t, exitAuth, exitCode(denied, nil, true), "S3 denying access should be an auth error")
+
+	noCreds := fmt.Errorf("operation error S3: ListObjectsV2, get identity: %w", &downloaders.CredentialsError{Err: errors.New("no EC2 IMDS role found")})
+	assert.Equal(t, exitAuth, exitCode(noCreds, nil, false), "missing credentials should be an auth error")
+
+	mentionsIdentity := errors.New("no such key: get identity: photos/0001.jpg")
+	assert.Equal(t, exitError, exitCode(mentionsIdentity, nil, false), "only credential errors should be auth errors")
+}
+
+func TestSummaryConfigRedactsKey(t *testing.T) {
+	args := []string{"s3pd", "--sse-c-key=c2VjcmV0", "--sse-c-key", "c2VjcmV0", "s3://mybucket/prefix", "/mnt/ram-disk"}
+	sc := Config{}.summaryConfig(args)
+	assert.Equal(t, []string{"s3pd", "--sse-c-key=REDACTED", "--sse-c-key", "REDACTED", "s3://mybucket/prefix", "/mnt/ram-disk"}, sc.Args)
 }
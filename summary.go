@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/cobookman/s3-parallel-downloader/downloaders"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Exit codes s3pd returns, documented in the README
+const (
+	exitSuccess = 0
+	// the run failed before anything was transferred
+	exitError = 1
+	// the run failed after some objects were completely transferred
+	exitPartial = 2
+	// invalid flags or arguments
+	exitConfig = 3
+	// credentials couldn't be found, or S3 denied access
+	exitAuth = 4
+	// SIGINT or SIGTERM, added to the signal's number following the 128 + signal number convention. E.g. 130 for SIGINT & 143 for SIGTERM
+	exitSignal = 128
+)
+
+// Error codes S3 returns when the credentials are invalid, or don't have access
+var authErrorCodes = map[string]bool{
+	"AccessDenied":          true,
+	"AllAccessDisabled":     true,
+	"ExpiredToken":          true,
+	"Forbidden":             true,
+	"InvalidAccessKeyId":    true,
+	"InvalidToken":          true,
+	"SignatureDoesNotMatch": true,
+	"TokenRefreshRequired":  true,
+}
+
+// Whether the error is from not finding credentials, or S3 rejecting them
+func isAuthError(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && authErrorCodes[apiErr.ErrorCode()] {
+		return true
+	}
+	var respErr *smithyhttp.ResponseError
+	if errors.As(err, &respErr) && (respErr.HTTPStatusCode() == http.StatusUnauthorized || respErr.HTTPStatusCode() == http.StatusForbidden) {
+		return true
+	}
+	var credsErr *downloaders.CredentialsError
+	return errors.As(err, &credsErr)
+}
+
+// Returns the exit code for how the run finished, interrupted being the signal that interrupted it if any,
+// and transferred whether any objects were completely transferred
+func exitCode(err error, interrupted os.Signal, transferred bool) int {
+	switch {
+	case err == nil:
+		return exitSuccess
+	case interrupted != nil:
+		return exitSignal + signalNumber(interrupted)
+	case isAuthError(err):
+		return exitAuth
+	case transferred:
+		return exitPartial
+	default:
+		return exitError
+	}
+}
+
+// Number of the signal, E.g. 2 for SIGINT, falling back to SIGINT's for signals that aren't numbered
+func signalNumber(sig os.Signal) int {
+	if s, ok := sig.(syscall.Signal); ok {
+		return int(s)
+	}
+	return int(syscall.SIGINT)
+}
+
+var exitStatuses = map[int]string{
+	exitSuccess:                       "success",
+	exitError:                         "failed",
+	exitPartial:                       "partial",
+	exitConfig:                        "config_error",
+	exitAuth:                          "auth_error",
+	exitSignal + int(syscall.SIGINT):  "interrupted",
+	exitSignal + int(syscall.SIGTERM): "interrupted",
+}
+
+// JSON summary of a run written by --summary-json
+type runSummary struct {
+	Status   string `json:"status"`
+	ExitCode int    `json:"exit_code"`
+	Error    string `json:"error,omitempty"`
+
+	downloaders.SummaryTotals
+
+	Started         time.Time                 `json:"started"`
+	Finished        time.Time                 `json:"finished"`
+	WallSeconds     float64                   `json:"wall_seconds"`
+	ThroughputGibps float64                   `json:"throughput_gibps"`
+	BytesWritten    int64                     `json:"bytes_written"`
+	BytesReceived   int64                     `json:"bytes_received"`
+	Samples         []downloaders.StatsSample `json:"samples"`
+	Config          summaryConfig             `json:"config"`
+}
+
+// Settings of the run reported in the summary
+type summaryConfig struct {
+	Args        []string `json:"args"`
+	Source      string   `json:"source"`
+	Destination string   `json:"destination"`
+	Region      string   `json:"region,omitempty"`
+	EndpointURL string   `json:"endpoint_url,omitempty"`
+	Workers     uint     `json:"workers"`
+	Threads     uint     `json:"threads"`
+	Partsize    int64    `json:"partsize"`
+	MaxList     int      `json:"max_list"`
+	NICs        []string `json:"nics,omitempty"`
+	Benchmark   bool     `json:"benchmark"`
+}
+
+// Returns the settings reported in the summary, with the SSE-C key in args redacted
+func (c Config) summaryConfig(args []string) summaryConfig {
+	redacted := make([]string, len(args))
+	for i, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "--sse-c-key="):
+			arg = "--sse-c-key=REDACTED"
+		case i > 0 && args[i-1] == "--sse-c-key":
+			arg = "REDACTED"
+		}
+		redacted[i] = arg
+	}
+
+	return summaryConfig{
+		Args:        redacted,
+		Source:      c.source,
+		Destination: c.destination,
+		Region:      c.region,
+		EndpointURL: c.endpointURL,
+		Workers:     c.workers,
+		Threads:     c.threads,
+		Partsize:    c.partsize,
+		MaxList:     c.maxList,
+		NICs:        c.NicsArr(),
+		Benchmark:   c.isBenchmark,
+	}
+}
+
+func writeSummary(path string, s runSummary) error {
+	s.Status = exitStatuses[s.ExitCode]
+	s.WallSeconds = s.Finished.Sub(s.Started).Seconds()
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}